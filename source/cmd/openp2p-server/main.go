@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"openp2p/core"
+	"openp2p/server"
+	"openp2p/server/natdetect"
+)
+
+func main() {
+	port := flag.Int("port", core.WsPort, "websocket listen port")
+	certFile := flag.String("cert", "", "TLS cert file, empty to use a self-signed cert")
+	keyFile := flag.String("key", "", "TLS key file")
+	usersFile := flag.String("users", "", `users file: {"user":token}, empty to accept any token`)
+	revokedFile := flag.String("revoked", "", `revoked node identities file: ["identity"], reloaded on SIGHUP`)
+	loginMaxDelay := flag.Int("loginmaxdelay", 0, "max seconds clients delay before reconnect")
+	natDetect := flag.Bool("natdetect", true, "serve nat detection and public ip echo")
+	natIP := flag.String("natip", "", "primary public ip of nat detection, needed by -natalt")
+	natAltIP := flag.String("natalt", "", "alternate public ip of this host, enables nat mapping and filtering classification")
+	flag.Parse()
+
+	s, err := server.New(server.Config{
+		Port:          *port,
+		CertFile:      *certFile,
+		KeyFile:       *keyFile,
+		UsersFile:     *usersFile,
+		LoginMaxDelay: *loginMaxDelay,
+		RevokedFile:   *revokedFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	var nd *natdetect.Server
+	if *natDetect {
+		nd = natdetect.New(natdetect.Config{IP: *natIP, AltIP: *natAltIP})
+		if err = nd.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if err := s.ReloadRevoked(); err != nil {
+				log.Printf("reload %s error:%s", *revokedFile, err)
+			}
+		}
+	}()
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		if nd != nil {
+			nd.Close()
+		}
+		s.Close()
+	}()
+	if err = s.ListenAndServe(); err != nil {
+		log.Fatal(err)
+	}
+}
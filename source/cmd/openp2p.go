@@ -9,6 +9,7 @@ import (
 )
 
 var isDev = flag.Bool("dev", false, "Run in development mode")
+var metricsAddr = flag.String("metrics", "", "Prometheus metrics listen address, e.g. :9100")
 
 func main() {
 	flag.Parse()
@@ -47,6 +48,7 @@ func main() {
 
 	// 初始化 API 路由
 	core.InitAPIRoutes()
+	core.StartMetrics(*metricsAddr)
 
 	// 保持程序运行
 	select {}
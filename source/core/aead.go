@@ -0,0 +1,162 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// overlay data cipher suites, the client picks one in OverlayConnectReq.
+// empty is the legacy AES-CBC of encryptBytes, used with peers before SupportAEADVersion.
+const (
+	CipherLegacy = ""
+	CipherAESGCM = "aes-256-gcm"
+)
+
+const (
+	aeadNoncePrefixSize = 4
+	aeadNonceSize       = aeadNoncePrefixSize + 8 // random prefix + seq
+	aeadTagSize         = 16
+	aeadOverhead        = aeadNonceSize + aeadTagSize
+	aeadSaltSize        = 16
+	replayWindowSize    = 64
+)
+
+var (
+	ErrCipherNotSupport = errors.New("cipher not support")
+	ErrDecrypt          = errors.New("decrypt error")
+	ErrReplay           = errors.New("replayed packet")
+)
+
+func isCipherSupported(suite string) bool {
+	return suite == CipherLegacy || suite == CipherAESGCM
+}
+
+func newCipherSalt() []byte {
+	salt := make([]byte, aeadSaltSize)
+	rand.Read(salt)
+	return salt
+}
+
+// aeadCipher seals each packet as nonce|ciphertext|tag. nonce is a random prefix
+// chosen per sender and an increasing seq, the receiver rejects seen or too old seq.
+type aeadCipher struct {
+	send   cipher.AEAD
+	recv   cipher.AEAD
+	prefix [aeadNoncePrefixSize]byte
+	seq    atomic.Uint64 // aligned on 32-bit platforms
+	replay replayWindow
+}
+
+// newAEADCipher derives one key per direction from the shared secret, so both
+// sides never encrypt with the same key and nonce
+func newAEADCipher(suite string, secret []byte, salt []byte, label string, isClient bool) (*aeadCipher, error) {
+	if suite != CipherAESGCM {
+		return nil, ErrCipherNotSupport
+	}
+	c2s, err := newAESGCM(hkdfSHA256(secret, salt, []byte(label+" c2s "+suite), 32))
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newAESGCM(hkdfSHA256(secret, salt, []byte(label+" s2c "+suite), 32))
+	if err != nil {
+		return nil, err
+	}
+	c := &aeadCipher{send: c2s, recv: s2c}
+	if !isClient {
+		c.send, c.recv = s2c, c2s
+	}
+	rand.Read(c.prefix[:])
+	return c, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal appends the sealed plain to out[:0], out needs len(plain)+aeadOverhead capacity
+func (c *aeadCipher) seal(out, plain, additional []byte) []byte {
+	nonce := out[:aeadNonceSize]
+	copy(nonce, c.prefix[:])
+	binary.LittleEndian.PutUint64(nonce[aeadNoncePrefixSize:], c.seq.Add(1))
+	return c.send.Seal(nonce, nonce, plain, additional)
+}
+
+// open decrypts into out[:0], the seq is accepted only after authentication
+func (c *aeadCipher) open(out, in, additional []byte) ([]byte, error) {
+	if len(in) < aeadOverhead {
+		return nil, ErrDecrypt
+	}
+	nonce := in[:aeadNonceSize]
+	plain, err := c.recv.Open(out[:0], nonce, in[aeadNonceSize:], additional)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if !c.replay.check(binary.LittleEndian.Uint64(nonce[aeadNoncePrefixSize:])) {
+		return nil, ErrReplay
+	}
+	return plain, nil
+}
+
+// sliding window like ipsec, seq starts from 1
+type replayWindow struct {
+	mtx    sync.Mutex
+	top    uint64
+	bitmap uint64 // bit i is top-i
+}
+
+// check returns false if seq is seen or out of the window, otherwise marks it
+func (w *replayWindow) check(seq uint64) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if seq == 0 {
+		return false
+	}
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= replayWindowSize {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.top = seq
+		return true
+	}
+	diff := w.top - seq
+	if diff >= replayWindowSize || w.bitmap&(1<<diff) != 0 {
+		return false
+	}
+	w.bitmap |= 1 << diff
+	return true
+}
+
+// RFC 5869
+func hkdfSHA256(secret, salt, info []byte, size int) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	okm := []byte{}
+	var prev []byte
+	for i := byte(1); len(okm) < size; i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(prev)
+		expand.Write(info)
+		expand.Write([]byte{i})
+		prev = expand.Sum(nil)
+		okm = append(okm, prev...)
+	}
+	return okm[:size]
+}
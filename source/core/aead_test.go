@@ -0,0 +1,64 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAEADCipher(t *testing.T) {
+	secret := []byte("0123456789ABCDEF")
+	salt := newCipherSalt()
+	client, err := newAEADCipher(CipherAESGCM, secret, salt, "test", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := newAEADCipher(CipherAESGCM, secret, salt, "test", false)
+	head := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	plain := bytes.Repeat([]byte("0123456789"), 10)
+
+	sealed := client.seal(make([]byte, len(plain)+aeadOverhead), plain, head)
+	if len(sealed) != len(plain)+aeadOverhead || bytes.Contains(sealed, plain[:16]) {
+		t.Errorf("seal error len=%d", len(sealed))
+	}
+	again := client.seal(make([]byte, len(plain)+aeadOverhead), plain, head)
+	if bytes.Equal(sealed, again) {
+		t.Errorf("same plaintext sealed to same ciphertext")
+	}
+	out, err := server.open(make([]byte, len(sealed)), sealed, head)
+	if err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("open error:%v", err)
+	}
+	if _, err = server.open(make([]byte, len(sealed)), sealed, head); err != ErrReplay {
+		t.Errorf("replay not detected:%v", err)
+	}
+	// own direction can not be opened by itself
+	if _, err = client.open(make([]byte, len(again)), again, head); err != ErrDecrypt {
+		t.Errorf("direction key error:%v", err)
+	}
+	tampered := append([]byte{}, again...)
+	tampered[aeadNonceSize] ^= 1
+	if _, err = server.open(make([]byte, len(tampered)), tampered, head); err != ErrDecrypt {
+		t.Errorf("tamper not detected:%v", err)
+	}
+	if _, err = server.open(make([]byte, len(again)), again, []byte("otherhead")); err != ErrDecrypt {
+		t.Errorf("additional data not authenticated:%v", err)
+	}
+	if _, err = server.open(make([]byte, len(again)), again, head); err != nil {
+		t.Errorf("open after failures error:%v", err)
+	}
+	if _, err = newAEADCipher("rc4", secret, salt, "test", true); err != ErrCipherNotSupport {
+		t.Errorf("unknown cipher error:%v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := replayWindow{}
+	for _, c := range []struct {
+		seq uint64
+		ok  bool
+	}{{0, false}, {1, true}, {3, true}, {2, true}, {2, false}, {100, true}, {37, true}, {36, false}, {37, false}, {101, true}, {99, true}} {
+		if w.check(c.seq) != c.ok {
+			t.Errorf("seq %d want %t", c.seq, c.ok)
+		}
+	}
+}
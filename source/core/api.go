@@ -11,8 +11,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,13 +33,6 @@ type User struct {
 	Email       string    `json:"email"`
 }
 
-// 用户存储
-var (
-	adminUser *User
-	users     = make(map[string]User)
-	userLock  sync.RWMutex
-)
-
 // API响应结构
 type APIResponse struct {
 	Code    int         `json:"code"`
@@ -56,6 +51,12 @@ type NodeStatus struct {
 	Bandwidth int       `json:"bandwidth"`
 	LastSeen  time.Time `json:"lastSeen"`
 	Token     string    `json:"token"`
+	Relay     bool      `json:"relay"` // 当前是否走中继
+	// 应用流量和承载应用的隧道流量，隧道流量包含同一对端的其他应用
+	Traffic       TrafficSnapshot `json:"traffic"`
+	TunnelTraffic TrafficSnapshot `json:"tunnelTraffic"`
+	// 心跳测得的往返时延、抖动和丢包率
+	RTT RTTSnapshot `json:"rtt"`
 }
 
 // 统计数据结构
@@ -64,6 +65,8 @@ type Stats struct {
 	ActiveConnections int     `json:"activeConnections"`
 	TotalTraffic      float64 `json:"totalTraffic"`
 	AvgLatency        int     `json:"avgLatency"`
+	// 直连、中继和为其他节点转发的流量明细
+	Traffic NodeTrafficSnapshot `json:"traffic"`
 }
 
 var isDevelopment = false // 默认为生产模式
@@ -104,13 +107,22 @@ func generateTOTPKey() string {
 	return strings.ToUpper(base32.StdEncoding.EncodeToString(bytes))
 }
 
-// InitConfig 初始化配置
+// InitConfig 初始化配置，加载上次保存的节点、映射和高级映射
 func InitConfig() error {
+	if gLog == nil {
+		gLog = NewLogger(filepath.Dir(os.Args[0]), ProductName, LvINFO, 1024*1024, LogFile|LogConsole)
+	}
+	if err := gUserManager.Init(); err != nil {
+		return err
+	}
 	// 在开发模式下使用默认配置
 	if isDevelopment {
 		return nil
 	}
-	return nil
+	if err := gConf.load(); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("加载配置失败: %v", err)
+	}
+	return loadAdvancedMappings()
 }
 
 // InitP2PNetwork 初始化P2P网络
@@ -143,6 +155,40 @@ var (
 	advancedMappingLock sync.RWMutex
 )
 
+const advancedMappingsFile = "advanced_mappings.json"
+
+// 加载高级映射
+func loadAdvancedMappings() error {
+	data, err := os.ReadFile(advancedMappingsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取高级映射失败: %v", err)
+	}
+	mappings := make(map[string]*AdvancedMapping)
+	if err = json.Unmarshal(data, &mappings); err != nil {
+		return fmt.Errorf("解析高级映射失败: %v", err)
+	}
+	advancedMappingLock.Lock()
+	advancedMappings = mappings
+	advancedMappingLock.Unlock()
+	return nil
+}
+
+// 保存高级映射，调用方需持有 advancedMappingLock
+func saveAdvancedMappings() error {
+	data, err := json.MarshalIndent(advancedMappings, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(advancedMappingsFile, data, 0644); err != nil {
+		log.Printf("保存高级映射失败: %v", err)
+		return err
+	}
+	return nil
+}
+
 // 添加CORS中间件
 func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -178,31 +224,37 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 // InitAPIRoutes 初始化API路由
 func InitAPIRoutes() {
-	// 认证相关路由
+	// 认证相关路由，注册、登录和检查管理员无需登录
 	http.HandleFunc("/api/auth/register", corsMiddleware(handleRegister))
 	http.HandleFunc("/api/auth/login", corsMiddleware(handleLogin))
-	http.HandleFunc("/api/auth/reset-totp", corsMiddleware(handleResetTOTP))
 	http.HandleFunc("/api/auth/check-admin", corsMiddleware(handleCheckAdmin))
-	http.HandleFunc("/api/auth/delete-admin", corsMiddleware(handleDeleteAdmin))
+	http.HandleFunc("/api/auth/reset-totp", corsMiddleware(authMiddleware(RoleReadOnly, RoleReadOnly, handleResetTOTP)))
+	http.HandleFunc("/api/auth/refresh", corsMiddleware(authMiddleware(RoleReadOnly, RoleReadOnly, handleRefreshToken)))
+	http.HandleFunc("/api/auth/logout", corsMiddleware(authMiddleware(RoleReadOnly, RoleReadOnly, handleLogout)))
 
 	// 用户信息相关路由
-	http.HandleFunc("/api/user/info", corsMiddleware(handleUserInfo))
+	http.HandleFunc("/api/user/info", corsMiddleware(authMiddleware(RoleReadOnly, RoleReadOnly, handleUserInfo)))
 
-	// 其他API路由
-	http.HandleFunc("/api/stats", corsMiddleware(handleStats))
-	http.HandleFunc("/api/nodes", corsMiddleware(handleNodes))
-	http.HandleFunc("/api/nodes/", corsMiddleware(handleNodeOperation))
-	http.HandleFunc("/api/mappings", corsMiddleware(handleMappings))
-	http.HandleFunc("/api/logs", corsMiddleware(handleLogs))
+	// 用户管理路由，仅管理员
+	http.HandleFunc("/api/users", corsMiddleware(authMiddleware(RoleAdmin, RoleAdmin, handleUsers)))
+	http.HandleFunc("/api/users/", corsMiddleware(authMiddleware(RoleAdmin, RoleAdmin, handleUserOperation)))
 
-	// 客户端API
+	// 其他API路由
+	http.HandleFunc("/api/stats", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleStats)))
+	http.HandleFunc("/api/nodes", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleNodes)))
+	http.HandleFunc("/api/nodes/", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleNodeOperation)))
+	http.HandleFunc("/api/mappings", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleMappings)))
+	http.HandleFunc("/api/logs", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleLogs)))
+	http.HandleFunc("/api/logs/stream", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleLogStream)))
+
+	// 客户端API，调用方是节点而不是管理用户，不走authMiddleware，由各处理函数用findNodeByToken校验节点token
 	http.HandleFunc("/api/client/verify", corsMiddleware(handleClientVerify))
 	http.HandleFunc("/api/client/connect", corsMiddleware(handleClientConnect))
 	http.HandleFunc("/api/client/heartbeat", corsMiddleware(handleClientHeartbeat))
 
 	// 高级映射相关路由
-	http.HandleFunc("/api/advanced-mappings", corsMiddleware(handleAdvancedMappings))
-	http.HandleFunc("/api/advanced-mappings/", corsMiddleware(handleAdvancedMappingOperation))
+	http.HandleFunc("/api/advanced-mappings", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleAdvancedMappings)))
+	http.HandleFunc("/api/advanced-mappings/", corsMiddleware(authMiddleware(RoleReadOnly, RoleOperator, handleAdvancedMappingOperation)))
 
 	// 启动HTTP服务器
 	go func() {
@@ -214,18 +266,15 @@ func InitAPIRoutes() {
 	}()
 }
 
-// 注册处理
+// 注册处理，仅用于创建第一个管理员
 func handleRegister(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	userLock.Lock()
-	defer userLock.Unlock()
-
 	// 检查是否已存在管理员
-	if adminUser != nil {
+	if gUserManager.HasAdmin() {
 		responseJSON(w, APIResponse{Code: 1, Message: "Administrator already exists"})
 		return
 	}
@@ -234,7 +283,7 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		Username string `json:"username"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&userData); err != nil || userData.Username == "" {
 		responseJSON(w, APIResponse{Code: 1, Message: "Invalid request body"})
 		return
 	}
@@ -247,11 +296,9 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 创建管理员用户
-	adminUser = &User{
-		Username: userData.Username,
-		TOTPKey:  totpKey,
-		Role:     "admin",
-		Created:  time.Now(),
+	if err := gUserManager.CreateAdmin(userData.Username, totpKey); err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+		return
 	}
 
 	// 生成测试环境的验证码
@@ -260,27 +307,29 @@ func handleRegister(w http.ResponseWriter, r *http.Request) {
 		testCode = "123456" // 在开发模式下使用固定的测试验证码
 	}
 
-	// 生成 QR 码 URL（使用自定义 issuer）
-	issuer := "OpenP2P-Private"
-	if isDevelopment {
-		issuer += "-Dev"
-	}
-	qrURL := fmt.Sprintf("data:image/png;base64,%s",
-		generateQRCode(fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s",
-			userData.Username, totpKey, issuer)))
-
 	// 返回TOTP密钥和二维码URL
 	responseJSON(w, APIResponse{
 		Code:    0,
 		Message: "Registration successful",
 		Data: map[string]interface{}{
 			"totp_key":  totpKey,
-			"qr_url":    qrURL,
+			"qr_url":    totpQRURL(userData.Username, totpKey),
 			"test_code": testCode,
 		},
 	})
 }
 
+// 生成TOTP二维码（使用自定义 issuer）
+func totpQRURL(username string, totpKey string) string {
+	issuer := "OpenP2P-Private"
+	if isDevelopment {
+		issuer += "-Dev"
+	}
+	return fmt.Sprintf("data:image/png;base64,%s",
+		generateQRCode(fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s",
+			username, totpKey, issuer)))
+}
+
 // 生成QR码
 func generateQRCode(content string) string {
 	// 使用 qrcode 包生成二维码
@@ -320,38 +369,41 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userLock.RLock()
-	defer userLock.RUnlock()
-
 	// 检查用户是否存在
-	if adminUser == nil || adminUser.Username != loginData.Username {
-		log.Printf("Invalid username: %s, adminUser exists: %v", loginData.Username, adminUser != nil)
+	user, exists := gUserManager.GetUser(loginData.Username)
+	if !exists {
+		log.Printf("Invalid username: %s", loginData.Username)
 		responseJSON(w, APIResponse{Code: 1, Message: "Invalid username"})
 		return
 	}
 
 	// 验证TOTP码
-	if !validateTOTP(adminUser.TOTPKey, loginData.TOTPCode) {
+	if !validateTOTP(user.TOTPKey, loginData.TOTPCode) {
 		log.Printf("Invalid TOTP code: %s for user: %s", loginData.TOTPCode, loginData.Username)
 		responseJSON(w, APIResponse{Code: 1, Message: "Invalid TOTP code"})
 		return
 	}
 
 	// 生成会话token
-	token := generateToken(adminUser.Username)
+	token, session, err := gSessions.create(user.Username)
+	if err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: "Failed to create session"})
+		return
+	}
 
 	log.Printf("Login successful for user: %s", loginData.Username)
 	responseJSON(w, APIResponse{
 		Code:    0,
 		Message: "Login successful",
-		Data: map[string]string{
-			"token": token,
-			"role":  adminUser.Role,
+		Data: map[string]interface{}{
+			"token":   token,
+			"role":    user.Role,
+			"expires": session.Expires.Unix(),
 		},
 	})
 }
 
-// 重置TOTP密钥
+// 重置当前用户的TOTP密钥
 func handleResetTOTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -368,24 +420,31 @@ func handleResetTOTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userLock.Lock()
-	defer userLock.Unlock()
-
-	if !validateTOTP(adminUser.TOTPKey, resetData.CurrentTOTPCode) {
+	username := sessionUser(r)
+	user, exists := gUserManager.GetUser(username)
+	if !exists {
+		responseJSON(w, APIResponse{Code: 1, Message: "User not found"})
+		return
+	}
+	if !validateTOTP(user.TOTPKey, resetData.CurrentTOTPCode) {
 		responseJSON(w, APIResponse{Code: 1, Message: "Invalid TOTP code"})
 		return
 	}
 
-	// 生成新的TOTP密钥
+	// 生成新的TOTP密钥，旧的会话全部作废
 	newTOTPKey := generateTOTPKey()
-	adminUser.TOTPKey = newTOTPKey
+	if err := gUserManager.ResetTOTP(username, newTOTPKey); err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+		return
+	}
+	gSessions.revokeUser(username)
 
 	responseJSON(w, APIResponse{
 		Code:    0,
 		Message: "TOTP key reset successful",
 		Data: map[string]string{
 			"totp_key": newTOTPKey,
-			"qr_url":   "otpauth://totp/" + adminUser.Username + "?secret=" + newTOTPKey + "&issuer=OpenP2P",
+			"qr_url":   "otpauth://totp/" + username + "?secret=" + newTOTPKey + "&issuer=OpenP2P",
 		},
 	})
 }
@@ -440,13 +499,6 @@ func validateTOTPAtTime(key []byte, code uint64, t time.Time) bool {
 	return hotp == code
 }
 
-// 辅助函数：生成token
-func generateToken(username string) string {
-	bytes := make([]byte, 32)
-	rand.Read(bytes)
-	return base64.StdEncoding.EncodeToString(bytes)
-}
-
 // 辅助函数：JSON响应
 func responseJSON(w http.ResponseWriter, response APIResponse) {
 	w.Header().Set("Content-Type", "application/json")
@@ -461,11 +513,14 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 获取实时统计数据
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
 	stats := Stats{
 		OnlineNodes:       len(gConf.Apps),
 		ActiveConnections: getActiveConnections(),
 		TotalTraffic:      calculateTotalTraffic(),
 		AvgLatency:        calculateAvgLatency(),
+		Traffic:           NodeTraffic(),
 	}
 
 	responseJSON(w, APIResponse{Code: 0, Data: stats})
@@ -473,24 +528,12 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 
 // 节点管理处理
 func handleNodes(w http.ResponseWriter, r *http.Request) {
-	// 获取请求中的token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Unauthorized"})
-		return
-	}
-
-	// 解析token获取用户名
-	username := parseToken(token)
-	if username == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token"})
-		return
-	}
-
 	switch r.Method {
 	case http.MethodGet:
 		// 获取所有节点状态
 		nodes := make([]NodeStatus, 0)
+		gConf.mtx.Lock()
+		defer gConf.mtx.Unlock()
 		for _, app := range gConf.Apps {
 			node := NodeStatus{
 				ID:        app.AppID,
@@ -499,10 +542,11 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 				Type:      app.AppType,
 				Status:    getNodeStatus(*app),
 				Latency:   getPeerLatency(*app),
-				Bandwidth: app.shareBandwidth,
+				Bandwidth: app.Bandwidth,
 				LastSeen:  app.connectTime,
 				Token:     app.AppToken,
 			}
+			fillNodeTraffic(&node, *app)
 			nodes = append(nodes, node)
 		}
 		responseJSON(w, APIResponse{Code: 0, Data: nodes})
@@ -533,14 +577,17 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 			AppName:        newNode.Name,
 			AppToken:       newNode.Token,
 			AppType:        newNode.Type,
-			shareBandwidth: newNode.Bandwidth,
+			Bandwidth:      newNode.Bandwidth,
 		}
 
-		// 添加节点配置
-		gConf.Apps = append(gConf.Apps, newApp)
-
-		// 保存配置
-		saveConfig()
+		// 添加节点配置并保存
+		gConf.mtx.Lock()
+		err := saveApps(append(gConf.Apps[:len(gConf.Apps):len(gConf.Apps)], newApp))
+		gConf.mtx.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "保存配置失败: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "节点添加成功", Data: newApp})
 
@@ -551,20 +598,6 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 
 // 节点操作处理（更新、删除）
 func handleNodeOperation(w http.ResponseWriter, r *http.Request) {
-	// 获取请求中的token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Unauthorized"})
-		return
-	}
-
-	// 解析token获取用户名
-	username := parseToken(token)
-	if username == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token"})
-		return
-	}
-
 	// 获取节点ID
 	path := r.URL.Path
 	parts := strings.Split(path, "/")
@@ -579,7 +612,9 @@ func handleNodeOperation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 查找节点
+	// 查找节点，修改期间持有配置锁
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
 	var targetApp *AppConfig
 	var targetIndex int
 	for i, app := range gConf.Apps {
@@ -605,10 +640,11 @@ func handleNodeOperation(w http.ResponseWriter, r *http.Request) {
 			Type:      targetApp.AppType,
 			Status:    getNodeStatus(*targetApp),
 			Latency:   getPeerLatency(*targetApp),
-			Bandwidth: targetApp.shareBandwidth,
+			Bandwidth: targetApp.Bandwidth,
 			LastSeen:  targetApp.connectTime,
 			Token:     targetApp.AppToken,
 		}
+		fillNodeTraffic(&node, *targetApp)
 		responseJSON(w, APIResponse{Code: 0, Data: node})
 
 	case http.MethodPut:
@@ -625,7 +661,8 @@ func handleNodeOperation(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 更新节点信息
+		// 更新节点信息，保存失败时恢复
+		oldApp := *targetApp
 		if updateData.Name != "" {
 			targetApp.AppName = updateData.Name
 		}
@@ -636,21 +673,26 @@ func handleNodeOperation(w http.ResponseWriter, r *http.Request) {
 			targetApp.AppType = updateData.Type
 		}
 		if updateData.Bandwidth > 0 {
-			targetApp.shareBandwidth = updateData.Bandwidth
+			targetApp.Bandwidth = updateData.Bandwidth
 		}
 
 		// 保存配置
-		saveConfig()
+		if err := saveConfig(); err != nil {
+			*targetApp = oldApp
+			responseJSON(w, APIResponse{Code: 1, Message: "保存配置失败: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "节点更新成功", Data: targetApp})
 
 	case http.MethodDelete:
 		// 删除节点
-		// 从配置中移除节点
-		gConf.Apps = append(gConf.Apps[:targetIndex], gConf.Apps[targetIndex+1:]...)
-
-		// 保存配置
-		saveConfig()
+		// 从配置中移除节点并保存
+		apps := append(append([]*AppConfig{}, gConf.Apps[:targetIndex]...), gConf.Apps[targetIndex+1:]...)
+		if err := saveApps(apps); err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "保存配置失败: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "节点删除成功"})
 
@@ -669,22 +711,59 @@ func generateUUID() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
 
-// 保存配置
-func saveConfig() {
-	// 这里应该实现配置保存逻辑
-	// 简化实现，实际应该写入配置文件
-	log.Printf("配置已更新，共有 %d 个节点", len(gConf.Apps))
+// 保存配置，调用方需持有 gConf.mtx
+func saveConfig() error {
+	if err := gConf.save(); err != nil {
+		log.Printf("保存配置失败: %v", err)
+		return err
+	}
+	log.Printf("配置已保存，共有 %d 个节点", len(gConf.Apps))
+	return nil
+}
+
+// 用新的节点列表保存配置，保存失败时保留原列表，调用方需持有 gConf.mtx
+func saveApps(apps []*AppConfig) error {
+	oldApps := gConf.Apps
+	gConf.Apps = apps
+	if err := saveConfig(); err != nil {
+		gConf.Apps = oldApps
+		return err
+	}
+	return nil
 }
 
 // 端口映射处理
+// mappingInfo 映射配置和运行时的NAT信息
+type mappingInfo struct {
+	AppConfig
+	NatBehavior     *NATBehavior `json:",omitempty"`
+	PeerNatBehavior *NATBehavior `json:",omitempty"`
+	NatDetail       string       `json:",omitempty"` // 无法直连的原因
+}
+
+// newMappingInfo 运行中的应用使用其配置中对端的NAT行为，调用方需持有gConf.mtx
+func newMappingInfo(config *AppConfig) mappingInfo {
+	natConfig := config
+	if GNetwork != nil {
+		if i, ok := GNetwork.apps.Load(config.ID()); ok {
+			natConfig = &i.(*p2pApp).config
+		}
+	}
+	info := AppInfo{}
+	info.setNATInfo(natConfig)
+	return mappingInfo{AppConfig: *config, NatBehavior: info.NatBehavior, PeerNatBehavior: info.PeerNatBehavior, NatDetail: info.NatDetail}
+}
+
 func handleMappings(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		// 获取所有映射配置
-		mappings := make([]AppConfig, 0)
+		// 获取所有映射配置，附带两端NAT行为和无法直连的原因
+		mappings := make([]mappingInfo, 0)
+		gConf.mtx.Lock()
 		for _, app := range gConf.Apps {
-			mappings = append(mappings, *app)
+			mappings = append(mappings, newMappingInfo(app))
 		}
+		gConf.mtx.Unlock()
 		responseJSON(w, APIResponse{Code: 0, Data: mappings})
 
 	case http.MethodPost:
@@ -694,8 +773,14 @@ func handleMappings(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		// 添加映射配置
-		gConf.Apps = append(gConf.Apps, &newMapping)
+		// 添加映射配置并保存
+		gConf.mtx.Lock()
+		err := saveApps(append(gConf.Apps[:len(gConf.Apps):len(gConf.Apps)], &newMapping))
+		gConf.mtx.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "保存配置失败: " + err.Error()})
+			return
+		}
 		responseJSON(w, APIResponse{Code: 0, Message: "映射添加成功"})
 
 	default:
@@ -710,32 +795,143 @@ func handleLogs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取查询参数
-	page := 1
-	pageSize := 10
-	level := ""
-
+	// 获取查询参数，兼容旧的 page/pageSize 分页
 	query := r.URL.Query()
+	limit := 10
+	if ps := query.Get("pageSize"); ps != "" {
+		if size, err := strconv.Atoi(ps); err == nil && size > 0 {
+			limit = size
+		}
+	}
+	if l := query.Get("limit"); l != "" {
+		if size, err := strconv.Atoi(l); err == nil && size > 0 {
+			limit = size
+		}
+	}
+	if limit > maxLogPageSize {
+		limit = maxLogPageSize
+	}
+	offset := 0
 	if p := query.Get("page"); p != "" {
 		if pageNum, err := strconv.Atoi(p); err == nil && pageNum > 0 {
-			page = pageNum
+			offset = (pageNum - 1) * limit
 		}
 	}
-	if ps := query.Get("pageSize"); ps != "" {
-		if size, err := strconv.Atoi(ps); err == nil && size > 0 {
-			pageSize = size
+	if o := query.Get("offset"); o != "" {
+		if n, err := strconv.Atoi(o); err == nil && n >= 0 {
+			offset = n
 		}
 	}
-	level = query.Get("level")
 
-	// 获取日志记录
-	logs, total := getSystemLogs(page, pageSize, level)
+	filter, err := logFilterFromQuery(r)
+	if err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+		return
+	}
+
+	// 读取日志文件，最新的在前
+	logs, total, err := readLogs(gLog.filePath(), filter, offset, limit)
+	if err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: "Failed to read logs"})
+		return
+	}
 	responseJSON(w, APIResponse{Code: 0, Data: map[string]interface{}{
-		"logs":  logs,
-		"total": total,
+		"logs":   logs,
+		"total":  total,
+		"offset": offset,
 	}})
 }
 
+const maxLogPageSize = 1000
+
+// 解析日志筛选参数：level 级别，start/end 毫秒时间戳，keyword 关键字
+func logFilterFromQuery(r *http.Request) (*logFilter, error) {
+	query := r.URL.Query()
+	filter := &logFilter{
+		level:   strings.ToUpper(query.Get("level")),
+		keyword: query.Get("keyword"),
+	}
+	if filter.level == "ALL" {
+		filter.level = ""
+	}
+	if filter.level == "WARNING" {
+		filter.level = "WARN"
+	}
+	for _, param := range []struct {
+		name string
+		ts   *time.Time
+	}{{"start", &filter.start}, {"end", &filter.end}} {
+		if v := query.Get(param.name); v != "" {
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", param.name)
+			}
+			*param.ts = time.UnixMilli(ms)
+		}
+	}
+	return filter, nil
+}
+
+// 实时日志，Server-Sent Events 推送新写入的日志
+func handleLogStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter, err := logFilterFromQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tailer, err := newLogTailer(gLog.filePath())
+	if err != nil {
+		http.Error(w, "Failed to open log file", http.StatusInternalServerError)
+		return
+	}
+	defer tailer.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx 不缓冲
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	tc := time.NewTicker(logTailInterval)
+	defer tc.Stop()
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tc.C:
+		}
+		lines, err := tailer.read()
+		if err != nil {
+			return
+		}
+		for _, e := range parseLogs(strings.NewReader(strings.Join(lines, "\n"))) {
+			if !filter.match(e) {
+				continue
+			}
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			lastWrite = time.Now()
+		}
+		// 定期发送注释保持连接
+		if time.Since(lastWrite) > time.Second*15 {
+			fmt.Fprint(w, ": ping\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+	}
+}
+
 func getActiveConnections() int {
 	count := 0
 	for _, app := range gConf.Apps {
@@ -746,9 +942,35 @@ func getActiveConnections() int {
 	return count
 }
 
+// 总流量（字节），包括直连、中继和为其他节点转发的流量
 func calculateTotalTraffic() float64 {
-	// TODO: 实现流量统计
-	return 0
+	traffic := NodeTraffic()
+	return float64(traffic.Direct.Total() + traffic.Relay.Total() + traffic.Relayed.Total())
+}
+
+// 查找配置对应的运行中应用，仅API模式运行时返回nil
+func findRunningApp(app AppConfig) *p2pApp {
+	if GNetwork == nil {
+		return nil
+	}
+	i, ok := GNetwork.apps.Load(app.ID())
+	if !ok {
+		return nil
+	}
+	return i.(*p2pApp)
+}
+
+func fillNodeTraffic(node *NodeStatus, config AppConfig) {
+	app := findRunningApp(config)
+	if app == nil {
+		return
+	}
+	node.Traffic = app.traffic.Snapshot()
+	node.RTT = app.RTT()
+	if t := app.Tunnel(); t != nil {
+		node.Relay = !app.isDirect()
+		node.TunnelTraffic = t.traffic.Snapshot()
+	}
 }
 
 func calculateAvgLatency() int {
@@ -788,48 +1010,12 @@ func getPeerLatency(app AppConfig) int {
 		return 0
 	}
 
-	// 这里可以实现真实的延迟检测
-	// 简单模拟一个随机延迟值
-	return 30 + int(time.Now().UnixNano()%50)
-}
-
-type LogEntry struct {
-	Timestamp int64  `json:"timestamp"`
-	Level     string `json:"level"`
-	Module    string `json:"module"`
-	Message   string `json:"message"`
-}
-
-func getSystemLogs(page, pageSize int, level string) ([]LogEntry, int) {
-	// 模拟日志数据
-	allLogs := []LogEntry{
-		{Timestamp: time.Now().Unix(), Level: "info", Module: "system", Message: "系统启动成功"},
-		{Timestamp: time.Now().Add(-time.Minute).Unix(), Level: "warning", Module: "network", Message: "网络连接不稳定"},
-		{Timestamp: time.Now().Add(-time.Hour).Unix(), Level: "error", Module: "database", Message: "数据库连接失败"},
-	}
-
-	// 根据级别筛选
-	filteredLogs := make([]LogEntry, 0)
-	for _, log := range allLogs {
-		if level == "" || level == "all" || log.Level == level {
-			filteredLogs = append(filteredLogs, log)
-		}
-	}
-
-	// 计算总数
-	total := len(filteredLogs)
-
-	// 计算分页
-	start := (page - 1) * pageSize
-	end := start + pageSize
-	if start >= total {
-		return []LogEntry{}, total
-	}
-	if end > total {
-		end = total
+	// 心跳测得的平滑RTT，还没有测量结果时返回0
+	runningApp := findRunningApp(app)
+	if runningApp == nil {
+		return 0
 	}
-
-	return filteredLogs[start:end], total
+	return int(math.Round(runningApp.RTT().RTT))
 }
 
 // 检查管理员是否存在
@@ -839,54 +1025,9 @@ func handleCheckAdmin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userLock.RLock()
-	exists := adminUser != nil
-	userLock.RUnlock()
-
 	responseJSON(w, APIResponse{
 		Code: 0,
-		Data: exists,
-	})
-}
-
-// 删除管理员账号
-func handleDeleteAdmin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// 验证当前TOTP码
-	var deleteData struct {
-		TOTPCode string `json:"totp_code"`
-	}
-
-	if err := json.NewDecoder(r.Body).Decode(&deleteData); err != nil {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid request body"})
-		return
-	}
-
-	userLock.Lock()
-	defer userLock.Unlock()
-
-	// 检查是否存在管理员账号
-	if adminUser == nil {
-		responseJSON(w, APIResponse{Code: 1, Message: "No admin user exists"})
-		return
-	}
-
-	// 验证TOTP码
-	if !validateTOTP(adminUser.TOTPKey, deleteData.TOTPCode) {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid TOTP code"})
-		return
-	}
-
-	// 删除管理员账号
-	adminUser = nil
-
-	responseJSON(w, APIResponse{
-		Code:    0,
-		Message: "Admin account deleted successfully",
+		Data: gUserManager.HasAdmin(),
 	})
 }
 
@@ -926,7 +1067,12 @@ func handleAdvancedMappings(w http.ResponseWriter, r *http.Request) {
 
 		mapping.Status = "disconnected"
 		advancedMappings[mapping.Name] = &mapping
+		err := saveAdvancedMappings()
 		advancedMappingLock.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Save mapping error: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "Advanced mapping created successfully"})
 
@@ -961,12 +1107,26 @@ func handleAdvancedMappingOperation(w http.ResponseWriter, r *http.Request) {
 	switch {
 	case operation == "start" && r.Method == http.MethodPost:
 		// 启动映射
+		advancedMappingLock.Lock()
 		mapping.Status = "connected"
+		err := saveAdvancedMappings()
+		advancedMappingLock.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Save mapping error: " + err.Error()})
+			return
+		}
 		responseJSON(w, APIResponse{Code: 0, Message: "Mapping started successfully"})
 
 	case operation == "stop" && r.Method == http.MethodPost:
 		// 停止映射
+		advancedMappingLock.Lock()
 		mapping.Status = "disconnected"
+		err := saveAdvancedMappings()
+		advancedMappingLock.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Save mapping error: " + err.Error()})
+			return
+		}
 		responseJSON(w, APIResponse{Code: 0, Message: "Mapping stopped successfully"})
 
 	case operation == "" && r.Method == http.MethodPut:
@@ -983,7 +1143,12 @@ func handleAdvancedMappingOperation(w http.ResponseWriter, r *http.Request) {
 		mapping.Nodes = updatedMapping.Nodes
 		mapping.TargetPort = updatedMapping.TargetPort
 		mapping.Description = updatedMapping.Description
+		err := saveAdvancedMappings()
 		advancedMappingLock.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Save mapping error: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "Mapping updated successfully"})
 
@@ -991,7 +1156,12 @@ func handleAdvancedMappingOperation(w http.ResponseWriter, r *http.Request) {
 		// 删除映射
 		advancedMappingLock.Lock()
 		delete(advancedMappings, mappingName)
+		err := saveAdvancedMappings()
 		advancedMappingLock.Unlock()
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Save mapping error: " + err.Error()})
+			return
+		}
 
 		responseJSON(w, APIResponse{Code: 0, Message: "Mapping deleted successfully"})
 
@@ -1002,51 +1172,19 @@ func handleAdvancedMappingOperation(w http.ResponseWriter, r *http.Request) {
 
 // 用户信息处理
 func handleUserInfo(w http.ResponseWriter, r *http.Request) {
-	// 获取请求中的token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Unauthorized"})
-		return
-	}
-
-	// 解析token获取用户名
-	username := parseToken(token)
-	if username == "" {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token"})
-		return
-	}
+	// 获取当前登录用户
+	username := sessionUser(r)
 
 	// 根据请求方法处理
 	switch r.Method {
 	case http.MethodGet:
-		userLock.RLock()
-		// 检查用户是否存在
-		var user User
-		if adminUser != nil && adminUser.Username == username {
-			user = *adminUser
-		} else if u, exists := users[username]; exists {
-			user = u
-		} else {
-			userLock.RUnlock()
+		// 返回用户信息（不包含敏感信息）
+		info, err := gUserManager.GetUserInfo(username)
+		if err != nil {
 			responseJSON(w, APIResponse{Code: 1, Message: "User not found"})
 			return
 		}
-		userLock.RUnlock()
-
-		// 返回用户信息（不包含敏感信息）
-		userInfo := map[string]interface{}{
-			"username": user.Username,
-			"role":     user.Role,
-			"created":  user.Created,
-			"displayName": func() string {
-				if user.DisplayName != "" {
-					return user.DisplayName
-				}
-				return user.Username
-			}(),
-			"email": user.Email,
-		}
-		responseJSON(w, APIResponse{Code: 0, Message: "Success", Data: userInfo})
+		responseJSON(w, APIResponse{Code: 0, Message: "Success", Data: info})
 
 	case http.MethodPut:
 		// 更新用户信息
@@ -1060,23 +1198,10 @@ func handleUserInfo(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		userLock.Lock()
-		// 检查用户是否存在
-		if adminUser != nil && adminUser.Username == username {
-			// 更新管理员信息
-			adminUser.DisplayName = updateData.DisplayName
-			adminUser.Email = updateData.Email
-		} else if u, exists := users[username]; exists {
-			// 更新普通用户信息
-			u.DisplayName = updateData.DisplayName
-			u.Email = updateData.Email
-			users[username] = u
-		} else {
-			userLock.Unlock()
-			responseJSON(w, APIResponse{Code: 1, Message: "User not found"})
+		if err := gUserManager.UpdateUserInfo(username, updateData.DisplayName, updateData.Email); err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
 			return
 		}
-		userLock.Unlock()
 
 		responseJSON(w, APIResponse{Code: 0, Message: "User information updated successfully"})
 
@@ -1085,14 +1210,119 @@ func handleUserInfo(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// 解析token获取用户名
-func parseToken(token string) string {
-	// 简单实现：token就是用户名的base64编码
-	decoded, err := base64.StdEncoding.DecodeString(token)
-	if err != nil {
-		return ""
+// 用户列表和邀请用户，仅管理员
+func handleUsers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]map[string]interface{}, 0)
+		for _, user := range gUserManager.ListUsers() {
+			list = append(list, userInfo(&user))
+		}
+		responseJSON(w, APIResponse{Code: 0, Data: list})
+
+	case http.MethodPost:
+		// 邀请用户：生成TOTP密钥，由管理员转交给被邀请人
+		var inviteData struct {
+			Username    string `json:"username"`
+			Role        string `json:"role"`
+			DisplayName string `json:"displayName"`
+			Email       string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&inviteData); err != nil || inviteData.Username == "" {
+			responseJSON(w, APIResponse{Code: 1, Message: "Invalid request body"})
+			return
+		}
+		if inviteData.Role != RoleOperator && inviteData.Role != RoleReadOnly {
+			responseJSON(w, APIResponse{Code: 1, Message: "Invalid role"})
+			return
+		}
+		totpKey := generateTOTPKey()
+		if totpKey == "" {
+			responseJSON(w, APIResponse{Code: 1, Message: "Failed to generate TOTP key"})
+			return
+		}
+		user := User{
+			Username:    inviteData.Username,
+			TOTPKey:     totpKey,
+			Role:        inviteData.Role,
+			Created:     time.Now(),
+			DisplayName: inviteData.DisplayName,
+			Email:       inviteData.Email,
+		}
+		if err := gUserManager.AddUser(user); err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+			return
+		}
+		log.Printf("User %s invited %s as %s", sessionUser(r), user.Username, user.Role)
+		responseJSON(w, APIResponse{
+			Code:    0,
+			Message: "User invited successfully",
+			Data: map[string]interface{}{
+				"username": user.Username,
+				"role":     user.Role,
+				"totp_key": totpKey,
+				"qr_url":   totpQRURL(user.Username, totpKey),
+			},
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// 修改用户角色、删除用户，仅管理员
+func handleUserOperation(w http.ResponseWriter, r *http.Request) {
+	username := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if username == "" {
+		responseJSON(w, APIResponse{Code: 1, Message: "Username is required"})
+		return
+	}
+	user, exists := gUserManager.GetUser(username)
+	if !exists {
+		responseJSON(w, APIResponse{Code: 1, Message: "User not found"})
+		return
+	}
+	// 管理员账号不能修改或删除，否则第一个调用注册接口的人会成为管理员
+	if user.Role == RoleAdmin {
+		responseJSON(w, APIResponse{Code: 1, Message: "Can not modify admin user"})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var updateData struct {
+			Role string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: "Invalid request body"})
+			return
+		}
+		if updateData.Role != RoleOperator && updateData.Role != RoleReadOnly {
+			responseJSON(w, APIResponse{Code: 1, Message: "Invalid role"})
+			return
+		}
+		err := gUserManager.UpdateUser(username, func(u *User) error {
+			u.Role = updateData.Role
+			return nil
+		})
+		if err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+			return
+		}
+		responseJSON(w, APIResponse{Code: 0, Message: "User updated successfully"})
+
+	case http.MethodDelete:
+		if err := gUserManager.DeleteUser(username); err != nil {
+			responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+			return
+		}
+		gSessions.revokeUser(username)
+		log.Printf("User %s removed %s", sessionUser(r), username)
+		responseJSON(w, APIResponse{Code: 0, Message: "User removed successfully"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
-	return string(decoded)
 }
 
 // 客户端配置验证
@@ -1133,16 +1363,11 @@ func handleClientVerify(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证Token是否有效
-	var foundNode *AppConfig
-	for _, app := range gConf.Apps {
-		if app.AppToken == clientConfig.Token {
-			foundNode = app
-			break
-		}
-	}
-
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
+	foundNode := findNodeByToken(clientConfig.Token)
 	if foundNode == nil {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token, node not found"})
+		responseStatusJSON(w, http.StatusUnauthorized, APIResponse{Code: 1, Message: "Invalid token, node not found"})
 		return
 	}
 
@@ -1190,16 +1415,11 @@ func handleClientConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证Token
-	var foundNode *AppConfig
-	for _, app := range gConf.Apps {
-		if app.AppToken == connectData.Token {
-			foundNode = app
-			break
-		}
-	}
-
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
+	foundNode := findNodeByToken(connectData.Token)
 	if foundNode == nil {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token, node not found"})
+		responseStatusJSON(w, http.StatusUnauthorized, APIResponse{Code: 1, Message: "Invalid token, node not found"})
 		return
 	}
 
@@ -1243,16 +1463,11 @@ func handleClientHeartbeat(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证Token
-	var foundNode *AppConfig
-	for _, app := range gConf.Apps {
-		if app.AppToken == heartbeatData.Token {
-			foundNode = app
-			break
-		}
-	}
-
+	gConf.mtx.Lock()
+	defer gConf.mtx.Unlock()
+	foundNode := findNodeByToken(heartbeatData.Token)
 	if foundNode == nil {
-		responseJSON(w, APIResponse{Code: 1, Message: "Invalid token, node not found"})
+		responseStatusJSON(w, http.StatusUnauthorized, APIResponse{Code: 1, Message: "Invalid token, node not found"})
 		return
 	}
 
@@ -280,3 +280,23 @@ func calculateChecksum(data []byte) uint16 {
 
 	return uint16(^sum)
 }
+
+// writeFileAtomic write to a temp file then rename, a crash never leaves a half written file
+func writeFileAtomic(fileName string, data []byte, perm os.FileMode) error {
+	tmpFile := fileName + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, fileName)
+}
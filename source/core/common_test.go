@@ -3,6 +3,8 @@ package core
 import (
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -127,3 +129,20 @@ func TestNodeID(t *testing.T) {
 		fmt.Printf("%s >= %s\n", node1, node2)
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "config.json")
+	if err := writeFileAtomic(fileName, []byte("old"), 0644); err != nil {
+		t.Fatalf("writeFileAtomic error:%s", err)
+	}
+	if err := writeFileAtomic(fileName, []byte("new"), 0644); err != nil {
+		t.Fatalf("writeFileAtomic error:%s", err)
+	}
+	data, _ := os.ReadFile(fileName)
+	if string(data) != "new" {
+		t.Errorf("writeFileAtomic got %s", data)
+	}
+	if _, err := os.Stat(fileName + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temp file not removed")
+	}
+}
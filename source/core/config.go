@@ -32,19 +32,27 @@ type AppConfig struct {
 	DstHost          string
 	PeerUser         string
 	RelayNode        string
-	ForceRelay       int // default:0 disable;1 enable
-	Enabled          int // default:1
+	ForceRelay       int    // default:0 disable;1 enable
+	Multipath        string // 多路径: 空为关闭, redundant 冗余发送, aggregate 按rtt和丢包聚合, 仅tcp应用
+	Enabled          int    // default:1
+	Bandwidth        int    // 管理API设置的节点带宽
 	// runtime info
 	relayMode        string // private|public
 	peerVersion      string
 	peerToken        uint64
 	peerNatType      int
+	peerNatBehavior  NATBehavior // 对端NAT的映射和过滤行为
 	peerLanIP        string
 	hasIPv4          int
 	peerIPv6         string
+	peerIdentity     string
 	hasUPNPorNATPMP  int
 	peerIP           string
 	peerConeNatPort  int
+	peerNatPortBase  int // 对端对称型NAT最后分配的端口
+	peerNatPortDelta int // 对端对称型NAT端口分配步长, 0 为随机
+	peerWSSPort      int
+	peerWSSCertHash  string
 	retryNum         int
 	retryTime        time.Time
 	nextRetryTime    time.Time
@@ -52,6 +60,7 @@ type AppConfig struct {
 	errMsg           string
 	connectTime      time.Time
 	fromToken        uint64
+	multipathTunnel  int // 1: build another tunnel to the peer instead of using the existing one
 	linkMode         string
 	isUnderlayServer int
 }
@@ -262,17 +271,18 @@ func (c *Config) delete(app AppConfig) {
 	}
 }
 
-func (c *Config) save() {
+func (c *Config) save() error {
 	// c.mtx.Lock()
 	// defer c.mtx.Unlock()  // internal call
 	if c.Network.Token == 0 {
-		return
+		return ErrConfigNoToken
 	}
 	data, _ := json.MarshalIndent(c, "", "  ")
-	err := os.WriteFile("config.json", data, 0644)
+	err := writeFileAtomic("config.json", data, 0644)
 	if err != nil {
 		gLog.Println(LvERROR, "save config.json error:", err)
 	}
+	return err
 }
 
 func (c *Config) saveCache() {
@@ -282,7 +292,7 @@ func (c *Config) saveCache() {
 		return
 	}
 	data, _ := json.MarshalIndent(c, "", "  ")
-	err := os.WriteFile("config.json0", data, 0644)
+	err := writeFileAtomic("config.json0", data, 0644)
 	if err != nil {
 		gLog.Println(LvERROR, "save config.json0 error:", err)
 	}
@@ -312,7 +322,7 @@ func (c *Config) load() error {
 	// load ok. cache it
 	var filteredApps []*AppConfig // filter memapp
 	for _, app := range c.Apps {
-		if app.SrcPort != 0 {
+		if app.SrcPort != 0 || app.AppID != "" { // 管理API添加的节点没有SrcPort, 不是memapp
 			filteredApps = append(filteredApps, app)
 		}
 	}
@@ -379,6 +389,16 @@ func (c *Config) IPv6() string {
 	defer c.mtx.Unlock()
 	return c.Network.publicIPv6
 }
+func (c *Config) setNATBehavior(b NATBehavior) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.Network.natBehavior = b
+}
+func (c *Config) NATBehavior() NATBehavior {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.Network.natBehavior
+}
 
 type NetworkConfig struct {
 	// local info
@@ -391,6 +411,7 @@ type NetworkConfig struct {
 	os              string
 	publicIP        string
 	natType         int
+	natBehavior     NATBehavior // lifetime 在后台测得后更新, 用 NATBehavior() 读取
 	hasIPv4         int
 	publicIPv6      string // must lowwer-case not save json
 	hasUPNPorNATPMP int
@@ -404,6 +425,11 @@ type NetworkConfig struct {
 	UDPPort1   int
 	UDPPort2   int
 	TCPPort    int
+	// wss underlay listen port when having public ip, -1 disable. http proxy for dialing wss
+	WSSPort   int
+	HTTPProxy string
+	// prometheus metrics listen address, empty disables it
+	MetricsAddr string
 }
 
 func parseParams(subCommand string, cmd string) {
@@ -420,16 +446,20 @@ func parseParams(subCommand string, cmd string) {
 	srcPort := fset.Int("srcport", 0, "source port ")
 	tcpPort := fset.Int("tcpport", 0, "tcp port for upnp or publicip")
 	protocol := fset.String("protocol", "tcp", "tcp or udp")
-	underlayProtocol := fset.String("underlay_protocol", "quic", "quic or kcp")
+	underlayProtocol := fset.String("underlay_protocol", "quic", "quic, kcp or wss")
+	wssPort := fset.Int("wssport", WSSPort, "wss underlay listen port when having public ip, -1 disable")
+	httpProxy := fset.String("httpproxy", "", "http proxy for wss underlay and server connection, default HTTPS_PROXY")
 	punchPriority := fset.Int("punch_priority", 0, "bitwise DisableTCP|DisableUDP|UDPFirst  0:tcp and udp both enable, tcp first")
 	appName := fset.String("appname", "", "app name")
 	relayNode := fset.String("relaynode", "", "relaynode")
+	multipath := fset.String("multipath", "", "redundant or aggregate, send tcp app traffic on all direct and relay tunnels")
 	shareBandwidth := fset.Int("sharebandwidth", 10, "N mbps share bandwidth limit, private network no limit")
 	daemonMode := fset.Bool("d", false, "daemonMode")
 	notVerbose := fset.Bool("nv", false, "not log console")
 	newconfig := fset.Bool("newconfig", false, "not load existing config.json")
 	logLevel := fset.Int("loglevel", 1, "0:debug 1:info 2:warn 3:error")
 	maxLogSize := fset.Int("maxlogsize", 1024*1024, "default 1MB")
+	metricsAddr := fset.String("metrics", "", "prometheus metrics listen address, e.g. :9100. disabled if empty")
 	if cmd == "" {
 		if subCommand == "" { // no subcommand
 			fset.Parse(os.Args[1:])
@@ -454,6 +484,7 @@ func parseParams(subCommand string, cmd string) {
 	config.PunchPriority = *punchPriority
 	config.AppName = *appName
 	config.RelayNode = *relayNode
+	config.Multipath = *multipath
 	if !*newconfig {
 		gConf.load() // load old config. otherwise will clear all apps
 	}
@@ -485,6 +516,15 @@ func parseParams(subCommand string, cmd string) {
 		if f.Name == "token" {
 			gConf.setToken(*token)
 		}
+		if f.Name == "wssport" {
+			gConf.Network.WSSPort = *wssPort
+		}
+		if f.Name == "httpproxy" {
+			gConf.Network.HTTPProxy = *httpProxy
+		}
+		if f.Name == "metrics" {
+			gConf.Network.MetricsAddr = *metricsAddr
+		}
 	})
 	// set default value
 	if gConf.Network.ServerHost == "" {
@@ -508,6 +548,9 @@ func parseParams(subCommand string, cmd string) {
 		}
 		gConf.Network.TCPPort = *tcpPort
 	}
+	if gConf.Network.WSSPort == 0 {
+		gConf.Network.WSSPort = *wssPort
+	}
 	if *token == 0 {
 		envToken := os.Getenv("OPENP2P_TOKEN")
 		if envToken != "" {
@@ -176,3 +176,34 @@ func TestInetAtoN(t *testing.T) {
 	ipa, _ = inetAtoN("121.5.147.4/32")
 	t.Log(ipa)
 }
+
+func TestConfigLoadAPINodes(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	chdirTemp(t)
+	conf := Config{}
+	conf.Apps = []*AppConfig{{AppID: "node1", AppName: "node1"}, {Protocol: "tcp", SrcPort: 23389, PeerNode: "peer1"}, {PeerNode: "memapp1"}}
+	if err := conf.save(); err != ErrConfigNoToken {
+		t.Errorf("save without token got %v", err)
+	}
+	conf.Network.Token = 1
+	if err := conf.save(); err != nil {
+		t.Fatal("save error:", err)
+	}
+	loaded := Config{}
+	if err := loaded.load(); err != nil {
+		t.Fatal("load error:", err)
+	}
+	if len(loaded.Apps) != 2 || loaded.Apps[0].AppID != "node1" || loaded.Apps[1].SrcPort != 23389 {
+		t.Errorf("loaded apps %d", len(loaded.Apps))
+	}
+
+	// a failed save keeps the apps in memory
+	oldApps, oldToken := gConf.Apps, gConf.Network.Token
+	defer func() { gConf.Apps, gConf.Network.Token = oldApps, oldToken }()
+	gConf.Apps, gConf.Network.Token = nil, 0
+	if err := saveApps([]*AppConfig{{AppID: "node2"}}); err == nil || len(gConf.Apps) != 0 {
+		t.Errorf("save apps without token got %v, %d apps", err, len(gConf.Apps))
+	}
+}
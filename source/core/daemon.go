@@ -4,14 +4,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/openp2p-cn/service"
 )
 
+const workerStopTimeout = time.Second * 5 // the worker deletes its port mappings before exit
+
 type daemon struct {
 	running bool
 	proc    *os.Process
+	exited  chan struct{} // closed when proc exited
 }
 
 func (d *daemon) Start(s service.Service) error {
@@ -24,7 +28,7 @@ func (d *daemon) Stop(s service.Service) error {
 	d.running = false
 	if d.proc != nil {
 		gLog.Println(LvINFO, "stop worker")
-		d.proc.Kill()
+		d.stopWorker()
 	}
 	if service.Interactive() {
 		gLog.Println(LvINFO, "stop daemon")
@@ -33,6 +37,22 @@ func (d *daemon) Stop(s service.Service) error {
 	return nil
 }
 
+// stopWorker lets the worker exit by SIGTERM, it's killed if it doesn't in time or can't be
+// signaled (windows). the mappings of a killed worker are deleted from the file it saved.
+func (d *daemon) stopWorker() {
+	if err := d.proc.Signal(syscall.SIGTERM); err == nil {
+		select {
+		case <-d.exited:
+			return
+		case <-time.After(workerStopTimeout):
+			gLog.Println(LvINFO, "worker stop timeout, kill it")
+		}
+	}
+	d.proc.Kill()
+	<-d.exited
+	cleanPortMappings()
+}
+
 func (d *daemon) run() {
 	gLog.Println(LvINFO, "daemon run start")
 	defer gLog.Println(LvINFO, "daemon run end")
@@ -79,8 +99,10 @@ func (d *daemon) run() {
 			gLog.Printf(LvERROR, "start worker error:%s", err)
 			return
 		}
+		d.exited = make(chan struct{})
 		d.proc = p
 		_, _ = p.Wait()
+		close(d.exited)
 		f.Close()
 		time.Sleep(time.Second)
 		err = os.Rename(tmpDump, dumpFile)
@@ -30,4 +30,18 @@ var (
 	ErrBuildTunnelBusy       = errors.New("build tunnel busy")
 	ErrMemAppTunnelNotFound  = errors.New("memapp tunnel not found")
 	ErrRemoteServiceUnable   = errors.New("remote service unable")
+	ErrSessionInvalid        = errors.New("session invalid or expired")
+	ErrSessionRefreshTooSoon = errors.New("session refresh too soon")
+	ErrOverlayConnectDenied  = errors.New("overlay connect denied by peer")
+	ErrOverlayDialFailed     = errors.New("peer dial destination error")
+	ErrOverlayConnectTimeout = errors.New("overlay connect timeout")
+	ErrOverlayWindowExceeded = errors.New("overlay receive window exceeded")
+	ErrWSSUnavailable        = errors.New("no side listening wss underlay")
+	ErrWSSCertMismatch       = errors.New("wss underlay certificate mismatch")
+	ErrDatagramUnsupported   = errors.New("datagram not supported by peer")
+	ErrDatagramTooLarge      = errors.New("message too large for datagrams")
+	ErrNATNotPunchable       = errors.New("nat hole punching impossible")
+	ErrPortMappingTimeout    = errors.New("port mapping gateway no response")
+	ErrConfigNoToken         = errors.New("config not saved before login")
+	ErrPushFromMismatch      = errors.New("push from another node")
 )
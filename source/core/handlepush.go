@@ -42,6 +42,9 @@ func handlePush(subType uint16, msg []byte) error {
 			gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
 			return err
 		}
+		if NodeNameToID(req.From) != pushHead.From { // the server checked pushHead.From
+			return ErrPushFromMismatch
+		}
 		config := AppConfig{}
 		config.PeerNode = req.RelayName
 		config.peerToken = req.RelayToken
@@ -49,6 +52,7 @@ func handlePush(subType uint16, msg []byte) error {
 		go func(r AddRelayTunnelReq) {
 			t, errDt := GNetwork.addDirectTunnel(config, 0)
 			if errDt == nil {
+				addRelayPeer(t.id, r.RelayTunnelID, r.From)
 				// notify peer relay ready
 				msg := TunnelMsg{ID: t.id}
 				GNetwork.push(r.From, MsgPushAddRelayTunnelRsp, msg)
@@ -66,6 +70,9 @@ func handlePush(subType uint16, msg []byte) error {
 			return err
 		}
 		gLog.Println(LvDEBUG, "handle MsgPushServerSideSaveMemApp:", prettyJson(req))
+		if NodeNameToID(req.From) != pushHead.From {
+			return ErrPushFromMismatch
+		}
 		var existTunnel *P2PTunnel
 		i, ok := GNetwork.allTunnels.Load(req.TunnelID)
 		if !ok {
@@ -77,6 +84,9 @@ func handlePush(subType uint16, msg []byte) error {
 			}
 		}
 		existTunnel = i.(*P2PTunnel)
+		if req.RelayTunnelID != 0 {
+			addRelayPeer(existTunnel.id, req.RelayTunnelID, req.From)
+		}
 		peerID := NodeNameToID(req.From)
 		existApp, appok := GNetwork.apps.Load(peerID)
 		if appok {
@@ -172,6 +182,15 @@ func handlePush(subType uint16, msg []byte) error {
 			// disable APP
 			GNetwork.DeleteApp(config)
 		}
+	case MsgPushRevokedIdentities:
+		req := RevokedIdentities{}
+		if err = json.Unmarshal(msg[openP2PHeaderSize:], &req); err != nil {
+			gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+			return err
+		}
+		gLog.Printf(LvINFO, "%d identities revoked", len(req.Identities))
+		trust().revoke(req.Identities)
+		GNetwork.closeRevokedTunnels()
 	case MsgPushDstNodeOnline:
 		gLog.Println(LvINFO, "MsgPushDstNodeOnline")
 		req := PushDstNodeOnline{}
@@ -218,6 +237,7 @@ func handleEditApp(msg []byte) (err error) {
 	newConf.SrcPort = newApp.SrcPort
 	newConf.RelayNode = newApp.SpecRelayNode
 	newConf.PunchPriority = newApp.PunchPriority
+	newConf.Multipath = newApp.Multipath
 	gConf.add(newConf, false)
 	if newApp.Protocol0 != "" && newApp.SrcPort0 != 0 { // not edit
 		GNetwork.DeleteApp(oldConf) // DeleteApp may cost some times, execute at the end
@@ -250,7 +270,11 @@ func handleConnectReq(msg []byte) (err error) {
 		gLog.Printf(LvINFO, "Access Granted")
 		config := AppConfig{}
 		config.peerNatType = req.NatType
+		if req.NatBehavior != nil {
+			config.peerNatBehavior = *req.NatBehavior
+		}
 		config.peerConeNatPort = req.ConeNatPort
+		config.peerNatPortBase, config.peerNatPortDelta = req.NatPortBase, req.NatPortDelta
 		config.peerIP = req.FromIP
 		config.PeerNode = req.From
 		config.peerVersion = req.Version
@@ -261,6 +285,8 @@ func handleConnectReq(msg []byte) (err error) {
 		config.linkMode = req.LinkMode
 		config.isUnderlayServer = req.IsUnderlayServer
 		config.UnderlayProtocol = req.UnderlayProtocol
+		config.peerWSSPort = req.WSSPort
+		config.peerWSSCertHash = req.WSSCertHash
 		// share relay node will limit bandwidth
 		if req.Token != gConf.Network.Token {
 			gLog.Printf(LvINFO, "set share bandwidth %d mbps", gConf.Network.ShareBandwidth)
@@ -330,6 +356,7 @@ func handleReportApps() (err error) {
 			SpecRelayNode: specRelayNode,
 			RelayMode:     relayMode,
 			LinkMode:      linkMode,
+			Multipath:     config.Multipath,
 			PeerNode:      config.PeerNode,
 			DstHost:       config.DstHost,
 			DstPort:       config.DstPort,
@@ -341,6 +368,11 @@ func handleReportApps() (err error) {
 			IsActive:      appActive,
 			Enabled:       config.Enabled,
 		}
+		if app != nil {
+			appInfo.setNATInfo(&app.config)
+		} else {
+			appInfo.setNATInfo(config)
+		}
 		req.Apps = append(req.Apps, appInfo)
 	}
 	return GNetwork.write(MsgReport, MsgReportApps, &req)
@@ -396,6 +428,7 @@ func handleReportMemApps() (err error) {
 			appInfo.PeerUser = app.config.PeerUser
 			appInfo.PeerIP = app.config.peerIP
 			appInfo.PeerNatType = app.config.peerNatType
+			appInfo.setNATInfo(&app.config)
 			appInfo.RetryTime = retryTime
 			appInfo.ConnectTime = connectTime
 		}
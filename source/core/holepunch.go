@@ -11,7 +11,7 @@ import (
 )
 
 func handshakeC2C(t *P2PTunnel) (err error) {
-	gLog.Printf(LvDEBUG, "handshakeC2C %s:%d:%d to %s:%d", gConf.Network.Node, t.coneLocalPort, t.coneNatPort, t.config.peerIP, t.config.peerConeNatPort)
+	gLog.Printf(LvDEBUG, "handshakeC2C %s:%d:%d to %s", gConf.Network.Node, t.coneLocalPort, t.coneNatPort, t.remoteHoleAddr)
 	defer gLog.Printf(LvDEBUG, "handshakeC2C end")
 	conn, err := net.ListenUDP("udp", t.localHoleAddr)
 	if err != nil {
@@ -68,8 +68,16 @@ func handshakeC2S(t *P2PTunnel) error {
 	}
 	defer buildTunnelMtx.Unlock()
 	startTime := time.Now()
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	randPorts := r.Perm(65532)
+	dstPorts := predictPorts(t.config.peerNatPortBase, t.config.peerNatPortDelta, SymmetricHandshakeNum)
+	if len(dstPorts) == 0 { // no pattern, random spray relies on birthday odds
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		dstPorts = r.Perm(65532)[:SymmetricHandshakeNum]
+		for i := range dstPorts {
+			dstPorts[i] += 2
+		}
+	} else {
+		gLog.Printf(LvDEBUG, "handshakeC2S predicted ports %d+%d*n", t.config.peerNatPortBase, t.config.peerNatPortDelta)
+	}
 	conn, err := net.ListenUDP("udp", t.localHoleAddr)
 	if err != nil {
 		return err
@@ -78,9 +86,9 @@ func handshakeC2S(t *P2PTunnel) error {
 
 	go func() error {
 		gLog.Printf(LvDEBUG, "send symmetric handshake to %s from %d:%d start", t.config.peerIP, t.coneLocalPort, t.coneNatPort)
-		for i := 0; i < SymmetricHandshakeNum; i++ {
+		for _, port := range dstPorts {
 			// time.Sleep(SymmetricHandshakeInterval)
-			dst, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", t.config.peerIP, randPorts[i]+2))
+			dst, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", t.config.peerIP, port))
 			if err != nil {
 				return err
 			}
@@ -166,10 +174,16 @@ func handshakeS2C(t *P2PTunnel) error {
 	defer buildTunnelMtx.Unlock()
 	startTime := time.Now()
 	gotCh := make(chan *net.UDPAddr, 5)
+	// the new sockets are mapped on the ports the peer predicted and sprays, more can't meet it
+	num := SymmetricHandshakeNum
+	if ports := predictPorts(t.natPortBase, t.natPortDelta, SymmetricHandshakeNum); len(ports) > 0 {
+		num = len(ports)
+		gLog.Printf(LvDEBUG, "handshakeS2C mapped on predicted ports %d+%d*n", t.natPortBase, t.natPortDelta)
+	}
 	// sequencely udp send handshake, do not parallel send
 	gLog.Printf(LvDEBUG, "send symmetric handshake to %s:%d start", t.config.peerIP, t.config.peerConeNatPort)
 	gotIt := false
-	for i := 0; i < SymmetricHandshakeNum; i++ {
+	for i := 0; i < num; i++ {
 		// time.Sleep(SymmetricHandshakeInterval)
 		go func(t *P2PTunnel) error {
 			conn, err := net.ListenUDP("udp", nil) // TODO: system allocated port really random?
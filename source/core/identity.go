@@ -0,0 +1,212 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// every node holds an ed25519 identity, published at login and used to sign the
+// key exchange. peers are pinned on first use, the server can push revoked identities.
+
+const (
+	identityFile   = "identity.key"
+	knownNodesFile = "known_nodes.json"
+)
+
+var (
+	ErrIdentityMismatch = errors.New("peer identity mismatch")
+	ErrIdentityRevoked  = errors.New("peer identity revoked")
+	ErrIdentitySig      = errors.New("peer identity signature error")
+	ErrIdentityMissing  = errors.New("peer identity missing")
+)
+
+type nodeIdentity struct {
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+// loadIdentity reads the base64 seed in path, generates and saves one if not exist
+func loadIdentity(path string) (*nodeIdentity, error) {
+	buf, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s format error", path)
+		}
+		priv := ed25519.NewKeyFromSeed(seed)
+		return &nodeIdentity{priv: priv, pub: priv.Public().(ed25519.PublicKey)}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(priv.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return &nodeIdentity{priv: priv, pub: pub}, nil
+}
+
+var (
+	gIdentity    *nodeIdentity
+	onceIdentity sync.Once
+)
+
+func localIdentity() *nodeIdentity {
+	onceIdentity.Do(func() {
+		id, err := loadIdentity(identityFile)
+		if err != nil {
+			gLog.Printf(LvERROR, "load node identity error:%s, use a temporary one", err)
+			pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+			id = &nodeIdentity{priv: priv, pub: pub}
+		}
+		gIdentity = id
+	})
+	return gIdentity
+}
+
+// base64 public key
+func (id *nodeIdentity) String() string {
+	return base64.StdEncoding.EncodeToString(id.pub)
+}
+
+func (id *nodeIdentity) sign(label string, data []byte) []byte {
+	return ed25519.Sign(id.priv, append([]byte(label), data...))
+}
+
+func verifyIdentitySig(identity string, label string, data []byte, sig []byte) error {
+	pub, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return ErrIdentitySig
+	}
+	if !ed25519.Verify(pub, append([]byte(label), data...), sig) {
+		return ErrIdentitySig
+	}
+	return nil
+}
+
+// trustStore keeps the trust on first use pins and the revoked identities
+type trustStore struct {
+	mtx     sync.Mutex
+	path    string
+	Pins    map[string]string `json:"pins"` // node name -> identity
+	Revoked []string          `json:"revoked,omitempty"`
+}
+
+func newTrustStore(path string) *trustStore {
+	ts := &trustStore{path: path, Pins: map[string]string{}}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return ts
+	}
+	if err = json.Unmarshal(buf, ts); err != nil {
+		gLog.Printf(LvERROR, "parse %s error:%s", path, err)
+	}
+	if ts.Pins == nil {
+		ts.Pins = map[string]string{}
+	}
+	return ts
+}
+
+var (
+	gTrust    *trustStore
+	onceTrust sync.Once
+)
+
+func trust() *trustStore {
+	onceTrust.Do(func() {
+		gTrust = newTrustStore(knownNodesFile)
+	})
+	return gTrust
+}
+
+// verify checks identity of node. the first identity seen is pinned, it must
+// equal the one published by server if any.
+func (ts *trustStore) verify(node string, identity string, published string) error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	if ts.isRevoked(identity) {
+		return ErrIdentityRevoked
+	}
+	if pin, ok := ts.Pins[node]; ok {
+		if pin != identity {
+			return ErrIdentityMismatch
+		}
+		return nil
+	}
+	if published != "" && published != identity {
+		return ErrIdentityMismatch
+	}
+	ts.Pins[node] = identity
+	gLog.Printf(LvINFO, "pin %s identity %s", node, identity)
+	return ts.save()
+}
+
+// verifyPeerCert checks the ed25519 key of the quic cert, tls has verified the peer holds it.
+// peers before node identity use a rsa cert, they are accepted until pinned or published.
+func verifyPeerCert(rawCerts [][]byte, node string, published string) error {
+	if len(rawCerts) == 0 {
+		return ErrIdentityMissing
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		if published != "" || trust().pinned(node) {
+			return ErrIdentityMissing
+		}
+		return nil
+	}
+	return trust().verify(node, base64.StdEncoding.EncodeToString(pub), published)
+}
+
+func (ts *trustStore) pinned(node string) bool {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	_, ok := ts.Pins[node]
+	return ok
+}
+
+// revoke replaces the revoked list, pushed by server
+func (ts *trustStore) revoke(identities []string) error {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	ts.Revoked = identities
+	return ts.save()
+}
+
+func (ts *trustStore) revoked(identity string) bool {
+	ts.mtx.Lock()
+	defer ts.mtx.Unlock()
+	return ts.isRevoked(identity)
+}
+
+func (ts *trustStore) isRevoked(identity string) bool {
+	for _, r := range ts.Revoked {
+		if r == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *trustStore) save() error {
+	data, _ := json.MarshalIndent(ts, "", "  ")
+	err := writeFileAtomic(ts.path, data, 0644)
+	if err != nil {
+		gLog.Printf(LvERROR, "save %s error:%s", ts.path, err)
+	}
+	return err
+}
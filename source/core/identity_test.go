@@ -0,0 +1,75 @@
+package core
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), identityFile)
+	id1, err := loadIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := loadIdentity(path)
+	if err != nil || id1.String() != id2.String() {
+		t.Errorf("reload identity error:%v", err)
+	}
+	sig := id1.sign("label", []byte("data"))
+	if verifyIdentitySig(id2.String(), "label", []byte("data"), sig) != nil {
+		t.Errorf("verify error")
+	}
+	if verifyIdentitySig(id2.String(), "label2", []byte("data"), sig) != ErrIdentitySig {
+		t.Errorf("wrong label verified")
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	path := filepath.Join(t.TempDir(), knownNodesFile)
+	ts := newTrustStore(path)
+	if err := ts.verify("node1", "key1", "key2"); err != ErrIdentityMismatch {
+		t.Errorf("published identity mismatch not detected:%v", err)
+	}
+	if err := ts.verify("node1", "key1", ""); err != nil {
+		t.Errorf("first use error:%v", err)
+	}
+	if err := ts.verify("node1", "key2", ""); err != ErrIdentityMismatch {
+		t.Errorf("pinned identity mismatch not detected:%v", err)
+	}
+	ts.revoke([]string{"key1"})
+	ts = newTrustStore(path)
+	if !ts.pinned("node1") || !ts.revoked("key1") {
+		t.Errorf("trust store not saved")
+	}
+	if err := ts.verify("node1", "key1", ""); err != ErrIdentityRevoked {
+		t.Errorf("revoked identity verified:%v", err)
+	}
+}
+
+func TestVerifyKeyExchange(t *testing.T) {
+	dir := t.TempDir()
+	if gLog == nil {
+		gLog = NewLogger(dir, ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	onceIdentity.Do(func() { gIdentity, _ = loadIdentity(filepath.Join(dir, identityFile)) })
+	onceTrust.Do(func() { gTrust = newTrustStore(filepath.Join(dir, knownNodesFile)) })
+	kex := keyExchange{}
+	pub, _ := kex.public()
+	req := newKeyExchangeMsg(tunnelKeyLabel(1), pub)
+	if err := verifyKeyExchange(&req, "peernode1", tunnelKeyLabel(2), ""); err != ErrIdentitySig {
+		t.Errorf("signature of other tunnel verified:%v", err)
+	}
+	if err := verifyKeyExchange(&req, "peernode1", tunnelKeyLabel(1), ""); err != nil {
+		t.Errorf("verify error:%v", err)
+	}
+	old := KeyExchange{Pub: pub}
+	if err := verifyKeyExchange(&old, "peernode1", tunnelKeyLabel(1), ""); err != ErrIdentityMissing {
+		t.Errorf("pinned peer without identity verified:%v", err)
+	}
+	if err := verifyKeyExchange(&old, "peernode2", tunnelKeyLabel(1), ""); err != nil {
+		t.Errorf("old peer error:%v", err)
+	}
+}
@@ -0,0 +1,334 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// end-to-end session keys by ephemeral x25519. the tunnel key is agreed over the
+// tunnel right after MsgTunnelHandshake, the app key of relay apps is agreed through
+// the relay node. the server and relay nodes only see the public keys.
+
+// OverlayConnectReq.Kex, empty means the appKey synced by server, only legacy cipher allows it
+const KexX25519 = "x25519"
+
+var (
+	ErrNoSessionKey        = errors.New("no session key")
+	ErrKeyExchangeNotStart = errors.New("key exchange not start")
+	ErrCipherDowngrade     = errors.New("legacy cipher from aead peer")
+)
+
+type keyExchange struct {
+	mtx  sync.Mutex
+	priv *ecdh.PrivateKey
+	key  []byte // nil until the peer's public key arrived
+}
+
+// public generates the ephemeral key at the first call
+func (k *keyExchange) public() ([]byte, error) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.priv == nil {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		k.priv = priv
+	}
+	return k.priv.PublicKey().Bytes(), nil
+}
+
+// complete derives the session key from the peer's public key. both public keys
+// are the salt in a fixed order, so both sides get the same key without roles.
+func (k *keyExchange) complete(peerPub []byte, label string) error {
+	peer, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return err
+	}
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	if k.priv == nil {
+		return ErrKeyExchangeNotStart
+	}
+	shared, err := k.priv.ECDH(peer)
+	if err != nil {
+		return err
+	}
+	pub := k.priv.PublicKey().Bytes()
+	salt := append(append([]byte{}, pub...), peerPub...)
+	if bytes.Compare(pub, peerPub) > 0 {
+		salt = append(append([]byte{}, peerPub...), pub...)
+	}
+	k.key = hkdfSHA256(shared, salt, []byte(label), 32)
+	k.priv = nil // forward secrecy, next exchange uses a new key
+	return nil
+}
+
+// pending is true after public() before complete()
+func (k *keyExchange) pending() bool {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return k.priv != nil
+}
+
+// abort drops the pending exchange, a late answer to it will be refused
+func (k *keyExchange) abort() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.priv = nil
+}
+
+// reset drops the session key, used before a new exchange
+func (k *keyExchange) reset() {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.key = nil
+}
+
+func (k *keyExchange) sessionKey() []byte {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	return k.key
+}
+
+func tunnelKeyLabel(tid uint64) string {
+	return fmt.Sprintf("openp2p tunnel %d", tid)
+}
+
+func appKeyLabel(appID uint64) string {
+	return fmt.Sprintf("openp2p app %d", appID)
+}
+
+// overlaySecret mixes the overlay id into the session key, the aead keys are derived from it
+func overlaySecret(sessionKey []byte, overlayID uint64) []byte {
+	secret := make([]byte, len(sessionKey)+8)
+	copy(secret, sessionKey)
+	binary.LittleEndian.PutUint64(secret[len(sessionKey):], overlayID)
+	return secret
+}
+
+// server side app session keys of relay apps, bound to the peer node and its identity
+var (
+	appSessionKeyMtx sync.Mutex
+	appSessionKeys   = map[appSessionKeyID]appSessionKey{}
+)
+
+type appSessionKeyID struct {
+	node  string
+	appID uint64
+}
+
+type appSessionKey struct {
+	identity string
+	key      []byte
+}
+
+func getAppSessionKey(node string, appID uint64) []byte {
+	appSessionKeyMtx.Lock()
+	defer appSessionKeyMtx.Unlock()
+	return appSessionKeys[appSessionKeyID{node, appID}].key
+}
+
+// setAppSessionKey refuses to replace the key agreed with another identity of node
+func setAppSessionKey(node string, appID uint64, identity string, key []byte) error {
+	appSessionKeyMtx.Lock()
+	defer appSessionKeyMtx.Unlock()
+	id := appSessionKeyID{node, appID}
+	if old, ok := appSessionKeys[id]; ok && old.identity != identity {
+		return ErrIdentityMismatch
+	}
+	appSessionKeys[id] = appSessionKey{identity: identity, key: key}
+	return nil
+}
+
+// the peers of relay tunnels, announced by their server push. the app key exchange and the
+// overlays through a relay tunnel belong to the node of their rtid, not the node they claim.
+var relayPeers sync.Map // key: relayPeerID, value: node name
+
+type relayPeerID struct {
+	tid  uint64 // our tunnel to the relay node
+	rtid uint64 // the peer's tunnel to the relay node
+}
+
+// addRelayPeer keeps the first node of rtid, another node can't take it over
+func addRelayPeer(tid uint64, rtid uint64, node string) {
+	if old, loaded := relayPeers.LoadOrStore(relayPeerID{tid, rtid}, node); loaded && old.(string) != node {
+		gLog.Printf(LvWARN, "relay tunnel %d:%d of %s claimed by %s, ignore", tid, rtid, old, node)
+	}
+}
+
+// relayPeer returns "" if no node announced rtid
+func relayPeer(tid uint64, rtid uint64) string {
+	i, ok := relayPeers.Load(relayPeerID{tid, rtid})
+	if !ok {
+		return ""
+	}
+	return i.(string)
+}
+
+func deleteRelayPeers(tid uint64) {
+	relayPeers.Range(func(k, _ interface{}) bool {
+		if k.(relayPeerID).tid == tid {
+			relayPeers.Delete(k)
+		}
+		return true
+	})
+}
+
+// sent by both sides after tunnel handshake, old peers ignore it and keep using appKey
+func (t *P2PTunnel) startKeyExchange() {
+	pub, err := t.kex.public()
+	if err != nil {
+		gLog.Printf(LvERROR, "%d tunnel key exchange error:%s", t.id, err)
+		return
+	}
+	req := newKeyExchangeMsg(tunnelKeyLabel(t.id), pub)
+	t.conn.WriteMessage(MsgP2P, MsgTunnelKeyExchange, &req)
+}
+
+// relay app asks the peer for an app session key through the relay tunnel
+func (app *p2pApp) startKeyExchange() {
+	t := app.RelayTunnel()
+	if t == nil {
+		return
+	}
+	app.kex.reset() // new overlays wait until the peer answers
+	pub, err := app.kex.public()
+	if err != nil {
+		gLog.Printf(LvERROR, "app %d key exchange error:%s", app.id, err)
+		return
+	}
+	req := newKeyExchangeMsg(appKeyLabel(app.id), pub)
+	req.AppID = app.id
+	req.RelayTunnelID = t.id
+	t.WriteMessage(app.rtid, MsgP2P, MsgAppKeyExchange, &req) // not RelayTunnelID(), it is 0 with a direct tunnel
+}
+
+// session key for the overlays of this app, nil if the peer doesn't support key exchange
+func (app *p2pApp) sessionKey() []byte {
+	if t := app.DirectTunnel(); t != nil {
+		return t.kex.sessionKey()
+	}
+	return app.kex.sessionKey()
+}
+
+// waitSessionKey waits for the session key of an aead peer, its overlays must not fall back to
+// appKey which the server knows
+func (app *p2pApp) waitSessionKey() ([]byte, error) {
+	for start := time.Now(); app.running && time.Since(start) < KeyExchangeTimeout; time.Sleep(time.Millisecond * 100) {
+		if key := app.sessionKey(); key != nil {
+			return key, nil
+		}
+	}
+	if app.running && app.DirectTunnel() == nil {
+		app.startKeyExchange() // the answer was lost, retry for the next overlay
+	}
+	return nil, ErrNoSessionKey
+}
+
+// handleAppKeyExchange answers the app key exchange as the peer of a relay app.
+// it queries the server, don't call it in the tunnel read loop.
+func (t *P2PTunnel) handleAppKeyExchange(req *KeyExchange) {
+	node := relayPeer(t.id, req.RelayTunnelID)
+	if node == "" || node != req.Node {
+		gLog.Printf(LvERROR, "app %d key exchange from %s, not the peer %q of relay tunnel %d", req.AppID, req.Node, node, req.RelayTunnelID)
+		return
+	}
+	err := ErrIdentityMissing // only peers with node identity exchange app keys
+	if req.Identity != "" {
+		err = verifyKeyExchange(req, node, appKeyLabel(req.AppID), publishedIdentity(node))
+	}
+	if err != nil {
+		gLog.Printf(LvERROR, "app %d key exchange from %s error:%s", req.AppID, node, err)
+		return
+	}
+	kex := keyExchange{}
+	pub, err := kex.public()
+	if err == nil {
+		err = kex.complete(req.Pub, appKeyLabel(req.AppID))
+	}
+	if err != nil {
+		gLog.Printf(LvERROR, "app %d key exchange error:%s", req.AppID, err)
+		return
+	}
+	if err = setAppSessionKey(node, req.AppID, req.Identity, kex.sessionKey()); err != nil {
+		gLog.Printf(LvERROR, "app %d key exchange from %s error:%s", req.AppID, node, err)
+		return
+	}
+	gLog.Printf(LvDEBUG, "app %d session key ready", req.AppID)
+	rsp := newKeyExchangeMsg(appKeyLabel(req.AppID), pub)
+	rsp.AppID = req.AppID
+	t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgAppKeyExchangeAck, &rsp)
+}
+
+// publishedIdentity asks the server for the identity node published at login, "" if the
+// server doesn't tell, e.g. node of another user, then the pin decides
+func publishedIdentity(node string) string {
+	if GNetwork == nil {
+		return ""
+	}
+	config := AppConfig{PeerNode: node}
+	if err := GNetwork.requestPeerInfo(&config); err != nil {
+		gLog.Printf(LvDEBUG, "query %s identity error:%s", node, err)
+		return ""
+	}
+	return config.peerIdentity
+}
+
+func (pn *P2PNetwork) updateAppSessionKey(rsp *KeyExchange) {
+	pn.apps.Range(func(id, i interface{}) bool {
+		app := i.(*p2pApp)
+		if app.id != rsp.AppID {
+			return true
+		}
+		err := verifyKeyExchange(rsp, app.config.PeerNode, appKeyLabel(app.id), app.config.peerIdentity)
+		if err == nil {
+			err = app.kex.complete(rsp.Pub, appKeyLabel(app.id))
+		}
+		if err != nil {
+			gLog.Printf(LvERROR, "app %d key exchange with %s error:%s", app.id, app.config.LogPeerNode(), err)
+		} else {
+			gLog.Printf(LvDEBUG, "app %d session key ready", app.id)
+		}
+		return true
+	})
+}
+
+// signed by the node identity, so relay nodes can not replace the public key
+func newKeyExchangeMsg(label string, pub []byte) KeyExchange {
+	id := localIdentity()
+	return KeyExchange{Pub: pub, Node: gConf.Network.Node, Identity: id.String(), Sig: id.sign(label, pub)}
+}
+
+// verifyKeyExchange checks the signature and the pinned identity of node.
+// peers before node identity send none, they are accepted until pinned or published.
+func verifyKeyExchange(req *KeyExchange, node string, label string, published string) error {
+	if req.Identity == "" {
+		if published != "" || trust().pinned(node) {
+			return ErrIdentityMissing
+		}
+		return nil
+	}
+	if err := verifyIdentitySig(req.Identity, label, req.Pub, req.Sig); err != nil {
+		return err
+	}
+	return trust().verify(node, req.Identity, published)
+}
+
+// close tunnels to revoked nodes, called when server pushes the revocation list
+func (pn *P2PNetwork) closeRevokedTunnels() {
+	pn.allTunnels.Range(func(_, i interface{}) bool {
+		t := i.(*P2PTunnel)
+		if t.peerIdentity != "" && trust().revoked(t.peerIdentity) {
+			gLog.Printf(LvWARN, "%d tunnel %s identity revoked, close it", t.id, t.config.LogPeerNode())
+			t.close()
+		}
+		return true
+	})
+}
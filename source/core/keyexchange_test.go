@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyExchange(t *testing.T) {
+	a, b := keyExchange{}, keyExchange{}
+	pubA, _ := a.public()
+	pubB, _ := b.public()
+	if err := a.complete(pubB, tunnelKeyLabel(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.complete(pubA, tunnelKeyLabel(1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.sessionKey()) != 32 || !bytes.Equal(a.sessionKey(), b.sessionKey()) {
+		t.Errorf("session key not equal")
+	}
+	if err := a.complete(pubB, tunnelKeyLabel(1)); err != ErrKeyExchangeNotStart {
+		t.Errorf("complete twice error:%v", err)
+	}
+	if err := (&keyExchange{}).complete(pubB, tunnelKeyLabel(1)); err != ErrKeyExchangeNotStart {
+		t.Errorf("complete without public key error:%v", err)
+	}
+
+	// a new exchange gets a new key
+	c, d := keyExchange{}, keyExchange{}
+	pubC, _ := c.public()
+	pubD, _ := d.public()
+	c.complete(pubD, tunnelKeyLabel(1))
+	d.complete(pubC, tunnelKeyLabel(1))
+	if bytes.Equal(a.sessionKey(), c.sessionKey()) || !bytes.Equal(c.sessionKey(), d.sessionKey()) {
+		t.Errorf("new exchange key error")
+	}
+	if _, err := newAEADCipher(CipherAESGCM, overlaySecret(c.sessionKey(), 1), nil, "test", true); err != nil {
+		t.Errorf("aead from session key error:%s", err)
+	}
+	c.reset()
+	if c.sessionKey() != nil {
+		t.Errorf("reset error")
+	}
+}
+
+func TestAppKeyExchangeBinding(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	tunnel := &P2PTunnel{id: 100}
+	kex := keyExchange{}
+	pub, _ := kex.public()
+	req := KeyExchange{Pub: pub, AppID: 7, RelayTunnelID: 200, Node: "victim"}
+	tunnel.handleAppKeyExchange(&req)
+	if getAppSessionKey("victim", 7) != nil {
+		t.Errorf("key of an unannounced relay tunnel stored")
+	}
+
+	addRelayPeer(tunnel.id, 200, "victim")
+	addRelayPeer(tunnel.id, 200, "attacker")
+	defer deleteRelayPeers(tunnel.id)
+	if node := relayPeer(tunnel.id, 200); node != "victim" {
+		t.Errorf("relay peer taken over by %s", node)
+	}
+	req.Node = "attacker"
+	tunnel.handleAppKeyExchange(&req)
+	if getAppSessionKey("attacker", 7) != nil || getAppSessionKey("victim", 7) != nil {
+		t.Errorf("key of another node stored")
+	}
+	req.Node = "victim"
+	tunnel.handleAppKeyExchange(&req)
+	if getAppSessionKey("victim", 7) != nil {
+		t.Errorf("unsigned key stored")
+	}
+
+	if err := setAppSessionKey("victim", 7, "identity1", []byte("key1")); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		appSessionKeyMtx.Lock()
+		delete(appSessionKeys, appSessionKeyID{"victim", 7})
+		appSessionKeyMtx.Unlock()
+	}()
+	if err := setAppSessionKey("victim", 7, "identity2", []byte("key2")); err != ErrIdentityMismatch || string(getAppSessionKey("victim", 7)) != "key1" {
+		t.Errorf("key of another identity replaced it:%v", err)
+	}
+	if err := setAppSessionKey("victim", 7, "identity1", []byte("key3")); err != nil || string(getAppSessionKey("victim", 7)) != "key3" {
+		t.Errorf("new key of the same identity error:%v", err)
+	}
+}
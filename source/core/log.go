@@ -1,11 +1,11 @@
 package core
 
 import (
-	"filepath"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
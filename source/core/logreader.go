@@ -0,0 +1,190 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logTimeLayout    = "2006/01/02 15:04:05.000000"
+	logTailInterval  = time.Millisecond * 500
+	logMaxLineLength = 1024 * 1024
+)
+
+// "2006/01/02 15:04:05.000000 pid LEVEL message", written by logger.Printf/Println
+var logLineRegexp = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}\.\d{6}) (\d+) +(Dev|DEBUG|INFO|WARN|ERROR) ?(.*)$`)
+
+type LogEntry struct {
+	Timestamp int64  `json:"timestamp"` // unix milliseconds
+	Level     string `json:"level"`
+	Module    string `json:"module,omitempty"`
+	Message   string `json:"message"`
+	PID       int    `json:"pid,omitempty"`
+}
+
+type logFilter struct {
+	level   string // exact level, empty for all
+	start   time.Time
+	end     time.Time
+	keyword string // case insensitive substring
+}
+
+func (f *logFilter) match(e *LogEntry) bool {
+	if f.level != "" && !strings.EqualFold(f.level, e.Level) {
+		return false
+	}
+	ts := time.UnixMilli(e.Timestamp)
+	if !f.start.IsZero() && ts.Before(f.start) {
+		return false
+	}
+	if !f.end.IsZero() && ts.After(f.end) {
+		return false
+	}
+	if f.keyword != "" && !strings.Contains(strings.ToLower(e.Message), strings.ToLower(f.keyword)) {
+		return false
+	}
+	return true
+}
+
+func parseLogLine(line string) *LogEntry {
+	m := logLineRegexp.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return nil
+	}
+	ts, err := time.ParseInLocation(logTimeLayout, m[1], time.Local)
+	if err != nil {
+		return nil
+	}
+	pid, _ := strconv.Atoi(m[2])
+	return &LogEntry{Timestamp: ts.UnixMilli(), PID: pid, Level: m[3], Message: m[4]}
+}
+
+// parseLogs parses log lines in order. lines not starting with a timestamp
+// belong to the previous entry, e.g. multi-line errors.
+func parseLogs(r io.Reader) []*LogEntry {
+	entries := []*LogEntry{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), logMaxLineLength)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if e := parseLogLine(line); e != nil {
+			entries = append(entries, e)
+		} else if len(entries) > 0 && strings.TrimSpace(line) != "" {
+			last := entries[len(entries)-1]
+			last.Message += "\n" + strings.TrimRight(line, "\r")
+		}
+	}
+	return entries
+}
+
+// log file path, rotated file is path + ".0"
+func (l *logger) filePath() string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if f, ok := l.files[0]; ok {
+		return f.Name()
+	}
+	return l.logDir + ProductName + logFileNames[0]
+}
+
+// readLogs returns the matched entries, newest first, skipping offset and at most limit.
+// total is the number of all matched entries.
+func readLogs(path string, filter *logFilter, offset int, limit int) ([]*LogEntry, int, error) {
+	entries := []*LogEntry{}
+	for _, name := range []string{path + ".0", path} { // oldest first
+		f, err := os.Open(name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, 0, err
+		}
+		for _, e := range parseLogs(f) {
+			if filter.match(e) {
+				entries = append(entries, e)
+			}
+		}
+		f.Close()
+	}
+	total := len(entries)
+	res := []*LogEntry{}
+	for i := total - 1 - offset; i >= 0 && len(res) < limit; i-- {
+		res = append(res, entries[i])
+	}
+	return res, total, nil
+}
+
+// logTailer follows the log file like tail -f, reopen it after rotation
+type logTailer struct {
+	path    string
+	f       *os.File
+	pending []byte // incomplete last line
+}
+
+// open at the end, only new logs will be read
+func newLogTailer(path string) (*logTailer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &logTailer{path: path, f: f}, nil
+}
+
+func (t *logTailer) Close() error {
+	return t.f.Close()
+}
+
+// read returns the complete lines appended since last read
+func (t *logTailer) read() ([]string, error) {
+	buf, err := io.ReadAll(t.f)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 && t.rotated() {
+		f, err := os.Open(t.path)
+		if err != nil {
+			return nil, nil // logger is recreating it, try next time
+		}
+		t.f.Close()
+		t.f = f
+		t.pending = nil
+		if buf, err = io.ReadAll(t.f); err != nil {
+			return nil, err
+		}
+	}
+	buf = append(t.pending, buf...)
+	end := bytes.LastIndexByte(buf, '\n')
+	if end < 0 {
+		t.pending = buf
+		return nil, nil
+	}
+	t.pending = append([]byte{}, buf[end+1:]...)
+	return strings.Split(string(buf[:end]), "\n"), nil
+}
+
+// the path now points to another file, or the file is truncated
+func (t *logTailer) rotated() bool {
+	st, err := os.Stat(t.path)
+	if err != nil {
+		return false
+	}
+	cur, err := t.f.Stat()
+	if err != nil {
+		return true
+	}
+	if !os.SameFile(st, cur) {
+		return true
+	}
+	pos, err := t.f.Seek(0, io.SeekCurrent)
+	return err == nil && st.Size() < pos
+}
@@ -0,0 +1,72 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadLogs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "openp2p.log")
+	os.WriteFile(path+".0", []byte("2024/01/02 10:00:00.000001 100 INFO old start\n"+
+		"2024/01/02 10:00:01.000000 100 ERROR old error\ngoroutine 1 [running]:\n"), 0644)
+	os.WriteFile(path, []byte("2024/01/02 11:00:00.000000 200 INFO new start\n"+
+		"2024/01/02 11:00:01.000000 200  WARN  relay tunnel error\n"+
+		"2024/01/02 11:00:02.000000 200 DEBUG punch ok\n"), 0644)
+
+	logs, total, err := readLogs(path, &logFilter{}, 0, 10)
+	if err != nil || total != 5 || len(logs) != 5 {
+		t.Fatalf("read all error:%v total=%d", err, total)
+	}
+	if logs[0].Message != "punch ok" || logs[4].Message != "old start" || logs[4].PID != 100 {
+		t.Errorf("order error:%+v %+v", logs[0], logs[4])
+	}
+	if logs[3].Message != "old error\ngoroutine 1 [running]:" {
+		t.Errorf("multi-line error:%q", logs[3].Message)
+	}
+	if logs[1].Level != "WARN" || logs[1].Message != " relay tunnel error" {
+		t.Errorf("println format error:%+v", logs[1])
+	}
+
+	logs, total, _ = readLogs(path, &logFilter{level: "info"}, 1, 10)
+	if total != 2 || len(logs) != 1 || logs[0].Message != "old start" {
+		t.Errorf("level and offset error:%d %+v", total, logs)
+	}
+	start, _ := time.ParseInLocation(logTimeLayout, "2024/01/02 10:30:00.000000", time.Local)
+	logs, total, _ = readLogs(path, &logFilter{start: start, keyword: "TUNNEL"}, 0, 10)
+	if total != 1 || logs[0].Level != "WARN" {
+		t.Errorf("time and keyword error:%d %+v", total, logs)
+	}
+}
+
+func TestLogTailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "openp2p.log")
+	os.WriteFile(path, []byte("2024/01/02 11:00:00.000000 200 INFO before tail\n"), 0644)
+	tailer, err := newLogTailer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tailer.Close()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString("2024/01/02 11:00:01.000000 200 INFO line1\n2024/01/02 11:00:02")
+	lines, _ := tailer.read()
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "line1") {
+		t.Errorf("read error:%q", lines)
+	}
+	f.WriteString(".000000 200 INFO line2\n")
+	f.Close()
+	lines, _ = tailer.read()
+	if len(lines) != 1 || !strings.HasSuffix(lines[0], "line2") {
+		t.Errorf("read partial line error:%q", lines)
+	}
+
+	// rotate like logger.checkFile
+	os.Rename(path, path+".0")
+	os.WriteFile(path, []byte("2024/01/02 11:00:03.000000 200 INFO rotated\n"), 0644)
+	if lines, _ = tailer.read(); len(lines) != 1 || !strings.HasSuffix(lines[0], "rotated") {
+		t.Errorf("read after rotation error:%q", lines)
+	}
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// prometheus text exposition format, small enough to not need the client library
+
+var metricCounters []*metricCounter
+
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	values sync.Map // joined label values -> *uint64
+}
+
+func newMetricCounter(name string, help string, labels ...string) *metricCounter {
+	c := &metricCounter{name: name, help: help, labels: labels}
+	metricCounters = append(metricCounters, c)
+	return c
+}
+
+func (c *metricCounter) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *metricCounter) add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values.Load(key)
+	if !ok {
+		v, _ = c.values.LoadOrStore(key, new(uint64))
+	}
+	atomic.AddUint64(v.(*uint64), n)
+}
+
+func (c *metricCounter) value(labelValues ...string) uint64 {
+	v, ok := c.values.Load(strings.Join(labelValues, "\xff"))
+	if !ok {
+		return 0
+	}
+	return atomic.LoadUint64(v.(*uint64))
+}
+
+func (c *metricCounter) write(mw *metricWriter) {
+	mw.header(c.name, c.help, "counter")
+	keys := []string{}
+	c.values.Range(func(k, _ interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+	sort.Strings(keys)
+	for _, k := range keys {
+		var values []string
+		if len(c.labels) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		mw.sample(c.name, c.labels, values, float64(c.value(values...)))
+	}
+}
+
+var (
+	metricPunchAttempts = newMetricCounter("openp2p_punch_attempts_total", "Hole punching attempts by method.", "method")
+	metricPunchFailures = newMetricCounter("openp2p_punch_failures_total", "Hole punching failures by method.", "method")
+	metricThrottled     = newMetricCounter("openp2p_speedlimit_throttled_total", "Share bandwidth limiter throttling events.")
+	metricReconnects    = newMetricCounter("openp2p_websocket_reconnects_total", "Reconnects to the signaling server.")
+	metricSDWANRouted   = newMetricCounter("openp2p_sdwan_packets_routed_total", "SDWAN packets routed.", "direction")
+	metricSDWANDropped  = newMetricCounter("openp2p_sdwan_packets_dropped_total", "SDWAN packets dropped.", "reason")
+	metricDatagrams     = newMetricCounter("openp2p_quic_datagrams_total", "Messages in quic datagrams.", "direction")
+)
+
+// punch methods
+const (
+	punchMethodC2C          = "c2c"
+	punchMethodC2S          = "c2s"
+	punchMethodS2C          = "s2c"
+	punchMethodS2S          = "s2s"
+	punchMethodTCP          = "tcppunch"
+	punchMethodTCPSymmetric = "tcppunch_symmetric"
+	punchMethodUDP6         = "udp6"
+)
+
+type metricWriter struct {
+	w io.Writer
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mw *metricWriter) header(name string, help string, metricType string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (mw *metricWriter) sample(name string, labels []string, values []string, v float64) {
+	fmt.Fprint(mw.w, name)
+	if len(labels) > 0 {
+		pairs := make([]string, len(labels))
+		for i, l := range labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, l, metricLabelEscaper.Replace(values[i]))
+		}
+		fmt.Fprintf(mw.w, "{%s}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(mw.w, " %g\n", v)
+}
+
+// gauge with no labels
+func (mw *metricWriter) gauge(name string, help string, v float64) {
+	mw.header(name, help, "gauge")
+	mw.sample(name, nil, nil, v)
+}
+
+// gauges are collected on scrape
+func writeMetrics(w io.Writer) {
+	mw := &metricWriter{w: w}
+	for _, c := range metricCounters {
+		c.write(mw)
+	}
+
+	traffic := NodeTraffic()
+	mw.header("openp2p_traffic_bytes_total", "Traffic bytes, relayed is forwarded for other nodes.", "counter")
+	for _, p := range []struct {
+		path string
+		snap TrafficSnapshot
+	}{{"direct", traffic.Direct}, {"relay", traffic.Relay}, {"relayed", traffic.Relayed}} {
+		mw.sample("openp2p_traffic_bytes_total", []string{"path", "direction"}, []string{p.path, "tx"}, float64(p.snap.TxBytes))
+		mw.sample("openp2p_traffic_bytes_total", []string{"path", "direction"}, []string{p.path, "rx"}, float64(p.snap.RxBytes))
+	}
+
+	mw.gauge("openp2p_api_sessions", "Active management API sessions.", float64(gSessions.count()))
+	if GNetwork == nil { // management API only
+		return
+	}
+	online := 0.0
+	if GNetwork.online {
+		online = 1
+	}
+	mw.gauge("openp2p_online", "Connected to the signaling server.", online)
+	mw.gauge("openp2p_nat_type", "NAT type, 0:none 1:cone 2:symmetric 314:unknown.", float64(gConf.Network.natType))
+
+	tunnels := map[string]int{}
+	GNetwork.allTunnels.Range(func(_, i interface{}) bool {
+		t := i.(*P2PTunnel)
+		mode := t.linkModeWeb
+		if mode == "" {
+			mode = t.config.linkMode
+		}
+		tunnels[mode]++
+		return true
+	})
+	mw.header("openp2p_tunnels", "Tunnels by link mode.", "gauge")
+	for _, mode := range sortedKeys(tunnels) {
+		mw.sample("openp2p_tunnels", []string{"link_mode"}, []string{mode}, float64(tunnels[mode]))
+	}
+
+	apps := map[[2]string]int{}
+	GNetwork.apps.Range(func(_, i interface{}) bool {
+		app := i.(*p2pApp)
+		state, path := "inactive", "none"
+		if app.isActive() {
+			state = "active"
+		}
+		if app.Tunnel() != nil {
+			path = "relay"
+			if app.isDirect() {
+				path = "direct"
+			}
+		}
+		apps[[2]string{state, path}]++
+		return true
+	})
+	mw.header("openp2p_apps", "Apps by state and path.", "gauge")
+	for _, state := range []string{"active", "inactive"} {
+		for _, path := range []string{"direct", "relay", "none"} {
+			mw.sample("openp2p_apps", []string{"state", "path"}, []string{state, path}, float64(apps[[2]string{state, path}]))
+		}
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	writeMetrics(buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// StartMetrics listen addr and serve /metrics, empty addr disables it
+func StartMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	go func() {
+		gLog.Printf(LvINFO, "metrics listen on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			gLog.Printf(LvERROR, "metrics listen error:%s", err)
+		}
+	}()
+}
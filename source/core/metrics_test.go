@@ -0,0 +1,32 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	c := &metricCounter{name: "openp2p_test_total", help: "Test.", labels: []string{"method"}}
+	c.inc("c2c")
+	c.add(2, `a"b`)
+	if c.value("c2c") != 1 || c.value("none") != 0 {
+		t.Errorf("counter value error")
+	}
+	buf := &bytes.Buffer{}
+	c.write(&metricWriter{w: buf})
+	want := "# HELP openp2p_test_total Test.\n# TYPE openp2p_test_total counter\n" +
+		"openp2p_test_total{method=\"a\\\"b\"} 2\nopenp2p_test_total{method=\"c2c\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("write counter got:\n%s", buf.String())
+	}
+
+	metricPunchFailures.inc(punchMethodC2S)
+	buf.Reset()
+	writeMetrics(buf)
+	for _, s := range []string{`openp2p_punch_failures_total{method="c2s"}`, "openp2p_traffic_bytes_total{path=\"relayed\",direction=\"rx\"}", "openp2p_api_sessions "} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("metrics missing %s", s)
+		}
+	}
+}
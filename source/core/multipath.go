@@ -0,0 +1,374 @@
+package core
+
+import (
+	"errors"
+	"time"
+)
+
+// multipath apps send the tcp overlay data on all tunnels of the app. beside the direct and
+// the relay tunnel it builds another direct tunnel, on the other transport if it can, and a
+// relay tunnel through another relay node, they are bonded as paths of the overlays.
+// redundant sends every packet on all paths, the receiver keeps the first copy by seq.
+// aggregate picks one path per packet by smooth weighted round robin, weighted by rtt
+// and loss, the receiver reorders by seq. it builds on the seq numbered overlays of
+// migration, a lost path is recovered by resending the unacked data.
+
+const (
+	MultipathRedundant = "redundant"
+	MultipathAggregate = "aggregate"
+)
+
+const (
+	MultipathDirectTunnels = 2 // direct tunnels of a multipath app
+	MultipathRelayTunnels  = 2 // relay tunnels of a multipath app, each through another relay node
+	MultipathRetryInterval = time.Minute
+)
+
+var ErrNoOtherRelay = errors.New("no other relay node")
+
+func isMultipathSupported(mode string) bool {
+	return mode == MultipathRedundant || mode == MultipathAggregate
+}
+
+type overlayPath struct {
+	tunnel  *P2PTunnel
+	rtid    uint64
+	current int // smooth weighted round robin
+}
+
+// enableMultipath must be called after enableMigration
+func (oConn *overlayConn) enableMultipath(mode string) {
+	oConn.sendMtx.Lock()
+	oConn.multipath = mode
+	oConn.paths = []*overlayPath{{tunnel: oConn.tunnel, rtid: oConn.rtid}}
+	oConn.sendMtx.Unlock()
+	oConn.recvMtx.Lock()
+	oConn.reorder = map[uint64][]byte{}
+	oConn.recvMtx.Unlock()
+}
+
+func (oConn *overlayConn) multipathMode() string {
+	oConn.sendMtx.Lock()
+	defer oConn.sendMtx.Unlock()
+	return oConn.multipath
+}
+
+// caller holds sendMtx
+func (oConn *overlayConn) findPath(t *P2PTunnel, rtid uint64) *overlayPath {
+	for _, p := range oConn.paths {
+		if p.tunnel == t && p.rtid == rtid {
+			return p
+		}
+	}
+	return nil
+}
+
+// addPath tells the peer through the new path, the data behind it on the same tunnel can be found
+func (oConn *overlayConn) addPath(t *P2PTunnel, rtid uint64, notify bool) {
+	oConn.sendMtx.Lock()
+	defer oConn.sendMtx.Unlock()
+	if oConn.multipath == "" || oConn.findPath(t, rtid) != nil {
+		return
+	}
+	oConn.paths = append(oConn.paths, &overlayPath{tunnel: t, rtid: rtid})
+	t.overlayConns.Store(oConn.id, oConn)
+	if notify {
+		req := OverlayMigrateReq{ID: oConn.id, Token: gConf.Network.Token}
+		if rtid != 0 {
+			req.RelayTunnelID = t.id
+		}
+		t.WriteMessage(rtid, MsgP2P, MsgOverlayAddPath, &req)
+	}
+	gLog.Printf(LvDEBUG, "overlay %d add path tunnel %d rtid:%d", oConn.id, t.id, rtid)
+}
+
+// dropPath removes the closed tunnel, the home moves to another path
+func (oConn *overlayConn) dropPath(t *P2PTunnel) {
+	oConn.sendMtx.Lock()
+	defer oConn.sendMtx.Unlock()
+	paths := oConn.paths[:0]
+	for _, p := range oConn.paths {
+		if p.tunnel != t {
+			paths = append(paths, p)
+		}
+	}
+	oConn.paths = paths
+	t.overlayConns.Delete(oConn.id)
+	if oConn.tunnel == t && len(paths) > 0 {
+		oConn.tunnel, oConn.rtid = paths[0].tunnel, paths[0].rtid
+	}
+}
+
+// prunePaths removes the paths on closed tunnels, caller holds sendMtx
+func (oConn *overlayConn) prunePaths() bool {
+	paths := oConn.paths[:0]
+	for _, p := range oConn.paths {
+		if p.tunnel.isRuning() {
+			paths = append(paths, p)
+		} else if p.tunnel != oConn.tunnel {
+			p.tunnel.overlayConns.Delete(oConn.id)
+		}
+	}
+	lost := len(paths) < len(oConn.paths)
+	oConn.paths = paths
+	return lost
+}
+
+// recoverPaths moves the home to a live path, both sides resend the unacked data
+func (oConn *overlayConn) recoverPaths() {
+	oConn.sendMtx.Lock()
+	t, rtid := oConn.tunnel, oConn.rtid
+	if !t.isRuning() {
+		for _, p := range oConn.paths {
+			if p.tunnel.isRuning() {
+				t, rtid = p.tunnel, p.rtid
+				break
+			}
+		}
+	}
+	oConn.sendMtx.Unlock()
+	oConn.migrate(t, rtid, true)
+}
+
+// schedule returns the paths for the next packet and whether a path is lost, caller holds sendMtx
+func (oConn *overlayConn) schedule() ([]*overlayPath, bool) {
+	lost := oConn.prunePaths()
+	if len(oConn.paths) <= 1 || oConn.multipath == MultipathRedundant {
+		return oConn.paths, lost
+	}
+	total := 0
+	var best *overlayPath
+	for _, p := range oConn.paths {
+		w := oConn.pathWeight(p)
+		p.current += w
+		total += w
+		if best == nil || p.current > best.current {
+			best = p
+		}
+	}
+	best.current -= total
+	return []*overlayPath{best}, lost
+}
+
+// pathWeight is about the packets per second the path delivers, the relay path of the app uses
+// the end-to-end rtt. the extra relays aren't probed end to end, they count twice the rtt to
+// the relay node.
+func (oConn *overlayConn) pathWeight(p *overlayPath) int {
+	s := p.tunnel.rtt.Snapshot()
+	if p.rtid != 0 {
+		if oConn.app != nil && oConn.app.RelayTunnel() == p.tunnel {
+			s = oConn.app.relayRTT.Snapshot()
+		} else {
+			s.RTT *= 2
+		}
+	}
+	rtt := s.RTT
+	if rtt <= 0 { // no sample yet
+		rtt = 100
+	}
+	if rtt < 1 {
+		rtt = 1
+	}
+	loss := s.Loss
+	if loss < 0 { // unknown
+		loss = 0
+	}
+	return int(1000*(1-loss)/rtt) + 1
+}
+
+// removeFromTunnels is called when the overlay closed
+func (oConn *overlayConn) removeFromTunnels() {
+	oConn.sendMtx.Lock()
+	defer oConn.sendMtx.Unlock()
+	oConn.tunnel.overlayConns.Delete(oConn.id)
+	for _, p := range oConn.paths {
+		p.tunnel.overlayConns.Delete(oConn.id)
+	}
+}
+
+func (t *P2PTunnel) handleOverlayAddPath(req *OverlayMigrateReq) {
+	if req.Token != gConf.Network.Token {
+		gLog.Printf(LvERROR, "overlay %d add path access denied", req.ID)
+		return
+	}
+	i, ok := migratableOverlays.Load(req.ID)
+	if !ok {
+		gLog.Printf(LvDEBUG, "%d tunnel not found overlay %d to add path", t.id, req.ID)
+		return
+	}
+	i.(*overlayConn).addPath(t, req.RelayTunnelID, false)
+}
+
+// appPath is a tunnel of the app, rtid is the peer's tunnel id at the relay node, 0 if direct
+type appPath struct {
+	tunnel    *P2PTunnel
+	rtid      uint64
+	relayMode string
+}
+
+// paths returns the direct and relay tunnel of the app and the extra tunnels of multipath
+func (app *p2pApp) paths() []appPath {
+	app.tunnelMtx.Lock()
+	defer app.tunnelMtx.Unlock()
+	paths := []appPath{}
+	if app.directTunnel != nil {
+		paths = append(paths, appPath{tunnel: app.directTunnel})
+	}
+	if app.relayTunnel != nil {
+		paths = append(paths, appPath{tunnel: app.relayTunnel, rtid: app.rtid, relayMode: app.relayMode})
+	}
+	return append(paths, app.extraPaths...)
+}
+
+func (app *p2pApp) addExtraPath(p appPath) {
+	app.tunnelMtx.Lock()
+	app.extraPaths = append(app.extraPaths, p)
+	app.tunnelMtx.Unlock()
+	gLog.Printf(LvINFO, "%s appid:%d multipath add tunnel %d rtid:%d", app.config.LogPeerNode(), app.id, p.tunnel.id, p.rtid)
+	app.addOverlayPaths()
+}
+
+// dropExtraTunnel is called when the tunnel closed
+func (app *p2pApp) dropExtraTunnel(t *P2PTunnel) {
+	app.tunnelMtx.Lock()
+	defer app.tunnelMtx.Unlock()
+	paths := app.extraPaths[:0]
+	for _, p := range app.extraPaths {
+		if p.tunnel != t {
+			paths = append(paths, p)
+		}
+	}
+	app.extraPaths = paths
+}
+
+// takeExtraPath removes the first extra direct or relay tunnel and returns it
+func (app *p2pApp) takeExtraPath(relay bool) *appPath {
+	app.tunnelMtx.Lock()
+	defer app.tunnelMtx.Unlock()
+	for i, p := range app.extraPaths {
+		if (p.rtid != 0) == relay && p.tunnel.isRuning() {
+			app.extraPaths = append(app.extraPaths[:i:i], app.extraPaths[i+1:]...)
+			return &p
+		}
+	}
+	return nil
+}
+
+// promotePaths replaces a lost direct or relay tunnel by an extra one, the overlays keep it as a path
+func (app *p2pApp) promotePaths() {
+	if app.DirectTunnel() == nil {
+		if p := app.takeExtraPath(false); p != nil {
+			gLog.Printf(LvINFO, "%s appid:%d use multipath tunnel %d as direct tunnel", app.config.LogPeerNode(), app.id, p.tunnel.id)
+			app.setDirectTunnel(p.tunnel)
+		}
+	}
+	if app.RelayTunnel() == nil {
+		if p := app.takeExtraPath(true); p != nil {
+			gLog.Printf(LvINFO, "%s appid:%d use multipath tunnel %d rtid:%d as relay tunnel", app.config.LogPeerNode(), app.id, p.tunnel.id, p.rtid)
+			app.setRelayTunnelID(p.rtid)
+			app.setRelayTunnel(p.tunnel)
+			app.relayNode = p.tunnel.config.PeerNode
+			app.relayMode = p.relayMode
+			app.updateHeartbeat()
+			app.startKeyExchange()
+		}
+	}
+}
+
+// checkMultipathTunnels builds the extra tunnels after the direct or relay tunnel connected
+func (app *p2pApp) checkMultipathTunnels() {
+	if !isMultipathSupported(app.config.Multipath) || compareVersion(app.config.peerVersion, SupportMultipathVersion) < 0 {
+		return
+	}
+	app.promotePaths()
+	if app.config.Enabled == 0 || app.nextRetryPathTime.After(time.Now()) {
+		return
+	}
+	direct, relays := 0, 0
+	for _, p := range app.paths() {
+		if p.rtid == 0 {
+			direct++
+		} else {
+			relays++
+		}
+	}
+	var errDirect, errRelay error
+	if t := app.DirectTunnel(); t != nil && direct < MultipathDirectTunnels {
+		errDirect = app.buildExtraDirectTunnel(t)
+	}
+	if app.RelayTunnel() != nil && relays < MultipathRelayTunnels {
+		errRelay = app.buildExtraRelayTunnel()
+	}
+	if errDirect != nil || errRelay != nil {
+		gLog.Printf(LvDEBUG, "%s appid:%d multipath tunnel error: direct %v, relay %v", app.config.LogPeerNode(), app.id, errDirect, errRelay)
+		app.nextRetryPathTime = time.Now().Add(MultipathRetryInterval)
+	}
+}
+
+// buildExtraDirectTunnel builds another direct tunnel beside t, a udp tunnel is bonded with a tcp one
+func (app *p2pApp) buildExtraDirectTunnel(t *P2PTunnel) error {
+	config := app.config
+	config.multipathTunnel = 1
+	switch t.config.linkMode {
+	case LinkModeUDPPunch, LinkModeUDP4, LinkModeUDP6:
+		config.PunchPriority |= PunchPriorityUDPDisable
+	default:
+		config.PunchPriority |= PunchPriorityTCPDisable
+	}
+	extra, err := GNetwork.addDirectTunnel(config, 0)
+	if err != nil {
+		return err
+	}
+	app.addExtraPath(appPath{tunnel: extra})
+	return nil
+}
+
+// buildExtraRelayTunnel asks the server for a relay node the app doesn't use yet
+func (app *p2pApp) buildExtraRelayTunnel() error {
+	exclude := []string{}
+	for _, p := range app.paths() {
+		if p.rtid != 0 {
+			exclude = append(exclude, p.tunnel.config.PeerNode)
+		}
+	}
+	rsp, err := GNetwork.requestRelayNode(app.config.PeerNode, "", exclude)
+	if err != nil {
+		return err
+	}
+	for _, node := range exclude {
+		if node == rsp.RelayName { // old servers don't know exclude
+			return ErrNoOtherRelay
+		}
+	}
+	config := app.config
+	config.RelayNode = rsp.RelayName
+	t, rtid, relayMode, err := GNetwork.addRelayTunnel(config)
+	if err != nil {
+		return err
+	}
+	app.addExtraPath(appPath{tunnel: t, rtid: rtid, relayMode: relayMode})
+	return nil
+}
+
+// addPaths adds all tunnels of the app to a multipath overlay
+func (app *p2pApp) addPaths(oConn *overlayConn) {
+	for _, p := range app.paths() {
+		oConn.addPath(p.tunnel, p.rtid, true)
+	}
+}
+
+// addOverlayPaths is called when the app got a new tunnel
+func (app *p2pApp) addOverlayPaths() {
+	if !isMultipathSupported(app.config.Multipath) {
+		return
+	}
+	for _, p := range app.paths() {
+		p.tunnel.overlayConns.Range(func(_, i interface{}) bool {
+			oConn := i.(*overlayConn)
+			if oConn.appID == app.id && oConn.isClient && oConn.multipathMode() != "" {
+				app.addPaths(oConn)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMultipathSchedule(t *testing.T) {
+	fast, slow := &P2PTunnel{id: 1}, &P2PTunnel{id: 2}
+	fast.setRun(true)
+	slow.setRun(true)
+	fast.rtt.addSample(time.Millisecond * 10)
+	slow.rtt.addSample(time.Millisecond * 30)
+	oConn := overlayConn{id: 1, tunnel: fast}
+	oConn.enableMultipath(MultipathAggregate)
+	oConn.paths = append(oConn.paths, &overlayPath{tunnel: slow})
+
+	count := map[uint64]int{}
+	for i := 0; i < 400; i++ {
+		paths, lost := oConn.schedule()
+		if len(paths) != 1 || lost {
+			t.Fatalf("aggregate schedule error:%d %t", len(paths), lost)
+		}
+		count[paths[0].tunnel.id]++
+	}
+	if count[1] < 290 || count[1] > 310 { // about 3:1
+		t.Errorf("aggregate not weighted by rtt:%v", count)
+	}
+
+	oConn.multipath = MultipathRedundant
+	if paths, _ := oConn.schedule(); len(paths) != 2 {
+		t.Errorf("redundant should send on all paths")
+	}
+	slow.setRun(false)
+	if paths, lost := oConn.schedule(); len(paths) != 1 || !lost {
+		t.Errorf("closed path not pruned")
+	}
+}
+
+func TestMultipathAppPaths(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	direct, relay, direct2, relay2 := &P2PTunnel{id: 1}, &P2PTunnel{id: 2}, &P2PTunnel{id: 3}, &P2PTunnel{id: 4}
+	for _, tunnel := range []*P2PTunnel{direct, relay, direct2, relay2} {
+		tunnel.setRun(true)
+	}
+	app := &p2pApp{id: 1, config: AppConfig{Multipath: MultipathAggregate}}
+	app.setDirectTunnel(direct)
+	app.setRelayTunnel(relay)
+	app.setRelayTunnelID(20)
+	app.addExtraPath(appPath{tunnel: direct2})
+	app.addExtraPath(appPath{tunnel: relay2, rtid: 40})
+	if paths := app.paths(); len(paths) != 4 || paths[3].tunnel != relay2 || paths[3].rtid != 40 {
+		t.Errorf("paths error:%v", paths)
+	}
+
+	relay.rtt.addSample(time.Millisecond * 100)
+	relay2.rtt.addSample(time.Millisecond * 10)
+	oConn := overlayConn{id: 1, tunnel: direct, app: app}
+	if w := oConn.pathWeight(&overlayPath{tunnel: relay2, rtid: 40}); w != 1000/20+1 {
+		t.Errorf("extra relay weight %d", w)
+	}
+
+	// the lost direct tunnel is replaced by the extra one
+	app.setDirectTunnel(nil)
+	app.dropExtraTunnel(direct)
+	app.promotePaths()
+	if app.DirectTunnel() != direct2 || len(app.paths()) != 3 {
+		t.Errorf("extra direct tunnel not promoted")
+	}
+	relay2.setRun(false)
+	app.dropExtraTunnel(relay2)
+	if len(app.paths()) != 2 || app.takeExtraPath(true) != nil {
+		t.Errorf("closed extra tunnel not dropped")
+	}
+}
+
+func TestMultipathReorder(t *testing.T) {
+	oConn := overlayConn{id: 1, tunnel: &P2PTunnel{}, recvData: make(chan []byte, 10)}
+	oConn.running.Store(true)
+	oConn.enableMultipath(MultipathAggregate)
+	packet := func(seq uint64) []byte {
+		b := make([]byte, overlayHeaderSize+8)
+		binary.LittleEndian.PutUint64(b, oConn.id)
+		binary.LittleEndian.PutUint64(b[overlayHeaderSize:], seq)
+		return append(b, fmt.Sprintf("data%d", seq)...)
+	}
+	for _, seq := range []uint64{3, 2, 3, 1, 4} {
+		if _, err := oConn.receiveSeq(packet(seq), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 4; i++ {
+		if got := string(<-oConn.recvData); got != fmt.Sprintf("data%d", i) {
+			t.Errorf("seq %d got %s", i, got)
+		}
+	}
+	if len(oConn.recvData) != 0 || len(oConn.reorder) != 0 {
+		t.Errorf("reorder error")
+	}
+}
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -88,24 +90,289 @@ func natTest(serverHost string, serverPort int, localPort int) (publicIP string,
 	return natRsp.IP, natRsp.Port, nil
 }
 
-func getNATType(host string, udp1 int, udp2 int) (publicIP string, NATType int, err error) {
-	// the random local port may be used by other.
-	localPort := int(rand.Uint32()%15000 + 50000)
+// natProbe sends MsgNAT to dst and waits the reply, retransmits for udp loss. replies must come
+// from the changed ip or port, so a late reply of the former probe is ignored.
+func natProbe(conn *net.UDPConn, dst *net.UDPAddr, req NatDetectReq) (rsp NatDetectRsp, err error) {
+	msg, err := newMessage(MsgNATDetect, MsgNAT, req)
+	if err != nil {
+		return rsp, err
+	}
+	buffer := make([]byte, 1024)
+	for i := 0; i < NatProbeRetry; i++ {
+		if _, err = conn.WriteToUDP(msg, dst); err != nil {
+			return rsp, err
+		}
+		conn.SetReadDeadline(time.Now().Add(NatProbeTimeout))
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			if n < openP2PHeaderSize || binary.LittleEndian.Uint16(buffer[4:]) != MsgNATDetect || binary.LittleEndian.Uint16(buffer[6:]) != MsgNAT {
+				continue
+			}
+			if (req.ChangeIP && from.IP.Equal(dst.IP)) || req.ChangePort == (from.Port == dst.Port) {
+				continue
+			}
+			rsp = NatDetectRsp{}
+			if err = json.Unmarshal(buffer[openP2PHeaderSize:n], &rsp); err != nil {
+				continue
+			}
+			return rsp, nil
+		}
+	}
+	return rsp, fmt.Errorf("nat probe %s %+v timeout", dst, req)
+}
 
-	ip1, port1, err := natTest(host, udp1, localPort)
+// hairpinTest sends to the mapped address of conn, it comes back if the NAT supports hairpinning
+func hairpinTest(conn *net.UDPConn, mapped *net.UDPAddr) int {
+	nonce := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nonce, rand.Uint64())
+	buffer := make([]byte, 1024)
+	for i := 0; i < NatProbeRetry; i++ {
+		if _, err := conn.WriteToUDP(nonce, mapped); err != nil {
+			return NATHairpinUnknown
+		}
+		conn.SetReadDeadline(time.Now().Add(NatProbeTimeout))
+		for {
+			n, _, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			if bytes.Equal(buffer[:n], nonce) {
+				return NATHairpinYes
+			}
+		}
+	}
+	return NATHairpinNo
+}
+
+// natBehaviorTest classifies the NAT as RFC 5780. the filtering tests go first, later probes to
+// the other addresses would open the filter. old servers have no other address, only the
+// mapping is tested by udp2 as before. without an alternate ip the endpoint independent
+// filtering can't be told from the address dependent one, the latter is reported.
+func natBehaviorTest(host string, udp1 int, udp2 int, localPort int) (publicIP string, behavior NATBehavior, err error) {
+	gLog.Println(LvDEBUG, "natBehaviorTest start")
+	defer gLog.Println(LvDEBUG, "natBehaviorTest end")
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localPort})
 	if err != nil {
-		return "", 0, err
+		gLog.Println(LvERROR, "natBehaviorTest listen udp error:", err)
+		return "", behavior, err
 	}
-	_, port2, err := natTest(host, udp2, localPort) // 2rd nat test not need testing publicip
-	gLog.Printf(LvDEBUG, "local port:%d  nat port:%d", localPort, port2)
+	defer conn.Close()
+	dst, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, udp1))
 	if err != nil {
-		return "", 0, err
+		return "", behavior, err
+	}
+	rsp1, err := natProbe(conn, dst, NatDetectReq{})
+	if err != nil {
+		gLog.Println(LvERROR, "NAT detect error:", err)
+		return "", behavior, err
+	}
+	mapped := &net.UDPAddr{IP: net.ParseIP(rsp1.IP), Port: rsp1.Port}
+	if rsp1.OtherPort != 0 {
+		behavior.Filtering = NATAddressAndPortDependent
+		if rsp1.OtherIP != "" {
+			if _, err = natProbe(conn, dst, NatDetectReq{ChangeIP: true, ChangePort: true}); err == nil {
+				behavior.Filtering = NATEndpointIndependent
+			}
+		}
+		if behavior.Filtering != NATEndpointIndependent {
+			if _, err = natProbe(conn, dst, NatDetectReq{ChangePort: true}); err == nil {
+				behavior.Filtering = NATAddressDependent
+			}
+		}
+	}
+	behavior.Hairpin = hairpinTest(conn, mapped)
+
+	// the mapping to another ip, or another port of the same ip by old servers
+	otherPort := udp2
+	if rsp1.OtherPort != 0 {
+		otherPort = rsp1.OtherPort
+	}
+	sameAddr := func(rsp NatDetectRsp) bool { return rsp.IP == rsp1.IP && rsp.Port == rsp1.Port }
+	if rsp1.OtherIP == "" {
+		rsp2, err := natProbe(conn, &net.UDPAddr{IP: dst.IP, Port: otherPort}, NatDetectReq{})
+		if err != nil {
+			return "", behavior, err
+		}
+		behavior.Mapping = NATAddressAndPortDependent
+		if sameAddr(rsp2) {
+			behavior.Mapping = NATEndpointIndependent
+		}
+	} else {
+		otherIP := net.ParseIP(rsp1.OtherIP)
+		rsp2, err := natProbe(conn, &net.UDPAddr{IP: otherIP, Port: udp1}, NatDetectReq{})
+		if err != nil {
+			return "", behavior, err
+		}
+		if sameAddr(rsp2) {
+			behavior.Mapping = NATEndpointIndependent
+		} else {
+			rsp3, err := natProbe(conn, &net.UDPAddr{IP: otherIP, Port: otherPort}, NatDetectReq{})
+			if err != nil {
+				return "", behavior, err
+			}
+			behavior.Mapping = NATAddressAndPortDependent
+			if rsp3.IP == rsp2.IP && rsp3.Port == rsp2.Port {
+				behavior.Mapping = NATAddressDependent
+			}
+		}
+	}
+	gLog.Printf(LvDEBUG, "local port:%d  nat port:%d %s", localPort, rsp1.Port, natBehaviorString(behavior))
+	return rsp1.IP, behavior, nil
+}
+
+func getNATType(host string, udp1 int, udp2 int) (publicIP string, NATType int, behavior NATBehavior, err error) {
+	// the random local port may be used by other.
+	localPort := int(rand.Uint32()%15000 + 50000)
+	publicIP, behavior, err = natBehaviorTest(host, udp1, udp2, localPort)
+	if err != nil {
+		return "", 0, behavior, err
 	}
 	natType := NATSymmetric
-	if port1 == port2 {
+	if behavior.Mapping == NATEndpointIndependent {
 		natType = NATCone
 	}
-	return ip1, natType, nil
+	return publicIP, natType, behavior, nil
+}
+
+// the idle intervals of the mapping lifetime test
+var natLifetimeIntervals = []time.Duration{time.Second * 20, time.Second * 40, time.Second * 80, time.Second * 160, time.Second * 320}
+
+// natLifetimeTest returns the longest interval an idle udp mapping survived, in seconds. the
+// server echoes to the mapped port from the address it was created for, through any filtering.
+// it returns half the shortest interval if none survived.
+func natLifetimeTest(host string, port int) int {
+	dst, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		return 0
+	}
+	lifetime := int(natLifetimeIntervals[0].Seconds() / 2)
+	for _, interval := range natLifetimeIntervals {
+		alive, err := natMappingAlive(dst, interval)
+		if err != nil {
+			gLog.Println(LvDEBUG, "natLifetimeTest error:", err)
+			return 0
+		}
+		if !alive {
+			break
+		}
+		lifetime = int(interval.Seconds())
+	}
+	gLog.Printf(LvINFO, "NAT mapping lifetime:%ds", lifetime)
+	return lifetime
+}
+
+func natMappingAlive(dst *net.UDPAddr, idle time.Duration) (bool, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	rsp, err := natProbe(conn, dst, NatDetectReq{})
+	if err != nil {
+		return false, err
+	}
+	time.Sleep(idle)
+	probeConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false, err
+	}
+	defer probeConn.Close()
+	msg, _ := newMessage(MsgNATDetect, MsgPublicIP, NatDetectReq{EchoPort: rsp.Port})
+	buffer := make([]byte, 1024)
+	for i := 0; i < NatProbeRetry; i++ {
+		if _, err = probeConn.WriteToUDP(msg, dst); err != nil {
+			return false, err
+		}
+		conn.SetReadDeadline(time.Now().Add(NatProbeTimeout))
+		for {
+			n, _, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			if n >= openP2PHeaderSize && binary.LittleEndian.Uint16(buffer[4:]) == MsgNATDetect && binary.LittleEndian.Uint16(buffer[6:]) == MsgPublicIP {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+var natBehaviorNames = map[int]string{
+	NATBehaviorUnknown:         "unknown",
+	NATEndpointIndependent:     "endpoint-independent",
+	NATAddressDependent:        "address-dependent",
+	NATAddressAndPortDependent: "address-and-port-dependent",
+}
+
+func natBehaviorString(b NATBehavior) string {
+	hairpin := map[int]string{NATHairpinUnknown: "unknown", NATHairpinYes: "yes", NATHairpinNo: "no"}[b.Hairpin]
+	return fmt.Sprintf("mapping:%s filtering:%s hairpin:%s lifetime:%ds", natBehaviorNames[b.Mapping], natBehaviorNames[b.Filtering], hairpin, b.Lifetime)
+}
+
+// natPunchReason explains why hole punching can't work between the two NATs, empty if it may work.
+// the unknown behavior of old nodes or servers never blocks punching. a port allocation pattern
+// doesn't change it, the predicted ports are sprayed from the fixed port of an endpoint-independent
+// mapping, two per-destination mappings have none.
+func natPunchReason(local NATBehavior, peer NATBehavior, sameNAT bool) string {
+	if sameNAT && local.Hairpin == NATHairpinNo {
+		return "both nodes are behind the same NAT without hairpinning, only the intranet connection works"
+	}
+	if local.Mapping > NATEndpointIndependent && peer.Mapping > NATEndpointIndependent {
+		return fmt.Sprintf("both NATs map a new port for each destination (local %s, peer %s mapping), the punching ports can't be known, port prediction needs one endpoint-independent NAT",
+			natBehaviorNames[local.Mapping], natBehaviorNames[peer.Mapping])
+	}
+	return ""
+}
+
+// natPortPattern maps several new sockets in a row to learn how the symmetric nat allocates ports.
+// it returns the last mapped port and the stride, delta 0 if no pattern found.
+func natPortPattern(host string, port int) (lastPort int, delta int) {
+	ports := []int{}
+	for i := 0; i < NatPortProbeNum; i++ {
+		_, natPort, err := natTest(host, port, 0)
+		if err != nil {
+			return 0, 0
+		}
+		ports = append(ports, natPort)
+	}
+	delta = portDelta(ports)
+	gLog.Printf(LvDEBUG, "nat port allocation %v delta:%d", ports, delta)
+	return ports[len(ports)-1], delta
+}
+
+const maxPortDelta = 100 // larger strides are random allocation
+
+// portDelta returns the stride of sequential ports, other sessions behind the nat may take one
+// port between the probes. 0 if the ports look random.
+func portDelta(ports []int) int {
+	count := map[int]int{}
+	for i := 1; i < len(ports); i++ {
+		d := ports[i] - ports[i-1]
+		if d != 0 && d >= -maxPortDelta && d <= maxPortDelta {
+			count[d]++
+		}
+	}
+	for d, n := range count {
+		if n >= len(ports)-2 && n > 1 {
+			return d
+		}
+	}
+	return 0
+}
+
+// predictPorts returns num ports the nat will allocate after lastPort, in order
+func predictPorts(lastPort int, delta int, num int) []int {
+	if delta == 0 {
+		return nil
+	}
+	ports := make([]int, 0, num)
+	for port := lastPort + delta; len(ports) < num && port > 1024 && port <= 65535; port += delta {
+		ports = append(ports, port)
+	}
+	return ports
 }
 
 func publicIPTest(publicIP string, echoPort int) (hasPublicIP int, hasUPNPorNATPMP int) {
@@ -121,30 +388,30 @@ func publicIPTest(publicIP string, echoPort int) (hasPublicIP int, hasUPNPorNATP
 		return
 	}
 	defer echoConn.Close()
-	// testing for public ip
-	for i := 0; i < 2; i++ {
-		if i == 1 {
-			// test upnp or nat-pmp
-			gLog.Println(LvDEBUG, "upnp test start")
-			nat, err := Discover()
+	// testing for public ip, then the port mapping of upnp, nat-pmp and pcp in order
+	for i := 0; i <= len(natKinds); i++ {
+		var nat NAT
+		if i > 0 {
+			name := natKinds[i-1].name
+			gLog.Println(LvDEBUG, name, "test start")
+			nat, err = natKinds[i-1].discover()
 			if err != nil || nat == nil {
-				gLog.Println(LvDEBUG, "could not perform UPNP discover:", err)
-				break
+				gLog.Printf(LvDEBUG, "could not perform %s discover:%v", name, err)
+				continue
 			}
 			ext, err := nat.GetExternalAddress()
 			if err != nil {
-				gLog.Println(LvDEBUG, "could not perform UPNP external address:", err)
-				break
+				gLog.Printf(LvDEBUG, "could not perform %s external address:%s", name, err)
+				continue
 			}
 			gLog.Println(LvINFO, "PublicIP:", ext)
 
 			externalPort, err := nat.AddPortMapping("udp", echoPort, echoPort, "openp2p", 30) // 30 seconds fot upnp testing
-			if err != nil {
-				gLog.Println(LvDEBUG, "could not add udp UPNP port mapping", externalPort)
-				break
-			} else {
-				nat.AddPortMapping("tcp", echoPort, echoPort, "openp2p", 604800) // 7 days for tcp connection
+			if err != nil || externalPort != echoPort {
+				gLog.Printf(LvDEBUG, "could not add udp %s port mapping %d", name, externalPort)
+				continue
 			}
+			defer nat.DeletePortMapping("udp", echoPort, echoPort)
 		}
 		gLog.Printf(LvDEBUG, "public ip test start %s:%d", publicIP, echoPort)
 		conn, err := net.ListenUDP("udp", nil)
@@ -179,8 +446,13 @@ func publicIPTest(publicIP string, echoPort int) (hasPublicIP int, hasUPNPorNATP
 			continue
 		}
 		if natRsp.Port == echoPort {
-			if i == 1 {
-				gLog.Println(LvDEBUG, "UPNP or NAT-PMP:YES")
+			if i > 0 {
+				// the tcp mapping is renewed until shutdown
+				if err = addPortMapping(nat, "tcp", echoPort, portMappingLifetime); err != nil {
+					gLog.Printf(LvDEBUG, "could not add tcp %s port mapping:%s", natKinds[i-1].name, err)
+					continue
+				}
+				gLog.Printf(LvDEBUG, "%s:YES", natKinds[i-1].name)
 				hasUPNPorNATPMP = 1
 			} else {
 				gLog.Println(LvDEBUG, "public ip:YES")
@@ -191,3 +463,15 @@ func publicIPTest(publicIP string, echoPort int) (hasPublicIP int, hasUPNPorNATP
 	}
 	return
 }
+
+// setNATInfo reports the nat behavior of both nodes and why they can't punch, gConf.mtx must be held
+func (info *AppInfo) setNATInfo(config *AppConfig) {
+	local, peer := gConf.Network.natBehavior, config.peerNatBehavior
+	if local.Mapping != NATBehaviorUnknown {
+		info.NatBehavior = &local
+	}
+	if peer.Mapping != NATBehaviorUnknown {
+		info.PeerNatBehavior = &peer
+	}
+	info.NatDetail = natPunchReason(local, peer, config.peerIP != "" && config.peerIP == gConf.Network.publicIP)
+}
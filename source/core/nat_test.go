@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// natServer answers MsgNAT like natdetect on 127.0.0.1 and 127.0.0.2, noChange drops the
+// change requests as a strict firewall, legacy answers as an old server
+func natServer(t *testing.T, noChange bool, legacy bool) []int {
+	ports := []int{}
+	conns := map[[2]int]*net.UDPConn{}
+	for i, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)} {
+		for j := 0; j < 2; j++ {
+			port := 0
+			if i == 1 {
+				port = ports[j]
+			}
+			conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				t.Skip("alternate loopback ip unavailable:", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			if i == 0 {
+				ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+			}
+			conns[[2]int{i, j}] = conn
+		}
+	}
+	for key, conn := range conns {
+		go func(key [2]int, conn *net.UDPConn) {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				req := NatDetectReq{}
+				json.Unmarshal(buf[openP2PHeaderSize:n], &req)
+				subType := binary.LittleEndian.Uint16(buf[6:])
+				rsp := NatDetectRsp{IP: addr.IP.String(), Port: addr.Port}
+				if subType == MsgPublicIP {
+					msg, _ := newMessage(MsgNATDetect, MsgPublicIP, rsp)
+					conn.WriteToUDP(msg, &net.UDPAddr{IP: addr.IP, Port: req.EchoPort})
+					continue
+				}
+				if !legacy {
+					rsp.OtherIP, rsp.OtherPort = "127.0.0.2", ports[key[1]^1]
+				}
+				other := key
+				if req.ChangeIP {
+					other[0] ^= 1
+				}
+				if req.ChangePort {
+					other[1] ^= 1
+				}
+				if other != key && (noChange || legacy) {
+					continue
+				}
+				msg, _ := newMessage(MsgNATDetect, MsgNAT, rsp)
+				conns[other].WriteToUDP(msg, addr)
+			}
+		}(key, conn)
+	}
+	return ports
+}
+
+func TestNATBehavior(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	tests := []struct {
+		name      string
+		noChange  bool
+		legacy    bool
+		filtering int
+	}{
+		{"rfc5780", false, false, NATEndpointIndependent},
+		{"strict firewall", true, false, NATAddressAndPortDependent},
+		{"old server", false, true, NATBehaviorUnknown},
+	}
+	for _, tt := range tests {
+		ports := natServer(t, tt.noChange, tt.legacy)
+		ip, b, err := natBehaviorTest("127.0.0.1", ports[0], ports[1], 0)
+		if err != nil {
+			t.Fatalf("%s error:%s", tt.name, err)
+		}
+		if ip != "127.0.0.1" || b.Mapping != NATEndpointIndependent || b.Filtering != tt.filtering || b.Hairpin != NATHairpinYes {
+			t.Errorf("%s got %s %s", tt.name, ip, natBehaviorString(b))
+		}
+	}
+
+	ports := natServer(t, false, false)
+	intervals := natLifetimeIntervals
+	natLifetimeIntervals = []time.Duration{time.Second, time.Second * 2}
+	defer func() { natLifetimeIntervals = intervals }()
+	if lifetime := natLifetimeTest("127.0.0.1", ports[0]); lifetime != 2 {
+		t.Errorf("lifetime got %d", lifetime)
+	}
+}
+
+func TestNATPunchReason(t *testing.T) {
+	cone := NATBehavior{Mapping: NATEndpointIndependent, Filtering: NATAddressAndPortDependent, Hairpin: NATHairpinNo}
+	symmetric := NATBehavior{Mapping: NATAddressAndPortDependent, Filtering: NATAddressAndPortDependent}
+	tests := []struct {
+		local, peer NATBehavior
+		sameNAT     bool
+		punchable   bool
+	}{
+		{cone, symmetric, false, true},
+		{symmetric, NATBehavior{Mapping: NATAddressDependent}, false, false},
+		{symmetric, NATBehavior{}, false, true}, // old peer
+		{cone, cone, true, false},
+		{NATBehavior{Mapping: NATEndpointIndependent, Hairpin: NATHairpinYes}, cone, true, true},
+	}
+	for i, tt := range tests {
+		if reason := natPunchReason(tt.local, tt.peer, tt.sameNAT); (reason == "") != tt.punchable {
+			t.Errorf("%d got %q", i, reason)
+		}
+	}
+}
+
+func TestMappingNATInfo(t *testing.T) {
+	symmetric := NATBehavior{Mapping: NATAddressAndPortDependent, Filtering: NATAddressAndPortDependent}
+	oldApps, oldBehavior := gConf.Apps, gConf.Network.natBehavior
+	defer func() { gConf.Apps, gConf.Network.natBehavior = oldApps, oldBehavior }()
+	gConf.Apps = []*AppConfig{{AppName: "app1", SrcPort: 23389, PeerNode: "peer1", peerNatBehavior: symmetric}}
+	gConf.Network.natBehavior = symmetric
+
+	w := httptest.NewRecorder()
+	handleMappings(w, httptest.NewRequest(http.MethodGet, "/api/mappings", nil))
+	rsp := struct{ Data []mappingInfo }{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil || len(rsp.Data) != 1 {
+		t.Fatalf("mappings error:%v %s", err, w.Body.String())
+	}
+	m := rsp.Data[0]
+	if m.AppName != "app1" || m.NatBehavior == nil || m.PeerNatBehavior == nil || m.PeerNatBehavior.Mapping != NATAddressAndPortDependent || m.NatDetail == "" {
+		t.Errorf("nat info missing:%s", w.Body.String())
+	}
+}
+
+func TestPortPrediction(t *testing.T) {
+	tests := []struct {
+		ports []int
+		delta int
+	}{
+		{[]int{40000, 40001, 40002, 40003, 40004}, 1},
+		{[]int{40000, 40002, 40005, 40006, 40008}, 0},
+		{[]int{40000, 40001, 40003, 40004, 40005}, 1}, // another session took a port
+		{[]int{50010, 50008, 50006, 50004, 50002}, -2},
+		{[]int{12345, 54321, 23456, 65432, 34567}, 0},
+		{[]int{40000, 40000, 40000, 40000, 40000}, 0},
+	}
+	for _, tt := range tests {
+		if d := portDelta(tt.ports); d != tt.delta {
+			t.Errorf("%v delta got %d want %d", tt.ports, d, tt.delta)
+		}
+	}
+	ports := predictPorts(40004, 2, SymmetricHandshakeNum)
+	if len(ports) != SymmetricHandshakeNum || ports[0] != 40006 || ports[1] != 40008 {
+		t.Errorf("predict ports error:%v", ports[:2])
+	}
+	if ports = predictPorts(65530, 3, 10); len(ports) != 1 || ports[0] != 65533 {
+		t.Errorf("predict ports over 65535:%v", ports)
+	}
+	if predictPorts(40000, 0, 10) != nil {
+		t.Errorf("predicted without pattern")
+	}
+}
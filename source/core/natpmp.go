@@ -0,0 +1,340 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) and PCP (RFC 6887) clients of the NAT interface, for routers without UPnP.
+// both talk to the default gateway on udp 5351.
+
+const (
+	natPMPPort         = 5351
+	natPMPRetry        = 3
+	natPMPFirstTimeout = time.Millisecond * 250 // doubled each retry
+	natPMPOpUDP        = 1
+	natPMPOpTCP        = 2
+)
+
+// defaultGateway reads the linux route table, other systems guess the .1 of the lan ip
+func defaultGateway() (net.IP, error) {
+	if data, err := os.ReadFile("/proc/net/route"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			f := strings.Fields(line)
+			if len(f) < 3 || f[1] != "00000000" {
+				continue
+			}
+			if gw, err := strconv.ParseUint(f[2], 16, 32); err == nil && gw != 0 {
+				ip := make(net.IP, net.IPv4len)
+				binary.LittleEndian.PutUint32(ip, uint32(gw))
+				return ip, nil
+			}
+		}
+	}
+	ip := net.ParseIP(localIPv4()).To4()
+	if ip == nil {
+		return nil, errors.New("no lan ipv4")
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], 1), nil
+}
+
+// natPMPRequest sends msg to the gateway and retransmits until a valid response
+func natPMPRequest(gateway *net.UDPAddr, msg []byte, valid func([]byte) error) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1100)
+	timeout := natPMPFirstTimeout
+	for i := 0; i < natPMPRetry; i++ {
+		if _, err = conn.Write(msg); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err // port unreachable, no server
+			}
+			if err = valid(buf[:n]); err == errNATPMPIgnore {
+				continue
+			}
+			return buf[:n], err
+		}
+		timeout *= 2
+	}
+	return nil, ErrPortMappingTimeout
+}
+
+var errNATPMPIgnore = errors.New("not the response")
+
+// natEpoch is the seconds since the gateway started in NAT-PMP and PCP responses, it goes back
+// when the gateway reboots and loses the mappings
+type natEpoch struct {
+	epoch    uint32
+	at       time.Time
+	rebooted bool
+}
+
+func (e *natEpoch) update(epoch uint32) {
+	if !e.at.IsZero() {
+		expected := uint64(e.epoch) + uint64(time.Since(e.at).Seconds())*7/8 // clocks may drift 1/8
+		if uint64(epoch)+2 < expected {
+			e.rebooted = true
+		}
+	}
+	e.epoch, e.at = epoch, time.Now()
+}
+
+// natRebootDetector is implemented by NAT-PMP and PCP, it queries the gateway and tells whether
+// it rebooted since the last query
+type natRebootDetector interface {
+	rebooted() (bool, error)
+}
+
+type natPMP struct {
+	gateway *net.UDPAddr
+	mtx     sync.Mutex
+	epoch   natEpoch
+}
+
+func discoverNATPMP() (NAT, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	n := &natPMP{gateway: &net.UDPAddr{IP: gw, Port: natPMPPort}}
+	if _, err = n.GetExternalAddress(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *natPMP) request(msg []byte, rspLen int) ([]byte, error) {
+	rsp, err := natPMPRequest(n.gateway, msg, func(rsp []byte) error {
+		if len(rsp) < 4 || rsp[0] != 0 || rsp[1] != msg[1]|0x80 {
+			return errNATPMPIgnore
+		}
+		if code := binary.BigEndian.Uint16(rsp[2:]); code != 0 {
+			return fmt.Errorf("nat-pmp result code %d", code)
+		}
+		if len(rsp) < rspLen {
+			return errNATPMPIgnore
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.mtx.Lock()
+	n.epoch.update(binary.BigEndian.Uint32(rsp[4:]))
+	n.mtx.Unlock()
+	return rsp, nil
+}
+
+func (n *natPMP) rebooted() (bool, error) {
+	if _, err := n.GetExternalAddress(); err != nil {
+		return false, err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	rebooted := n.epoch.rebooted
+	n.epoch.rebooted = false
+	return rebooted, nil
+}
+
+func (n *natPMP) GetExternalAddress() (addr net.IP, err error) {
+	rsp, err := n.request([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IPv4(rsp[8], rsp[9], rsp[10], rsp[11]), nil
+}
+
+func (n *natPMP) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+	msg := make([]byte, 12)
+	msg[1] = natPMPOpUDP
+	if protocol == "tcp" {
+		msg[1] = natPMPOpTCP
+	}
+	binary.BigEndian.PutUint16(msg[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(msg[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(msg[8:], uint32(timeout))
+	rsp, err := n.request(msg, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(rsp[10:])), nil
+}
+
+// DeletePortMapping requests lifetime 0, the external port is ignored
+func (n *natPMP) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
+	_, err = n.AddPortMapping(protocol, 0, internalPort, "", 0)
+	return err
+}
+
+const (
+	pcpVersion    = 2
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+	pcpHeaderLen  = 24
+	pcpMapLen     = 36
+)
+
+type pcpNAT struct {
+	gateway    *net.UDPAddr
+	localIP    net.IP
+	mtx        sync.Mutex
+	nonces     map[string][]byte // renewals and deletion must send the nonce of the mapping
+	externalIP net.IP
+	epoch      natEpoch
+}
+
+func discoverPCP() (NAT, error) {
+	gw, err := defaultGateway()
+	if err != nil {
+		return nil, err
+	}
+	n := &pcpNAT{gateway: &net.UDPAddr{IP: gw, Port: natPMPPort}, localIP: net.ParseIP(localIPv4())}
+	if _, err = n.GetExternalAddress(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *pcpNAT) nonce(protocol string, internalPort int) []byte {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.nonces == nil {
+		n.nonces = map[string][]byte{}
+	}
+	key := fmt.Sprintf("%s:%d", protocol, internalPort)
+	if n.nonces[key] == nil {
+		nonce := make([]byte, 12)
+		rand.Read(nonce)
+		n.nonces[key] = nonce
+	}
+	return n.nonces[key]
+}
+
+func (n *pcpNAT) setNonce(protocol string, internalPort int, nonce []byte) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.nonces == nil {
+		n.nonces = map[string][]byte{}
+	}
+	n.nonces[fmt.Sprintf("%s:%d", protocol, internalPort)] = nonce
+}
+
+func (n *pcpNAT) request(msg []byte, rspLen int, nonce []byte) ([]byte, error) {
+	rsp, err := natPMPRequest(n.gateway, msg, func(rsp []byte) error {
+		if len(rsp) < 4 {
+			return errNATPMPIgnore
+		}
+		if rsp[0] != pcpVersion {
+			return fmt.Errorf("pcp unsupported version %d", rsp[0])
+		}
+		if rsp[1] != msg[1]|0x80 {
+			return errNATPMPIgnore
+		}
+		if rsp[3] != 0 {
+			return fmt.Errorf("pcp result code %d", rsp[3])
+		}
+		if len(rsp) < rspLen || (nonce != nil && string(rsp[24:36]) != string(nonce)) {
+			return errNATPMPIgnore
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	n.mtx.Lock()
+	n.epoch.update(binary.BigEndian.Uint32(rsp[8:]))
+	n.mtx.Unlock()
+	return rsp, nil
+}
+
+func (n *pcpNAT) rebooted() (bool, error) {
+	msg := make([]byte, pcpHeaderLen)
+	msg[0], msg[1] = pcpVersion, pcpOpAnnounce
+	copy(msg[8:24], n.localIP.To16())
+	if _, err := n.request(msg, pcpHeaderLen, nil); err != nil {
+		return false, err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	rebooted := n.epoch.rebooted
+	n.epoch.rebooted = false
+	return rebooted, nil
+}
+
+// mapRequest sends the MAP opcode, lifetime 0 deletes the mapping
+func (n *pcpNAT) mapRequest(protocol string, externalPort, internalPort int, lifetime int) (int, error) {
+	msg := make([]byte, pcpHeaderLen+pcpMapLen)
+	msg[0], msg[1] = pcpVersion, pcpOpMap
+	binary.BigEndian.PutUint32(msg[4:], uint32(lifetime))
+	copy(msg[8:24], n.localIP.To16())
+	nonce := n.nonce(protocol, internalPort)
+	copy(msg[24:36], nonce)
+	msg[36] = 17
+	if protocol == "tcp" {
+		msg[36] = 6
+	}
+	binary.BigEndian.PutUint16(msg[40:], uint16(internalPort))
+	binary.BigEndian.PutUint16(msg[42:], uint16(externalPort))
+	copy(msg[44:60], net.IPv4zero.To16())
+	rsp, err := n.request(msg, pcpHeaderLen+pcpMapLen, nonce)
+	if err != nil {
+		return 0, err
+	}
+	if lifetime > 0 {
+		n.mtx.Lock()
+		n.externalIP = net.IP(append([]byte{}, rsp[44:60]...))
+		n.mtx.Unlock()
+	}
+	return int(binary.BigEndian.Uint16(rsp[42:])), nil
+}
+
+// GetExternalAddress maps a short lived port to learn it, PCP has no opcode for the address
+func (n *pcpNAT) GetExternalAddress() (addr net.IP, err error) {
+	n.mtx.Lock()
+	addr = n.externalIP
+	n.mtx.Unlock()
+	if addr != nil {
+		return addr, nil
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if _, err = n.mapRequest("udp", port, port, 30); err != nil {
+		return nil, err
+	}
+	n.mapRequest("udp", port, port, 0)
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	return n.externalIP, nil
+}
+
+func (n *pcpNAT) AddPortMapping(protocol string, externalPort, internalPort int, description string, timeout int) (mappedExternalPort int, err error) {
+	return n.mapRequest(protocol, externalPort, internalPort, timeout)
+}
+
+func (n *pcpNAT) DeletePortMapping(protocol string, externalPort, internalPort int) (err error) {
+	_, err = n.mapRequest(protocol, 0, internalPort, 0)
+	return err
+}
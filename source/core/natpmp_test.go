@@ -0,0 +1,201 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natPMPGateway answers NAT-PMP and PCP requests like a router, it records the leases by port
+// and loses them on reboot
+type natPMPGateway struct {
+	addr   *net.UDPAddr
+	mtx    sync.Mutex
+	leases map[int]int
+	nonces map[int]string
+	start  time.Time
+}
+
+func newNATPMPGateway(t *testing.T) *natPMPGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	g := &natPMPGateway{addr: conn.LocalAddr().(*net.UDPAddr), leases: map[int]int{}, nonces: map[int]string{}, start: time.Now().Add(-time.Hour)}
+	go func() {
+		buf := make([]byte, 1100)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			var rsp []byte
+			g.mtx.Lock()
+			epoch := uint32(time.Since(g.start).Seconds())
+			switch {
+			case req[0] == 0 && req[1] == 0: // nat-pmp external address
+				rsp = []byte{0, 128, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+				binary.BigEndian.PutUint32(rsp[4:], epoch)
+			case req[0] == 0: // nat-pmp map
+				rsp = make([]byte, 16)
+				rsp[1] = req[1] | 0x80
+				binary.BigEndian.PutUint32(rsp[4:], epoch)
+				copy(rsp[8:], req[4:6])
+				copy(rsp[10:], req[6:8])
+				copy(rsp[12:], req[8:12])
+				g.leases[int(binary.BigEndian.Uint16(req[4:]))] = int(binary.BigEndian.Uint32(req[8:]))
+			case req[0] == pcpVersion && req[1] == pcpOpAnnounce:
+				rsp = make([]byte, pcpHeaderLen)
+				rsp[0], rsp[1] = pcpVersion, req[1]|0x80
+				binary.BigEndian.PutUint32(rsp[8:], epoch)
+			case req[0] == pcpVersion:
+				rsp = make([]byte, pcpHeaderLen+pcpMapLen)
+				rsp[0], rsp[1] = pcpVersion, req[1]|0x80
+				copy(rsp[4:8], req[4:8])
+				binary.BigEndian.PutUint32(rsp[8:], epoch)
+				copy(rsp[24:], req[24:42])
+				copy(rsp[42:44], req[40:42])
+				copy(rsp[44:], net.IPv4(1, 2, 3, 4).To16())
+				port := int(binary.BigEndian.Uint16(req[40:]))
+				if nonce, ok := g.nonces[port]; ok && g.leases[port] != 0 && nonce != string(req[24:36]) {
+					rsp[3] = 2 // NOT_AUTHORIZED, another client
+					break
+				}
+				g.nonces[port] = string(req[24:36])
+				g.leases[port] = int(binary.BigEndian.Uint32(req[4:]))
+			}
+			g.mtx.Unlock()
+			conn.WriteToUDP(rsp, addr)
+		}
+	}()
+	return g
+}
+
+func (g *natPMPGateway) lease(port int) int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.leases[port]
+}
+
+func (g *natPMPGateway) reboot() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.leases = map[int]int{}
+	g.start = time.Now()
+}
+
+// chdirTemp runs the test in a temporary dir, the port mappings are saved in the working dir
+func chdirTemp(t *testing.T) {
+	wd, _ := os.Getwd()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestNATPMP(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	chdirTemp(t)
+	gateway := newNATPMPGateway(t)
+	nats := []NAT{
+		&natPMP{gateway: gateway.addr},
+		&pcpNAT{gateway: gateway.addr, localIP: net.IPv4(127, 0, 0, 1)},
+	}
+	for i, nat := range nats {
+		ext, err := nat.GetExternalAddress()
+		if err != nil || !ext.Equal(net.IPv4(1, 2, 3, 4)) {
+			t.Fatalf("%d external address %s error:%v", i, ext, err)
+		}
+		port := 40000 + i
+		if err = addPortMapping(nat, "tcp", port, 2); err != nil {
+			t.Fatalf("%d add port mapping error:%s", i, err)
+		}
+		if gateway.lease(port) != 2 {
+			t.Errorf("%d lease %d", i, gateway.lease(port))
+		}
+	}
+	// renewed at half lifetime, deleted at shutdown
+	time.Sleep(time.Millisecond * 1500)
+	deletePortMappings()
+	for i := range nats {
+		if gateway.lease(40000+i) != 0 {
+			t.Errorf("%d mapping not deleted", i)
+		}
+	}
+	if len(portMappings) != 0 {
+		t.Errorf("port mappings left %d", len(portMappings))
+	}
+	if _, err := os.Stat(portMappingFile); err == nil {
+		t.Errorf("%s not removed", portMappingFile)
+	}
+
+	// no gateway
+	closed, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	closed.Close()
+	if _, err := (&natPMP{gateway: closed.LocalAddr().(*net.UDPAddr)}).GetExternalAddress(); err == nil {
+		t.Errorf("no gateway got external address")
+	}
+}
+
+func TestPortMappingReboot(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	chdirTemp(t)
+	gateway := newNATPMPGateway(t)
+	checkTime, kinds := portMappingCheckTime, natKinds
+	portMappingCheckTime = time.Millisecond * 100
+	natKinds = append(kinds[:0:0], kinds...)
+	natKinds[1].discover = func() (NAT, error) { return &natPMP{gateway: gateway.addr}, nil }
+	natKinds[2].discover = func() (NAT, error) {
+		return &pcpNAT{gateway: gateway.addr, localIP: net.IPv4(127, 0, 0, 1)}, nil
+	}
+	defer func() { portMappingCheckTime, natKinds = checkTime, kinds }()
+
+	for i, kind := range natKinds[1:] {
+		nat, _ := kind.discover()
+		nat.GetExternalAddress()
+		if err := addPortMapping(nat, "udp", 40010+i, portMappingLifetime); err != nil {
+			t.Fatalf("%s add port mapping error:%s", kind.name, err)
+		}
+	}
+	data, _ := os.ReadFile(portMappingFile)
+	states := []portMappingState{}
+	if json.Unmarshal(data, &states); len(states) != 2 {
+		t.Fatalf("saved port mappings %s", data)
+	}
+
+	// re-created long before half lifetime
+	gateway.reboot()
+	time.Sleep(time.Millisecond * 500)
+	for i := 0; i < 2; i++ {
+		if gateway.lease(40010+i) != portMappingLifetime {
+			t.Errorf("%d not re-created after reboot", i)
+		}
+	}
+
+	// crashed without deletion, the next run cleans up with the saved pcp nonce
+	portMappingMtx.Lock()
+	for key, m := range portMappings {
+		close(m.stop)
+		delete(portMappings, key)
+	}
+	portMappingMtx.Unlock()
+	cleanPortMappings()
+	for i := 0; i < 2; i++ {
+		if gateway.lease(40010+i) != 0 {
+			t.Errorf("%d stale mapping not deleted", i)
+		}
+	}
+	if _, err := os.Stat(portMappingFile); err == nil {
+		t.Errorf("%s not removed", portMappingFile)
+	}
+}
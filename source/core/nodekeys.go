@@ -0,0 +1,214 @@
+package core
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// sdwan node data is sealed with a key per node pair, agreed by a signed x25519
+// exchange through the memapp tunnel, direct or relay. the nonce is the seq only,
+// every exchange gets new keys, so it's 24 bytes per packet.
+
+const nodeCipherOverhead = 8 + aeadTagSize
+
+type nodeCipher struct {
+	send   cipher.AEAD
+	recv   cipher.AEAD
+	seq    atomic.Uint64 // aligned on 32-bit platforms
+	replay replayWindow
+}
+
+// one key per direction, the smaller node id sends with lo2hi
+func newNodeCipher(sessionKey []byte, localID uint64, peerID uint64) (*nodeCipher, error) {
+	lo2hi, err := newAESGCM(hkdfSHA256(sessionKey, nil, []byte("openp2p node lo2hi"), 32))
+	if err != nil {
+		return nil, err
+	}
+	hi2lo, err := newAESGCM(hkdfSHA256(sessionKey, nil, []byte("openp2p node hi2lo"), 32))
+	if err != nil {
+		return nil, err
+	}
+	if localID < peerID {
+		return &nodeCipher{send: lo2hi, recv: hi2lo}, nil
+	}
+	return &nodeCipher{send: hi2lo, recv: lo2hi}, nil
+}
+
+// seal returns seq|ciphertext|tag in a new buffer, it will be queued
+func (c *nodeCipher) seal(plain []byte) []byte {
+	out := make([]byte, 8, len(plain)+nodeCipherOverhead)
+	binary.LittleEndian.PutUint64(out, c.seq.Add(1))
+	nonce := make([]byte, aeadNonceSize)
+	copy(nonce[aeadNoncePrefixSize:], out)
+	return c.send.Seal(out, nonce, plain, nil)
+}
+
+// open returns the plain in a new buffer, in keeps untouched if failed
+func (c *nodeCipher) open(in []byte) ([]byte, error) {
+	if len(in) < nodeCipherOverhead {
+		return nil, ErrDecrypt
+	}
+	nonce := make([]byte, aeadNonceSize)
+	copy(nonce[aeadNoncePrefixSize:], in[:8])
+	plain, err := c.recv.Open(make([]byte, 0, len(in)-nodeCipherOverhead), nonce, in[8:], nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if !c.replay.check(binary.LittleEndian.Uint64(in[:8])) {
+		return nil, ErrReplay
+	}
+	return plain, nil
+}
+
+type nodeKey struct {
+	mtx  sync.Mutex
+	kex  keyExchange // pending exchange started by us
+	cur  *nodeCipher
+	prev *nodeCipher // the peer may still use it for a while after rekey
+}
+
+var nodeKeys sync.Map // peer node id -> *nodeKey
+
+func getNodeKey(peerID uint64) *nodeKey {
+	i, _ := nodeKeys.LoadOrStore(peerID, &nodeKey{})
+	return i.(*nodeKey)
+}
+
+// nil if no key with the peer, node data is sent in plain to old peers
+func findNodeCipher(peerID uint64) *nodeCipher {
+	i, ok := nodeKeys.Load(peerID)
+	if !ok {
+		return nil
+	}
+	nk := i.(*nodeKey)
+	nk.mtx.Lock()
+	defer nk.mtx.Unlock()
+	return nk.cur
+}
+
+// sealNodeData returns the data and message types to the peer, plain if no key
+func sealNodeData(peerID uint64, buff []byte) ([]byte, uint16, uint16) {
+	if c := findNodeCipher(peerID); c != nil {
+		return c.seal(buff), MsgNodeDataSealed, MsgRelayNodeDataSealed
+	}
+	return buff, MsgNodeData, MsgRelayNodeData
+}
+
+func (nk *nodeKey) set(c *nodeCipher) {
+	nk.mtx.Lock()
+	defer nk.mtx.Unlock()
+	nk.prev = nk.cur
+	nk.cur = c
+}
+
+func (nk *nodeKey) open(in []byte) ([]byte, error) {
+	nk.mtx.Lock()
+	cur, prev := nk.cur, nk.prev
+	nk.mtx.Unlock()
+	if cur == nil {
+		return nil, ErrNoSessionKey
+	}
+	plain, err := cur.open(in)
+	if err == ErrDecrypt && prev != nil {
+		return prev.open(in)
+	}
+	return plain, err
+}
+
+func nodeKeyLabel(node1 string, node2 string) string {
+	if NodeNameToID(node1) > NodeNameToID(node2) {
+		node1, node2 = node2, node1
+	}
+	return fmt.Sprintf("openp2p node %s %s", node1, node2)
+}
+
+// memapp starts the node key exchange after its tunnel is ready
+func (app *p2pApp) startNodeKeyExchange() {
+	t := app.Tunnel()
+	if t == nil {
+		return
+	}
+	nk := getNodeKey(NodeNameToID(app.config.PeerNode))
+	pub, err := nk.kex.public()
+	if err != nil {
+		gLog.Printf(LvERROR, "node key exchange with %s error:%s", app.config.LogPeerNode(), err)
+		return
+	}
+	req := newKeyExchangeMsg(nodeKeyLabel(gConf.Network.Node, app.config.PeerNode), pub)
+	rtid := uint64(0)
+	if !app.isDirect() {
+		rtid = app.rtid
+		req.RelayTunnelID = t.id
+	}
+	t.WriteMessage(rtid, MsgP2P, MsgNodeKeyExchange, &req)
+}
+
+// handleNodeKeyExchange answers with a new key. if both sides start at the same
+// time, the larger node id ignores the peer's and waits for the ack of its own.
+func (t *P2PTunnel) handleNodeKeyExchange(req *KeyExchange) {
+	peerID := NodeNameToID(req.Node)
+	label := nodeKeyLabel(gConf.Network.Node, req.Node)
+	if err := verifyKeyExchange(req, req.Node, label, peerIdentity(peerID)); err != nil {
+		gLog.Printf(LvERROR, "node key exchange from %s error:%s", req.Node, err)
+		return
+	}
+	nk := getNodeKey(peerID)
+	if nk.kex.pending() {
+		if gConf.nodeID() > peerID {
+			return
+		}
+		nk.kex.abort()
+	}
+	kex := keyExchange{}
+	pub, err := kex.public()
+	if err == nil {
+		err = kex.complete(req.Pub, label)
+	}
+	var c *nodeCipher
+	if err == nil {
+		c, err = newNodeCipher(kex.sessionKey(), gConf.nodeID(), peerID)
+	}
+	if err != nil {
+		gLog.Printf(LvERROR, "node key exchange from %s error:%s", req.Node, err)
+		return
+	}
+	nk.set(c)
+	gLog.Printf(LvDEBUG, "node key with %s ready", req.Node)
+	rsp := newKeyExchangeMsg(label, pub)
+	t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgNodeKeyExchangeAck, &rsp)
+}
+
+func (t *P2PTunnel) handleNodeKeyExchangeAck(rsp *KeyExchange) {
+	peerID := NodeNameToID(rsp.Node)
+	label := nodeKeyLabel(gConf.Network.Node, rsp.Node)
+	nk := getNodeKey(peerID)
+	err := verifyKeyExchange(rsp, rsp.Node, label, peerIdentity(peerID))
+	if err == nil {
+		err = nk.kex.complete(rsp.Pub, label)
+	}
+	var c *nodeCipher
+	if err == nil {
+		c, err = newNodeCipher(nk.kex.sessionKey(), gConf.nodeID(), peerID)
+	}
+	if err != nil {
+		gLog.Printf(LvERROR, "node key exchange with %s error:%s", rsp.Node, err)
+		return
+	}
+	nk.set(c)
+	gLog.Printf(LvDEBUG, "node key with %s ready", rsp.Node)
+}
+
+// identity published by server, known if we have an app to the peer
+func peerIdentity(peerID uint64) string {
+	if GNetwork == nil {
+		return ""
+	}
+	i, ok := GNetwork.apps.Load(peerID)
+	if !ok {
+		return ""
+	}
+	return i.(*p2pApp).config.peerIdentity
+}
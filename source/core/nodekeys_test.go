@@ -0,0 +1,53 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNodeCipher(t *testing.T) {
+	key := hkdfSHA256([]byte("secret"), nil, []byte("test"), 32)
+	a, _ := newNodeCipher(key, 1, 2)
+	b, _ := newNodeCipher(key, 2, 1)
+	plain := []byte("sdwan node data")
+	sealed := a.seal(plain)
+	if len(sealed) != len(plain)+nodeCipherOverhead {
+		t.Errorf("sealed length error:%d", len(sealed))
+	}
+	if out, err := b.open(sealed); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("open error:%v", err)
+	}
+	if _, err := b.open(sealed); err != ErrReplay {
+		t.Errorf("replay not detected:%v", err)
+	}
+	if _, err := a.open(a.seal(plain)); err != ErrDecrypt {
+		t.Errorf("own packet opened:%v", err)
+	}
+	if out, err := a.open(b.seal(plain)); err != nil || !bytes.Equal(out, plain) {
+		t.Errorf("open reverse error:%v", err)
+	}
+}
+
+func TestNodeKeyRekey(t *testing.T) {
+	nk := nodeKey{}
+	if _, err := nk.open(make([]byte, 64)); err != ErrNoSessionKey {
+		t.Errorf("open without key error:%v", err)
+	}
+	old := hkdfSHA256([]byte("old"), nil, []byte("test"), 32)
+	oldSend, _ := newNodeCipher(old, 1, 2)
+	oldRecv, _ := newNodeCipher(old, 2, 1)
+	nk.set(oldRecv)
+	key := hkdfSHA256([]byte("new"), nil, []byte("test"), 32)
+	send, _ := newNodeCipher(key, 1, 2)
+	recv, _ := newNodeCipher(key, 2, 1)
+	nk.set(recv)
+	if _, err := nk.open(send.seal([]byte("new key"))); err != nil {
+		t.Errorf("open with new key error:%v", err)
+	}
+	if _, err := nk.open(oldSend.seal([]byte("old key"))); err != nil {
+		t.Errorf("open with previous key error:%v", err)
+	}
+	if nodeKeyLabel("node1", "node2") != nodeKeyLabel("node2", "node1") {
+		t.Errorf("node key label not symmetric")
+	}
+}
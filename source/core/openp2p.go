@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -47,13 +49,13 @@ func Run() {
 		gLog.Println(LvINFO, "setRLimit error:", err)
 	}
 	GNetwork = P2PNetworkInstance()
+	StartMetrics(gConf.Network.MetricsAddr)
 	if ok := GNetwork.Connect(30000); !ok {
 		gLog.Println(LvERROR, "P2PNetwork login error")
 		return
 	}
 	// gLog.Println(LvINFO, "waiting for connection...")
-	forever := make(chan bool)
-	<-forever
+	waitStop()
 }
 
 // for Android app
@@ -104,8 +106,7 @@ func RunCmd(cmd string) {
 		gLog.Println(LvERROR, "P2PNetwork login error")
 		return
 	}
-	forever := make(chan bool)
-	<-forever
+	waitStop()
 }
 
 func GetToken(baseDir string) string {
@@ -115,5 +116,15 @@ func GetToken(baseDir string) string {
 }
 
 func Stop() {
+	deletePortMappings()
 	os.Exit(0)
 }
+
+// waitStop blocks until killed, the nat-pmp and pcp mappings are deleted on SIGINT or SIGTERM
+func waitStop() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	gLog.Println(LvINFO, "openp2p stop")
+	deletePortMappings()
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,11 +31,37 @@ type overlayConn struct {
 	connTCP     net.Conn
 	id          uint64
 	rtid        uint64
-	running     bool
+	running     atomic.Bool
 	isClient    bool
 	appID       uint64 // TODO: del
 	appKey      uint64 // TODO: del
 	appKeyBytes []byte // TODO: del
+	aead        *aeadCipher
+	connectRsp  chan *OverlayConnectRsp // client side, nil if peer is too old to answer
+	// the tunnel readLoop only queues the data, deliverLoop writes it to the destination
+	recvData  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	consumed  atomic.Int64 // cumulative credits of the delivered data
+	returned  int64        // consumed reported to peer
+	// credit based flow control of tcp overlays, both sides announce the window in connect req/rsp
+	flowControl  atomic.Bool
+	peerWindow   atomic.Int64
+	peerConsumed atomic.Int64
+	sentCost     int64 // run() only
+	creditUpdate chan struct{}
+	// seq numbered data, the overlay can migrate between the direct and relay tunnel
+	seqMode       atomic.Bool
+	sendMtx       sync.Mutex // guards tunnel, rtid and sendSeq
+	sendSeq       uint64
+	retransmitMtx sync.Mutex
+	unacked       []overlayPacket
+	recvMtx       sync.Mutex
+	recvSeq       atomic.Uint64
+	// multipath apps send on all tunnels of the app
+	multipath string            // guarded by sendMtx
+	paths     []*overlayPath    // home tunnel included, guarded by sendMtx
+	reorder   map[uint64][]byte // out of order data, guarded by recvMtx
 	// for udp
 	connUDP       *net.UDPConn
 	remoteAddr    net.Addr
@@ -46,12 +75,12 @@ func (oConn *overlayConn) run() {
 	oConn.lastReadUDPTs = time.Now()
 	buffer := make([]byte, ReadBuffLen+PaddingSize) // 16 bytes for padding
 	reuseBuff := buffer[:ReadBuffLen]
-	encryptData := make([]byte, ReadBuffLen+PaddingSize) // 16 bytes for padding
+	encryptData := make([]byte, ReadBuffLen+aeadOverhead) // nonce and tag, larger than cbc padding
 	tunnelHead := new(bytes.Buffer)
-	relayHead := new(bytes.Buffer)
-	binary.Write(relayHead, binary.LittleEndian, oConn.rtid)
 	binary.Write(tunnelHead, binary.LittleEndian, oConn.id)
-	for oConn.running && oConn.tunnel.isRuning() {
+	seqHead := make([]byte, overlayHeaderSize+8)
+	binary.LittleEndian.PutUint64(seqHead, oConn.id)
+	for oConn.running.Load() && oConn.tunnelReady() {
 		readBuff, dataLen, err := oConn.Read(reuseBuff)
 		if err != nil {
 			if ne, ok := err.(net.Error); ok && ne.Timeout() {
@@ -61,37 +90,166 @@ func (oConn *overlayConn) run() {
 			gLog.Printf(LvDEBUG, "overlayConn %d read error:%s,close it", oConn.id, err)
 			break
 		}
+		if oConn.flowControl.Load() && !oConn.waitCredit(overlayPacketCost(dataLen)) {
+			break
+		}
+		oConn.sendMtx.Lock()
+		subType := uint16(MsgOverlayData)
+		head := tunnelHead.Bytes()
+		if oConn.seqMode.Load() {
+			oConn.sendSeq++
+			binary.LittleEndian.PutUint64(seqHead[overlayHeaderSize:], oConn.sendSeq)
+			subType = MsgOverlayDataSeq
+			head = seqHead
+		}
 		payload := readBuff[:dataLen]
-		if oConn.appKey != 0 {
+		if oConn.aead != nil {
+			payload = oConn.aead.seal(encryptData, readBuff[:dataLen], head)
+		} else if oConn.appKey != 0 {
 			payload, _ = encryptBytes(oConn.appKeyBytes, encryptData, readBuff[:dataLen], dataLen)
 		}
-		writeBytes := append(tunnelHead.Bytes(), payload...)
+		writeBytes := append(head, payload...)
+		if subType == MsgOverlayDataSeq { // seqHead is full, writeBytes is a new buffer
+			oConn.retransmitMtx.Lock()
+			oConn.unacked = append(oConn.unacked, overlayPacket{oConn.sendSeq, writeBytes})
+			oConn.retransmitMtx.Unlock()
+		}
 		// TODO: app.write
-		if oConn.rtid == 0 {
-			oConn.tunnel.conn.WriteBytes(MsgP2P, MsgOverlayData, writeBytes)
-			gLog.Printf(LvDev, "write overlay data to tid:%d,oid:%d bodylen=%d", oConn.tunnel.id, oConn.id, len(writeBytes))
+		lost := false
+		if oConn.multipath != "" {
+			var paths []*overlayPath
+			paths, lost = oConn.schedule()
+			for _, p := range paths {
+				oConn.writeOverlayTo(p.tunnel, p.rtid, subType, writeBytes)
+			}
 		} else {
-			// write raley data
-			all := append(relayHead.Bytes(), encodeHeader(MsgP2P, MsgOverlayData, uint32(len(writeBytes)))...)
-			all = append(all, writeBytes...)
-			oConn.tunnel.conn.WriteBytes(MsgP2P, MsgRelayData, all)
-			gLog.Printf(LvDev, "write relay data to tid:%d,rtid:%d,oid:%d bodylen=%d", oConn.tunnel.id, oConn.rtid, oConn.id, len(writeBytes))
+			oConn.writeOverlay(subType, writeBytes)
+		}
+		rtid := oConn.rtid
+		oConn.sendMtx.Unlock()
+		countAppTx(oConn.app, dataLen, rtid != 0)
+		if lost {
+			oConn.recoverPaths()
 		}
 	}
-	if oConn.connTCP != nil {
-		oConn.connTCP.Close()
+	oConn.Close()
+	migratableOverlays.Delete(oConn.id)
+	oConn.removeFromTunnels()
+	// notify peer disconnect
+	req := OverlayDisconnectReq{ID: oConn.id}
+	oConn.writeMessage(MsgOverlayDisconnectReq, &req)
+}
+
+// writeOverlay writes the overlay data to the current tunnel, sendMtx must be held
+func (oConn *overlayConn) writeOverlay(subType uint16, writeBytes []byte) {
+	oConn.writeOverlayTo(oConn.tunnel, oConn.rtid, subType, writeBytes)
+}
+
+func (oConn *overlayConn) writeOverlayTo(t *P2PTunnel, rtid uint64, subType uint16, writeBytes []byte) {
+	if rtid == 0 {
+		if oConn.connUDP == nil || !t.writeDatagram(append(encodeHeader(MsgP2P, subType, uint32(len(writeBytes))), writeBytes...)) {
+			t.conn.WriteBytes(MsgP2P, subType, writeBytes)
+		}
+		t.traffic.addTx(len(writeBytes) + openP2PHeaderSize)
+		gLog.Printf(LvDev, "write overlay data to tid:%d,oid:%d bodylen=%d", t.id, oConn.id, len(writeBytes))
+		return
 	}
-	if oConn.connUDP != nil {
-		oConn.connUDP.Close()
+	// write raley data
+	relayHead := new(bytes.Buffer)
+	binary.Write(relayHead, binary.LittleEndian, rtid)
+	all := append(relayHead.Bytes(), encodeHeader(MsgP2P, subType, uint32(len(writeBytes)))...)
+	all = append(all, writeBytes...)
+	if oConn.connUDP == nil || !t.writeDatagram(append(encodeHeader(MsgP2P, MsgRelayData, uint32(len(all))), all...)) {
+		t.conn.WriteBytes(MsgP2P, MsgRelayData, all)
+	}
+	t.traffic.addTx(len(all) + openP2PHeaderSize)
+	gLog.Printf(LvDev, "write relay data to tid:%d,rtid:%d,oid:%d bodylen=%d", t.id, rtid, oConn.id, len(writeBytes))
+}
+
+func (oConn *overlayConn) currentTunnel() *P2PTunnel {
+	oConn.sendMtx.Lock()
+	defer oConn.sendMtx.Unlock()
+	return oConn.tunnel
+}
+
+// writeMessage writes a control message to the peer through the current tunnel
+func (oConn *overlayConn) writeMessage(subType uint16, req interface{}) error {
+	oConn.sendMtx.Lock()
+	t, rtid := oConn.tunnel, oConn.rtid
+	oConn.sendMtx.Unlock()
+	return t.WriteMessage(rtid, MsgP2P, subType, req)
+}
+
+// initCipher pre-calc the key bytes for encrypt, legacy cbc or aead negotiated in OverlayConnectReq.
+// aead keys come from the end-to-end session key if exchanged, otherwise from appKey.
+func (oConn *overlayConn) initCipher(suite string, salt []byte, sessionKey []byte) error {
+	if suite == CipherLegacy {
+		if oConn.appKey != 0 {
+			encryptKey := make([]byte, AESKeySize)
+			binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
+			binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
+			oConn.appKeyBytes = encryptKey
+		}
+		return nil
+	}
+	if sessionKey == nil {
+		if oConn.appKey == 0 {
+			return nil
+		}
+		sessionKey = make([]byte, 8)
+		binary.LittleEndian.PutUint64(sessionKey, oConn.appKey)
+	}
+	var err error
+	oConn.aead, err = newAEADCipher(suite, overlaySecret(sessionKey, oConn.id), salt, "openp2p overlay", oConn.isClient)
+	return err
+}
+
+// waitConnectRsp waits for the peer dialing the destination
+func (oConn *overlayConn) waitConnectRsp() error {
+	if oConn.connectRsp == nil {
+		time.Sleep(time.Second) // waiting remote node connection ok
+		return nil
+	}
+	select {
+	case rsp := <-oConn.connectRsp:
+		switch rsp.Error {
+		case OverlayConnectOK:
+			if rsp.Window > 0 && oConn.connTCP != nil {
+				oConn.enableFlowControl(rsp.Window)
+				if rsp.Migrate == 1 {
+					oConn.enableMigration()
+					if isMultipathSupported(rsp.Multipath) {
+						oConn.enableMultipath(rsp.Multipath)
+					}
+				}
+			}
+			return nil
+		case OverlayConnectDenied:
+			return fmt.Errorf("%w: %s", ErrOverlayConnectDenied, rsp.Detail)
+		default:
+			return fmt.Errorf("%w: %s", ErrOverlayDialFailed, rsp.Detail)
+		}
+	case <-time.After(OverlayConnectTimeout):
+		return ErrOverlayConnectTimeout
 	}
+}
+
+// abort drops the overlay before run, the local tcp client gets a reset instead of eof.
+// udp overlays share the listener, keep it.
+func (oConn *overlayConn) abort() {
+	oConn.running.Store(false)
+	oConn.stopDeliver()
 	oConn.tunnel.overlayConns.Delete(oConn.id)
-	// notify peer disconnect
-	req := OverlayDisconnectReq{ID: oConn.id}
-	oConn.tunnel.WriteMessage(oConn.rtid, MsgP2P, MsgOverlayDisconnectReq, &req)
+	if oConn.connTCP != nil {
+		if tc, ok := oConn.connTCP.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+		}
+		oConn.connTCP.Close()
+	}
 }
 
 func (oConn *overlayConn) Read(reuseBuff []byte) (buff []byte, dataLen int, err error) {
-	if !oConn.running {
+	if !oConn.running.Load() {
 		err = ErrOverlayConnDisconnect
 		return
 	}
@@ -130,7 +288,7 @@ func (oConn *overlayConn) Read(reuseBuff []byte) (buff []byte, dataLen int, err
 // calling by p2pTunnel
 func (oConn *overlayConn) Write(buff []byte) (n int, err error) {
 	// add mutex when multi-thread calling
-	if !oConn.running {
+	if !oConn.running.Load() {
 		return 0, ErrOverlayConnDisconnect
 	}
 	if oConn.connUDP != nil {
@@ -140,7 +298,7 @@ func (oConn *overlayConn) Write(buff []byte) (n int, err error) {
 			n, err = oConn.connUDP.WriteTo(buff, oConn.remoteAddr)
 		}
 		if err != nil {
-			oConn.running = false
+			oConn.running.Store(false)
 		}
 		return
 	}
@@ -149,13 +307,14 @@ func (oConn *overlayConn) Write(buff []byte) (n int, err error) {
 	}
 
 	if err != nil {
-		oConn.running = false
+		oConn.running.Store(false)
 	}
 	return
 }
 
 func (oConn *overlayConn) Close() (err error) {
-	oConn.running = false
+	oConn.running.Store(false)
+	oConn.stopDeliver()
 	if oConn.connTCP != nil {
 		oConn.connTCP.Close()
 		// oConn.connTCP = nil
@@ -166,3 +325,119 @@ func (oConn *overlayConn) Close() (err error) {
 	}
 	return nil
 }
+
+func overlayPacketCost(n int) int {
+	if n < OverlayPacketCost {
+		return OverlayPacketCost
+	}
+	return n
+}
+
+// startDeliver must be called before the overlay is stored in tunnel.overlayConns
+func (oConn *overlayConn) startDeliver() {
+	oConn.recvData = make(chan []byte, OverlayWindowSize/OverlayPacketCost)
+	oConn.done = make(chan struct{})
+	oConn.creditUpdate = make(chan struct{}, 1)
+	go oConn.deliverLoop()
+}
+
+func (oConn *overlayConn) stopDeliver() {
+	if oConn.done != nil {
+		oConn.closeOnce.Do(func() { close(oConn.done) })
+	}
+}
+
+// deliver queues the data read by tunnel readLoop. a peer with flow control never
+// exceeds the window, old peers block the readLoop as before, udp drops.
+func (oConn *overlayConn) deliver(payload []byte) error {
+	if oConn.recvData == nil {
+		_, err := oConn.Write(payload)
+		return err
+	}
+	buff := append([]byte(nil), payload...) // readLoop reuses the buffer
+	select {
+	case oConn.recvData <- buff:
+		return nil
+	default:
+	}
+	if oConn.flowControl.Load() {
+		return ErrOverlayWindowExceeded
+	}
+	if oConn.connUDP != nil {
+		return nil
+	}
+	select {
+	case oConn.recvData <- buff:
+	case <-oConn.done:
+	}
+	return nil
+}
+
+func (oConn *overlayConn) deliverLoop() {
+	for {
+		select {
+		case buff := <-oConn.recvData:
+			if _, err := oConn.Write(buff); err != nil {
+				gLog.Printf(LvERROR, "overlay %d write error:%s", oConn.id, err)
+				oConn.Close()
+				return
+			}
+			oConn.returnCredit(len(buff))
+		case <-oConn.done:
+			return
+		}
+	}
+}
+
+// returnCredit reports the consumed credits every quarter window. they are counted before flow
+// control enabled too, the peer may send data before the client reads OverlayConnectRsp.
+func (oConn *overlayConn) returnCredit(n int) {
+	consumed := oConn.consumed.Add(int64(overlayPacketCost(n)))
+	if !oConn.flowControl.Load() || consumed-oConn.returned < OverlayWindowSize/4 {
+		return
+	}
+	oConn.returned = consumed
+	oConn.sendWindowUpdate()
+}
+
+// cumulative, a lost update is covered by the next one
+func (oConn *overlayConn) sendWindowUpdate() {
+	req := OverlayWindowUpdate{ID: oConn.id, Consumed: oConn.consumed.Load(), Ack: oConn.recvSeq.Load()}
+	oConn.writeMessage(MsgOverlayWindowUpdate, &req)
+}
+
+func (oConn *overlayConn) enableFlowControl(peerWindow int) {
+	oConn.peerWindow.Store(int64(peerWindow))
+	oConn.flowControl.Store(true)
+}
+
+func (oConn *overlayConn) updateWindow(req *OverlayWindowUpdate) {
+	for {
+		old := oConn.peerConsumed.Load()
+		if req.Consumed <= old || oConn.peerConsumed.CompareAndSwap(old, req.Consumed) {
+			break
+		}
+	}
+	select {
+	case oConn.creditUpdate <- struct{}{}:
+	default:
+	}
+	oConn.ack(req.Ack)
+}
+
+// waitCredit blocks run() until the peer has room for n, only run() takes credits
+func (oConn *overlayConn) waitCredit(n int) bool {
+	for oConn.peerWindow.Load()+oConn.peerConsumed.Load()-oConn.sentCost < int64(n) {
+		if !oConn.running.Load() || !oConn.tunnelReady() {
+			return false
+		}
+		select {
+		case <-oConn.creditUpdate:
+		case <-oConn.done:
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+	oConn.sentCost += int64(n)
+	return true
+}
@@ -0,0 +1,146 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestWaitConnectRsp(t *testing.T) {
+	cases := []struct {
+		rsp OverlayConnectRsp
+		err error
+	}{
+		{OverlayConnectRsp{ID: 1}, nil},
+		{OverlayConnectRsp{ID: 1, Error: OverlayConnectDenied, Detail: "token not match"}, ErrOverlayConnectDenied},
+		{OverlayConnectRsp{ID: 1, Error: OverlayConnectDialFailed, Detail: "connection refused"}, ErrOverlayDialFailed},
+	}
+	for _, c := range cases {
+		oConn := overlayConn{id: 1, connectRsp: make(chan *OverlayConnectRsp, 1)}
+		rsp := c.rsp
+		oConn.connectRsp <- &rsp
+		if err := oConn.waitConnectRsp(); !errors.Is(err, c.err) {
+			t.Errorf("rsp error %d got %v, want %v", c.rsp.Error, err, c.err)
+		}
+	}
+}
+
+func TestDialOverlay(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	gConf.Network.Token = 123
+	tunnel := &P2PTunnel{}
+	if _, code, err := tunnel.dialOverlay(&OverlayConnectReq{ID: 1, Token: 456}); code != OverlayConnectDenied || err == nil {
+		t.Errorf("wrong token not denied:%d %v", code, err)
+	}
+	if _, code, _ := tunnel.dialOverlay(&OverlayConnectReq{ID: 1, Token: 123, Cipher: "rc4"}); code != OverlayConnectDenied {
+		t.Errorf("unknown cipher not denied:%d", code)
+	}
+	if _, code, _ := tunnel.dialOverlay(&OverlayConnectReq{ID: 1, Token: 123, Cipher: CipherAESGCM, Kex: KexX25519}); code != OverlayConnectDenied {
+		t.Errorf("missing session key not denied:%d", code)
+	}
+	if _, code, err := tunnel.dialOverlay(&OverlayConnectReq{ID: 1, Token: 123, Cipher: CipherAESGCM}); code != OverlayConnectDenied || err != ErrNoSessionKey {
+		t.Errorf("aead without key exchange not denied:%d %v", code, err)
+	}
+	identified := &P2PTunnel{peerIdentity: "peer identity"}
+	if _, code, err := identified.dialOverlay(&OverlayConnectReq{ID: 1, Token: 123}); code != OverlayConnectDenied || err != ErrCipherDowngrade {
+		t.Errorf("legacy cipher from identified peer not denied:%d %v", code, err)
+	}
+	relay := &P2PTunnel{id: 10}
+	addRelayPeer(relay.id, 20, "relay peer")
+	setAppSessionKey("relay peer", 30, "peer identity", make([]byte, 32))
+	defer func() {
+		deleteRelayPeers(relay.id)
+		appSessionKeyMtx.Lock()
+		delete(appSessionKeys, appSessionKeyID{"relay peer", 30})
+		appSessionKeyMtx.Unlock()
+	}()
+	if _, code, err := relay.dialOverlay(&OverlayConnectReq{ID: 1, Token: 123, AppID: 30, RelayTunnelID: 20}); code != OverlayConnectDenied || err != ErrCipherDowngrade {
+		t.Errorf("legacy cipher from relay peer with app key not denied:%d %v", code, err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	oConn, code, err := tunnel.dialOverlay(&OverlayConnectReq{ID: 2, Token: 123, DstIP: "127.0.0.1", DstPort: port})
+	if code != OverlayConnectOK || err != nil {
+		t.Fatalf("dial error:%d %v", code, err)
+	}
+	if _, ok := tunnel.overlayConns.Load(oConn.id); !ok {
+		t.Errorf("overlay not stored")
+	}
+	oConn.abort()
+	if _, ok := tunnel.overlayConns.Load(oConn.id); ok || oConn.running.Load() {
+		t.Errorf("abort error")
+	}
+	l.Close()
+	if _, code, _ := tunnel.dialOverlay(&OverlayConnectReq{ID: 3, Token: 123, DstIP: "127.0.0.1", DstPort: port}); code != OverlayConnectDialFailed {
+		t.Errorf("closed port dial code %d", code)
+	}
+}
+
+func TestOverlayFlowControl(t *testing.T) {
+	tunnel := &P2PTunnel{}
+	tunnel.setRun(true)
+	local, remote := net.Pipe() // nobody reads remote, deliverLoop blocks in Write
+	defer remote.Close()
+	oConn := overlayConn{tunnel: tunnel, id: 1, connTCP: local}
+	oConn.running.Store(true)
+	oConn.enableFlowControl(OverlayPacketCost * 2)
+	oConn.startDeliver()
+	defer oConn.Close()
+
+	if !oConn.waitCredit(overlayPacketCost(1)) || !oConn.waitCredit(overlayPacketCost(OverlayPacketCost)) {
+		t.Errorf("credit of the window not available")
+	}
+	go oConn.updateWindow(&OverlayWindowUpdate{ID: 1, Consumed: OverlayPacketCost})
+	if !oConn.waitCredit(overlayPacketCost(10)) {
+		t.Errorf("wait credit error")
+	}
+
+	var err error
+	for i := 0; i <= OverlayWindowSize/OverlayPacketCost+1 && err == nil; i++ {
+		err = oConn.deliver([]byte("data"))
+	}
+	if err != ErrOverlayWindowExceeded {
+		t.Errorf("receive window exceeded not detected:%v", err)
+	}
+}
+
+func TestOverlayReceiveSeq(t *testing.T) {
+	oConn := overlayConn{id: 1, recvData: make(chan []byte, 10)}
+	oConn.running.Store(true)
+	packet := func(seq uint64, data string) []byte {
+		b := make([]byte, overlayHeaderSize+8)
+		binary.LittleEndian.PutUint64(b, oConn.id)
+		binary.LittleEndian.PutUint64(b[overlayHeaderSize:], seq)
+		return append(b, data...)
+	}
+	// 2 arrives before the data resent from 1, then 1 and 2 again
+	for _, seq := range []uint64{2, 1, 2, 1, 3} {
+		if _, err := oConn.receiveSeq(packet(seq, fmt.Sprintf("data%d", seq)), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		if got := string(<-oConn.recvData); got != fmt.Sprintf("data%d", i) {
+			t.Errorf("seq %d got %s", i, got)
+		}
+	}
+	if len(oConn.recvData) != 0 || oConn.recvSeq.Load() != 3 {
+		t.Errorf("duplicated data delivered")
+	}
+
+	for i := uint64(1); i <= 5; i++ {
+		oConn.unacked = append(oConn.unacked, overlayPacket{seq: i})
+	}
+	oConn.ack(3)
+	if len(oConn.unacked) != 2 || oConn.unacked[0].seq != 4 {
+		t.Errorf("ack error:%v", oConn.unacked)
+	}
+}
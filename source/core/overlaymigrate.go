@@ -0,0 +1,178 @@
+package core
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// tcp overlays with flow control number their data. the sender keeps the data until
+// acked in OverlayWindowUpdate, it's at most one window. when the app switches between
+// the direct and relay tunnel, the client sends MsgOverlayMigrate on the new tunnel,
+// both sides move the overlay and send the unacked data again, the receiver drops
+// what it has got by seq. the user's tcp connection keeps alive.
+
+type overlayPacket struct {
+	seq  uint64
+	data []byte // overlay id|seq|payload
+}
+
+// the peer looks up the overlay here, its old tunnel may be closed
+var migratableOverlays sync.Map // overlay id -> *overlayConn
+
+func (oConn *overlayConn) enableMigration() {
+	oConn.seqMode.Store(true)
+	migratableOverlays.Store(oConn.id, oConn)
+}
+
+// tunnelReady waits a while for a migration if the tunnel closed
+func (oConn *overlayConn) tunnelReady() bool {
+	for i := 0; ; i++ {
+		if oConn.currentTunnel().isRuning() {
+			return true
+		}
+		if !oConn.seqMode.Load() || !oConn.running.Load() || i >= int(OverlayMigrateTimeout/time.Second) {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// ack drops the data the peer has got
+func (oConn *overlayConn) ack(seq uint64) {
+	oConn.retransmitMtx.Lock()
+	defer oConn.retransmitMtx.Unlock()
+	i := 0
+	for i < len(oConn.unacked) && oConn.unacked[i].seq <= seq {
+		i++
+	}
+	oConn.unacked = oConn.unacked[i:]
+}
+
+// receiveSeq delivers the data in order, both tunnels may deliver during migration.
+// the data resent after migration starts at or before the next seq, so there is no gap.
+// multipath overlays keep the data ahead until the gap filled, it's at most one window.
+func (oConn *overlayConn) receiveSeq(body []byte, decryptData []byte) (int, error) {
+	seq := binary.LittleEndian.Uint64(body[overlayHeaderSize:])
+	oConn.recvMtx.Lock()
+	defer oConn.recvMtx.Unlock()
+	next := oConn.recvSeq.Load() + 1
+	if seq < next {
+		return 0, nil
+	}
+	if seq > next {
+		if oConn.reorder != nil && oConn.reorder[seq] == nil && len(oConn.reorder) < OverlayWindowSize/OverlayPacketCost {
+			oConn.reorder[seq] = append([]byte(nil), body...) // readLoop reuses the buffer
+		}
+		return 0, nil
+	}
+	n, err := oConn.deliverSeq(seq, body, decryptData)
+	if err != nil {
+		return 0, err
+	}
+	for oConn.reorder != nil {
+		b, ok := oConn.reorder[seq+1]
+		if !ok {
+			break
+		}
+		delete(oConn.reorder, seq+1)
+		m, err := oConn.deliverSeq(seq+1, b, decryptData)
+		if err != nil { // a forged one, wait for the other path
+			return n, err
+		}
+		seq++
+		n += m
+	}
+	return n, nil
+}
+
+// deliverSeq decrypts in seq order, the aead replay window sees increasing nonces. caller holds recvMtx
+func (oConn *overlayConn) deliverSeq(seq uint64, body []byte, decryptData []byte) (int, error) {
+	head := body[:overlayHeaderSize+8]
+	payload := body[len(head):]
+	if oConn.aead != nil {
+		var err error
+		if payload, err = oConn.aead.open(decryptData, body[len(head):], head); err != nil {
+			return 0, err
+		}
+	} else if oConn.appKey != 0 {
+		payload, _ = decryptBytes(oConn.appKeyBytes, decryptData, body[len(head):], len(body)-len(head))
+	}
+	if err := oConn.deliver(payload); err != nil {
+		return 0, err
+	}
+	oConn.recvSeq.Store(seq)
+	return len(payload), nil
+}
+
+// migrate moves the overlay to tunnel t and sends the unacked data again.
+// notify the peer first, it must move the overlay before reading the data.
+func (oConn *overlayConn) migrate(t *P2PTunnel, rtid uint64, notify bool) {
+	oConn.sendMtx.Lock()
+	if oConn.tunnel != t || oConn.rtid != rtid {
+		gLog.Printf(LvINFO, "overlay %d migrate from tunnel %d to %d, rtid:%d", oConn.id, oConn.tunnel.id, t.id, rtid)
+		if oConn.findPath(oConn.tunnel, oConn.rtid) == nil {
+			oConn.tunnel.overlayConns.Delete(oConn.id)
+		}
+		oConn.tunnel, oConn.rtid = t, rtid
+		t.overlayConns.Store(oConn.id, oConn)
+		if oConn.multipath != "" && oConn.findPath(t, rtid) == nil {
+			oConn.paths = append(oConn.paths, &overlayPath{tunnel: t, rtid: rtid})
+		}
+	}
+	if oConn.multipath != "" {
+		oConn.prunePaths()
+	}
+	if notify {
+		req := OverlayMigrateReq{ID: oConn.id, Token: gConf.Network.Token}
+		if rtid != 0 {
+			req.RelayTunnelID = t.id
+		}
+		t.WriteMessage(rtid, MsgP2P, MsgOverlayMigrate, &req)
+	}
+	oConn.retransmitMtx.Lock()
+	for _, p := range oConn.unacked {
+		oConn.writeOverlay(MsgOverlayDataSeq, p.data)
+	}
+	oConn.retransmitMtx.Unlock()
+	oConn.sendMtx.Unlock()
+	oConn.sendWindowUpdate() // window updates on the old tunnel may be lost
+}
+
+func (t *P2PTunnel) handleOverlayMigrate(req *OverlayMigrateReq) {
+	if req.Token != gConf.Network.Token {
+		gLog.Printf(LvERROR, "overlay %d migrate access denied", req.ID)
+		return
+	}
+	i, ok := migratableOverlays.Load(req.ID)
+	if !ok {
+		gLog.Printf(LvDEBUG, "%d tunnel not found overlay %d to migrate", t.id, req.ID)
+		return
+	}
+	i.(*overlayConn).migrate(t, req.RelayTunnelID, false)
+}
+
+// migrateOverlays moves the client overlays of this app on tunnel from to the current tunnel.
+// multipath overlays keep both tunnels, they only drop the closed one.
+func (app *p2pApp) migrateOverlays(from *P2PTunnel, closed bool) {
+	to := app.Tunnel()
+	if from == nil || to == nil || from == to {
+		return
+	}
+	rtid := app.RelayTunnelID()
+	from.overlayConns.Range(func(_, i interface{}) bool {
+		oConn := i.(*overlayConn)
+		if oConn.appID != app.id || !oConn.isClient || !oConn.seqMode.Load() {
+			return true
+		}
+		if oConn.multipathMode() != "" {
+			if closed {
+				oConn.dropPath(from)
+				oConn.recoverPaths()
+			}
+			return true
+		}
+		oConn.migrate(to, rtid, true)
+		return true
+	})
+}
@@ -37,6 +37,12 @@ type p2pApp struct {
 	nextRetryRelayTime time.Time
 	errMsg             string
 	connectTime        time.Time
+	traffic            TrafficStats
+	relayRTT           rttStats    // end-to-end through relay node
+	kex                keyExchange // app session key through relay node
+	// multipath
+	extraPaths        []appPath // more tunnels beside directTunnel and relayTunnel, guarded by tunnelMtx
+	nextRetryPathTime time.Time
 }
 
 func (app *p2pApp) Tunnel() *P2PTunnel {
@@ -99,6 +105,7 @@ func (app *p2pApp) RetryTime() time.Time {
 
 func (app *p2pApp) checkP2PTunnel() error {
 	for app.running {
+		app.checkMultipathTunnels()
 		app.checkDirectTunnel()
 		app.checkRelayTunnel()
 		time.Sleep(time.Second * 3)
@@ -215,12 +222,15 @@ func (app *p2pApp) buildDirectTunnel() error {
 	gLog.Printf(LvDEBUG, "sync appkey direct to %s", app.config.LogPeerNode())
 	pn.push(app.config.PeerNode, MsgPushAPPKey, &syncKeyReq)
 	app.setDirectTunnel(t)
+	app.migrateOverlays(app.RelayTunnel(), false)
+	app.addOverlayPaths()
 
 	// if memapp notify peer addmemapp
 	if app.config.SrcPort == 0 {
 		req := ServerSideSaveMemApp{From: gConf.Network.Node, Node: gConf.Network.Node, TunnelID: t.id, RelayTunnelID: 0, AppID: app.id}
 		pn.push(app.config.PeerNode, MsgPushServerSideSaveMemApp, &req)
 		gLog.Printf(LvDEBUG, "push %s ServerSideSaveMemApp: %s", app.config.LogPeerNode(), prettyJson(req))
+		app.startNodeKeyExchange()
 	}
 	gLog.Printf(LvDEBUG, "%s use tunnel %d", app.config.AppName, t.id)
 	return nil
@@ -320,22 +330,34 @@ func (app *p2pApp) buildRelayTunnel() error {
 	}
 	gLog.Printf(LvDEBUG, "sync appkey relay to %s", config.LogPeerNode())
 	pn.push(config.PeerNode, MsgPushAPPKey, &syncKeyReq)
+	app.config.peerVersion = config.peerVersion // cipherSuite negotiates by it, a force relay app has no direct tunnel to learn it
 	app.setRelayTunnelID(rtid)
 	app.setRelayTunnel(t)
 	app.relayNode = relayNode
 	app.relayMode = relayMode
 	app.hbTimeRelay = time.Now()
+	app.startKeyExchange()
+	app.addOverlayPaths()
 
 	// if memapp notify peer addmemapp
 	if config.SrcPort == 0 {
 		req := ServerSideSaveMemApp{From: gConf.Network.Node, Node: relayNode, TunnelID: rtid, RelayTunnelID: t.id, AppID: app.id, RelayMode: relayMode}
 		pn.push(config.PeerNode, MsgPushServerSideSaveMemApp, &req)
 		gLog.Printf(LvDEBUG, "push %s relay ServerSideSaveMemApp: %s", config.LogPeerNode(), prettyJson(req))
+		app.startNodeKeyExchange()
 	}
 	gLog.Printf(LvDEBUG, "%s use tunnel %d", app.config.AppName, t.id)
 	return nil
 }
 
+// strongest overlay cipher the peer supports, old peers only know the legacy one
+func (app *p2pApp) cipherSuite() string {
+	if compareVersion(app.config.peerVersion, SupportAEADVersion) >= 0 {
+		return CipherAESGCM
+	}
+	return CipherLegacy
+}
+
 func (app *p2pApp) buildOfficialTunnel() error {
 	return nil
 }
@@ -373,6 +395,16 @@ func (app *p2pApp) isActive() bool {
 	return res
 }
 
+// rtt to the peer, relay apps use the end-to-end rtt
+func (app *p2pApp) RTT() RTTSnapshot {
+	if app.isDirect() {
+		if t := app.DirectTunnel(); t != nil {
+			return t.rtt.Snapshot()
+		}
+	}
+	return app.relayRTT.Snapshot()
+}
+
 func (app *p2pApp) updateHeartbeat() {
 	app.hbMtx.Lock()
 	defer app.hbMtx.Unlock()
@@ -423,39 +455,66 @@ func (app *p2pApp) listenTCP() error {
 			isClient: true,
 			appID:    app.id,
 			appKey:   app.key,
-			running:  true,
 		}
+		oConn.running.Store(true)
 		if !app.isDirect() {
 			oConn.rtid = app.rtid
 		}
-		// pre-calc key bytes for encrypt
-		if oConn.appKey != 0 {
-			encryptKey := make([]byte, AESKeySize)
-			binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
-			binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
-			oConn.appKeyBytes = encryptKey
+		if compareVersion(app.config.peerVersion, SupportOverlayConnectRspVersion) >= 0 {
+			oConn.connectRsp = make(chan *OverlayConnectRsp, 1)
 		}
-		app.Tunnel().overlayConns.Store(oConn.id, &oConn)
-		gLog.Printf(LvDEBUG, "Accept TCP overlayID:%d, %s", oConn.id, oConn.connTCP.RemoteAddr())
-		// tell peer connect
 		req := OverlayConnectReq{ID: oConn.id,
-			Token:    gConf.Network.Token,
-			DstIP:    app.config.DstHost,
-			DstPort:  app.config.DstPort,
-			Protocol: app.config.Protocol,
-			AppID:    app.id,
-		}
-		if !app.isDirect() {
-			req.RelayTunnelID = app.Tunnel().id
+			Token:     gConf.Network.Token,
+			DstIP:     app.config.DstHost,
+			DstPort:   app.config.DstPort,
+			Protocol:  app.config.Protocol,
+			AppID:     app.id,
+			Cipher:    app.cipherSuite(),
+			Window:    OverlayWindowSize,
+			Migrate:   1,
+			Multipath: app.config.Multipath,
 		}
-		app.Tunnel().WriteMessage(app.RelayTunnelID(), MsgP2P, MsgOverlayConnectReq, &req)
-		// TODO: wait OverlayConnectRsp instead of sleep
-		time.Sleep(time.Second) // waiting remote node connection ok
-		go oConn.run()
+		gLog.Printf(LvDEBUG, "Accept TCP overlayID:%d, %s", oConn.id, oConn.connTCP.RemoteAddr())
+		go func() {
+			if err := app.connectOverlay(&oConn, &req); err != nil {
+				gLog.Printf(LvERROR, "overlay %d connect %s:%d error:%s, close %s", oConn.id, req.DstIP, req.DstPort, err, conn.RemoteAddr())
+				oConn.abort()
+				return
+			}
+			if oConn.multipathMode() != "" {
+				app.addPaths(&oConn)
+			}
+			oConn.run()
+		}()
 	}
 	return nil
 }
 
+// connectOverlay inits the cipher and asks the peer to connect. the overlay of an aead peer waits
+// for the session key, so it runs in the overlay goroutine, not in the listener.
+func (app *p2pApp) connectOverlay(oConn *overlayConn, req *OverlayConnectReq) error {
+	var sessionKey []byte
+	if req.Cipher != CipherLegacy {
+		req.Salt = newCipherSalt()
+		req.Kex = KexX25519
+		var err error
+		if sessionKey, err = app.waitSessionKey(); err != nil {
+			return err
+		}
+	}
+	if err := oConn.initCipher(req.Cipher, req.Salt, sessionKey); err != nil {
+		return fmt.Errorf("init cipher %s error:%s", req.Cipher, err)
+	}
+	oConn.startDeliver()
+	oConn.tunnel.overlayConns.Store(oConn.id, oConn)
+	// tell peer connect
+	if oConn.rtid != 0 {
+		req.RelayTunnelID = oConn.tunnel.id
+	}
+	oConn.tunnel.WriteMessage(oConn.rtid, MsgP2P, MsgOverlayConnectReq, req)
+	return oConn.waitConnectRsp()
+}
+
 func (app *p2pApp) listenUDP() error {
 	gLog.Printf(LvDEBUG, "udp accept on port %d start", app.config.SrcPort)
 	defer gLog.Printf(LvDEBUG, "udp accept on port %d end", app.config.SrcPort)
@@ -501,6 +560,7 @@ func (app *p2pApp) listenUDP() error {
 			if !ok {
 				oConn := overlayConn{
 					tunnel:     app.Tunnel(),
+					app:        app,
 					connUDP:    app.listenerUDP,
 					remoteAddr: remoteAddr,
 					udpData:    make(chan []byte, 1000),
@@ -508,36 +568,34 @@ func (app *p2pApp) listenUDP() error {
 					isClient:   true,
 					appID:      app.id,
 					appKey:     app.key,
-					running:    true,
 				}
+				oConn.running.Store(true)
 				if !app.isDirect() {
 					oConn.rtid = app.rtid
 				}
-				// calc key bytes for encrypt
-				if oConn.appKey != 0 {
-					encryptKey := make([]byte, AESKeySize)
-					binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
-					binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
-					oConn.appKeyBytes = encryptKey
+				if compareVersion(app.config.peerVersion, SupportOverlayConnectRspVersion) >= 0 {
+					oConn.connectRsp = make(chan *OverlayConnectRsp, 1)
 				}
-				app.Tunnel().overlayConns.Store(oConn.id, &oConn)
-				gLog.Printf(LvDEBUG, "Accept UDP overlayID:%d", oConn.id)
-				// tell peer connect
 				req := OverlayConnectReq{ID: oConn.id,
 					Token:    gConf.Network.Token,
 					DstIP:    app.config.DstHost,
 					DstPort:  app.config.DstPort,
 					Protocol: app.config.Protocol,
 					AppID:    app.id,
+					Cipher:   app.cipherSuite(),
 				}
-				if !app.isDirect() {
-					req.RelayTunnelID = app.Tunnel().id
-				}
-				app.Tunnel().WriteMessage(app.RelayTunnelID(), MsgP2P, MsgOverlayConnectReq, &req)
-				// TODO: wait OverlayConnectRsp instead of sleep
-				time.Sleep(time.Second) // waiting remote node connection ok
-				go oConn.run()
+				oConn.tunnel.overlayConns.Store(oConn.id, &oConn) // the next packets queue in udpData until connected
+				gLog.Printf(LvDEBUG, "Accept UDP overlayID:%d", oConn.id)
+				go func() {
+					if err := app.connectOverlay(&oConn, &req); err != nil {
+						gLog.Printf(LvERROR, "overlay %d connect %s:%d error:%s, drop %s", oConn.id, req.DstIP, req.DstPort, err, remoteAddr)
+						oConn.abort()
+						return
+					}
+					oConn.run()
+				}()
 				oConn.udpData <- dupData.Bytes()
+				continue
 			}
 
 			// load from app.tunnel.overlayConns by remoteAddr ok, write relay data
@@ -545,7 +603,10 @@ func (app *p2pApp) listenUDP() error {
 			if !ok {
 				continue
 			}
-			overlayConn.udpData <- dupData.Bytes()
+			select {
+			case overlayConn.udpData <- dupData.Bytes():
+			default: // drop, don't block the listener
+			}
 		}
 	}
 	return nil
@@ -581,11 +642,8 @@ func (app *p2pApp) close() {
 	if app.listenerUDP != nil {
 		app.listenerUDP.Close()
 	}
-	if app.DirectTunnel() != nil {
-		app.DirectTunnel().closeOverlayConns(app.id)
-	}
-	if app.RelayTunnel() != nil {
-		app.RelayTunnel().closeOverlayConns(app.id)
+	for _, p := range app.paths() {
+		p.tunnel.closeOverlayConns(app.id)
 	}
 	app.wg.Wait()
 }
@@ -602,8 +660,9 @@ func (app *p2pApp) relayHeartbeatLoop() {
 			time.Sleep(TunnelHeartbeatTime)
 			continue
 		}
+		seq, ts := app.relayRTT.probe()
 		req := RelayHeartbeat{From: gConf.Network.Node, RelayTunnelID: app.RelayTunnel().id,
-			AppID: app.id}
+			AppID: app.id, Seq: seq, Ts: ts.UnixNano()}
 		err := app.RelayTunnel().WriteMessage(app.rtid, MsgP2P, MsgRelayHeartbeat, &req)
 		if err != nil {
 			gLog.Printf(LvERROR, "%s appid:%d rtid:%d write relay tunnel heartbeat error %s", app.config.LogPeerNode(), app.id, app.rtid, err)
@@ -20,10 +20,12 @@ import (
 )
 
 var (
-	v4l            *v4Listener
-	instance       *P2PNetwork
-	onceP2PNetwork sync.Once
-	onceV4Listener sync.Once
+	v4l                   *v4Listener
+	instance              *P2PNetwork
+	onceP2PNetwork        sync.Once
+	onceV4Listener        sync.Once
+	onceNATLifetime       sync.Once
+	onceCleanPortMappings sync.Once
 )
 
 const (
@@ -115,6 +117,7 @@ func (pn *P2PNetwork) run() {
 			pn.write(MsgHeartbeat, 0, "")
 		case <-pn.restartCh:
 			gLog.Printf(LvDEBUG, "got restart channel")
+			metricReconnects.inc()
 			pn.sdwan.reset()
 			pn.online = false
 			pn.wgReconnect.Wait() // wait read/autorunapp goroutine end
@@ -136,6 +139,8 @@ func (pn *P2PNetwork) run() {
 				if app.RelayTunnel() == t {
 					app.setRelayTunnel(nil)
 				}
+				app.dropExtraTunnel(t)
+				app.migrateOverlays(t, true)
 				return true
 			})
 		}
@@ -201,8 +206,10 @@ func (pn *P2PNetwork) addRelayTunnel(config AppConfig) (*P2PTunnel, uint64, stri
 	defer gLog.Printf(LvINFO, "addRelayTunnel to %s end", config.LogPeerNode())
 	relayConfig := AppConfig{
 		PeerNode:  config.RelayNode,
-		peerToken: config.peerToken,
-		relayMode: "private"}
+		relayMode: "private"} // peerToken is the relay's, not config.peerToken of the peer
+	if config.UnderlayProtocol == UderlayWSS { // the firewall applies to the relay too
+		relayConfig.UnderlayProtocol = UderlayWSS
+	}
 	if relayConfig.PeerNode == "" {
 		// find existing relay tunnel
 		pn.apps.Range(func(id, i interface{}) bool {
@@ -214,24 +221,14 @@ func (pn *P2PNetwork) addRelayTunnel(config AppConfig) (*P2PTunnel, uint64, stri
 				return true
 			}
 			relayConfig.PeerNode = app.RelayTunnel().config.PeerNode
+			relayConfig.peerToken = app.RelayTunnel().config.peerToken
 			gLog.Printf(LvDEBUG, "found existing relay tunnel %s", relayConfig.LogPeerNode())
 			return false
 		})
 		if relayConfig.PeerNode == "" { // request relay node
-			pn.reqGatewayMtx.Lock()
-			pn.write(MsgRelay, MsgRelayNodeReq, &RelayNodeReq{config.PeerNode})
-			head, body := pn.read("", MsgRelay, MsgRelayNodeRsp, ClientAPITimeout)
-			pn.reqGatewayMtx.Unlock()
-			if head == nil {
-				return nil, 0, "", errors.New("read MsgRelayNodeRsp error")
-			}
-			rsp := RelayNodeRsp{}
-			if err := json.Unmarshal(body, &rsp); err != nil {
-				return nil, 0, "", errors.New("unmarshal MsgRelayNodeRsp error")
-			}
-			if rsp.RelayName == "" || rsp.RelayToken == 0 {
-				gLog.Printf(LvERROR, "MsgRelayNodeReq error")
-				return nil, 0, "", errors.New("MsgRelayNodeReq error")
+			rsp, err := pn.requestRelayNode(config.PeerNode, "", nil)
+			if err != nil {
+				return nil, 0, "", err
 			}
 			gLog.Printf(LvDEBUG, "got relay node:%s", relayConfig.LogPeerNode())
 
@@ -240,6 +237,13 @@ func (pn *P2PNetwork) addRelayTunnel(config AppConfig) (*P2PTunnel, uint64, stri
 			relayConfig.relayMode = rsp.Mode
 		}
 
+	} else {
+		// pinned relay node maybe other user's share node, ask server for its token
+		rsp, err := pn.requestRelayNode(config.PeerNode, config.RelayNode, nil)
+		if err == nil && rsp.RelayName == config.RelayNode {
+			relayConfig.peerToken = rsp.RelayToken
+			relayConfig.relayMode = rsp.Mode
+		}
 	}
 	///
 	t, err := pn.addDirectTunnel(relayConfig, 0)
@@ -272,6 +276,25 @@ func (pn *P2PNetwork) addRelayTunnel(config AppConfig) (*P2PTunnel, uint64, stri
 	return t, rspID.ID, relayConfig.relayMode, err
 }
 
+func (pn *P2PNetwork) requestRelayNode(peerNode string, relayNode string, exclude []string) (*RelayNodeRsp, error) {
+	pn.reqGatewayMtx.Lock()
+	pn.write(MsgRelay, MsgRelayNodeReq, &RelayNodeReq{peerNode, relayNode, exclude})
+	head, body := pn.read("", MsgRelay, MsgRelayNodeRsp, ClientAPITimeout)
+	pn.reqGatewayMtx.Unlock()
+	if head == nil {
+		return nil, errors.New("read MsgRelayNodeRsp error")
+	}
+	rsp := RelayNodeRsp{}
+	if err := json.Unmarshal(body, &rsp); err != nil {
+		return nil, errors.New("unmarshal MsgRelayNodeRsp error")
+	}
+	if rsp.RelayName == "" || rsp.RelayToken == 0 {
+		gLog.Printf(LvERROR, "MsgRelayNodeReq error")
+		return nil, errors.New("MsgRelayNodeReq error")
+	}
+	return &rsp, nil
+}
+
 // use *AppConfig to save status
 func (pn *P2PNetwork) AddApp(config AppConfig) error {
 	gLog.Printf(LvINFO, "addApp %s to %s:%s:%d start", config.AppName, config.LogPeerNode(), config.DstHost, config.DstPort)
@@ -368,6 +391,25 @@ func (pn *P2PNetwork) addDirectTunnel(config AppConfig, tid uint64) (t *P2PTunne
 	}
 	gLog.Printf(LvDEBUG, "config.peerNode=%s,config.peerVersion=%s,config.peerIP=%s,config.peerLanIP=%s,gConf.Network.publicIP=%s,config.peerIPv6=%s,config.hasIPv4=%d,config.hasUPNPorNATPMP=%d,gConf.Network.hasIPv4=%d,gConf.Network.hasUPNPorNATPMP=%d,config.peerNatType=%d,gConf.Network.natType=%d,",
 		config.LogPeerNode(), config.peerVersion, config.peerIP, config.peerLanIP, gConf.Network.publicIP, config.peerIPv6, config.hasIPv4, config.hasUPNPorNATPMP, gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP, config.peerNatType, gConf.Network.natType)
+	funcWSS := func() (t *P2PTunnel, err error) {
+		if compareVersion(config.peerVersion, SupportWSSVersion) < 0 {
+			return nil, ErrVersionNotCompatible
+		}
+		// the node with public ip listens
+		if port, _ := localWSS(); config.hasIPv4 == 1 {
+			config.isUnderlayServer = 0
+		} else if port != 0 {
+			config.isUnderlayServer = 1
+		} else {
+			return nil, ErrWSSUnavailable
+		}
+		gLog.Println(LvINFO, "try WSS")
+		config.linkMode = LinkModeWSS
+		return pn.newTunnel(config, tid, isClient)
+	}
+	if config.UnderlayProtocol == UderlayWSS {
+		return funcWSS()
+	}
 	// try Intranet
 	if config.peerIP == gConf.Network.publicIP && compareVersion(config.peerVersion, SupportIntranetVersion) >= 0 { // old version client has no peerLanIP
 		gLog.Println(LvINFO, "try Intranet")
@@ -387,7 +429,15 @@ func (pn *P2PNetwork) addDirectTunnel(config AppConfig, tid uint64) (t *P2PTunne
 		}
 	}
 
-	// try UDP6? maybe no
+	// try UDP6, many ipv6 firewalls drop inbound tcp but pass udp after an outbound packet
+	if IsIPv6(config.peerIPv6) && IsIPv6(gConf.IPv6()) && config.PunchPriority&PunchPriorityUDPDisable == 0 && compareVersion(config.peerVersion, SupportUDP6Version) >= 0 {
+		gLog.Println(LvINFO, "try UDP6")
+		config.linkMode = LinkModeUDP6
+		config.isUnderlayServer = 0
+		if t, err = pn.newTunnel(config, tid, isClient); err == nil {
+			return t, nil
+		}
+	}
 
 	// try TCP4
 	if config.hasIPv4 == 1 || gConf.Network.hasIPv4 == 1 || config.hasUPNPorNATPMP == 1 || gConf.Network.hasUPNPorNATPMP == 1 {
@@ -403,6 +453,14 @@ func (pn *P2PNetwork) addDirectTunnel(config AppConfig, tid uint64) (t *P2PTunne
 		}
 	}
 	// try UDP4? maybe no
+	if reason := natPunchReason(gConf.NATBehavior(), config.peerNatBehavior, config.peerIP == gConf.Network.publicIP); reason != "" {
+		gLog.Printf(LvINFO, "%s skip punching: %s", config.LogPeerNode(), reason)
+		err = fmt.Errorf("%w: %s", ErrNATNotPunchable, reason)
+		if tWSS, errWSS := funcWSS(); errWSS == nil {
+			return tWSS, nil
+		}
+		return nil, err
+	}
 	var primaryPunchFunc func() (*P2PTunnel, error)
 	var secondaryPunchFunc func() (*P2PTunnel, error)
 	funcUDP := func() (t *P2PTunnel, err error) {
@@ -456,13 +514,17 @@ func (pn *P2PNetwork) addDirectTunnel(config AppConfig, tid uint64) (t *P2PTunne
 	if t, err = secondaryPunchFunc(); t != nil && err == nil {
 		return t, err
 	}
+	// try WSS at last, some firewalls only allow tcp 443
+	if tWSS, errWSS := funcWSS(); errWSS == nil {
+		return tWSS, nil
+	}
 
 	// TODO: s2s won't return err
 	return nil, err
 }
 
 func (pn *P2PNetwork) newTunnel(config AppConfig, tid uint64, isClient bool) (t *P2PTunnel, err error) {
-	if isClient { // only client side find existing tunnel
+	if isClient && config.multipathTunnel == 0 { // only client side find existing tunnel
 		if existTunnel := pn.findTunnel(config.PeerNode); existTunnel != nil {
 			return existTunnel, nil
 		}
@@ -499,11 +561,16 @@ func (pn *P2PNetwork) init() error {
 	var err error
 	for {
 		// detect nat type
-		gConf.Network.publicIP, gConf.Network.natType, err = getNATType(gConf.Network.ServerHost, gConf.Network.UDPPort1, gConf.Network.UDPPort2)
+		var natBehavior NATBehavior
+		gConf.Network.publicIP, gConf.Network.natType, natBehavior, err = getNATType(gConf.Network.ServerHost, gConf.Network.UDPPort1, gConf.Network.UDPPort2)
 		if err != nil {
 			gLog.Println(LvDEBUG, "detect NAT type error:", err)
 			break
 		}
+		natBehavior.Lifetime = gConf.NATBehavior().Lifetime // measured once in background
+		gConf.setNATBehavior(natBehavior)
+		// delete the port mappings left by the last run
+		onceCleanPortMappings.Do(cleanPortMappings)
 		if gConf.Network.hasIPv4 == 0 && gConf.Network.hasUPNPorNATPMP == 0 { // if already has ipv4 or upnp no need test again
 			gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP = publicIPTest(gConf.Network.publicIP, gConf.Network.TCPPort)
 		}
@@ -513,6 +580,7 @@ func (pn *P2PNetwork) init() error {
 			gConf.Network.natType = NATSymmetric
 			gConf.Network.hasIPv4 = 0
 			gConf.Network.hasUPNPorNATPMP = 0
+			gConf.setNATBehavior(NATBehavior{Mapping: NATAddressAndPortDependent, Filtering: NATAddressAndPortDependent})
 			gLog.Println(LvINFO, "openp2pS2STest debug")
 
 		}
@@ -520,8 +588,23 @@ func (pn *P2PNetwork) init() error {
 			gConf.Network.natType = NATCone
 			gConf.Network.hasIPv4 = 0
 			gConf.Network.hasUPNPorNATPMP = 0
+			gConf.setNATBehavior(NATBehavior{Mapping: NATEndpointIndependent, Filtering: NATAddressAndPortDependent})
 			gLog.Println(LvINFO, "openp2pC2CTest debug")
 		}
+		if gConf.Network.hasIPv4 == 0 {
+			onceNATLifetime.Do(func() {
+				go func() {
+					if lifetime := natLifetimeTest(gConf.Network.ServerHost, gConf.Network.UDPPort1); lifetime > 0 {
+						b := gConf.NATBehavior()
+						b.Lifetime = lifetime
+						gConf.setNATBehavior(b)
+						if time.Duration(lifetime)*time.Second < TunnelHeartbeatTime {
+							gLog.Printf(LvWARN, "NAT mapping lifetime %ds is shorter than tunnel heartbeat, udp tunnels may break", lifetime)
+						}
+					}
+				}()
+			})
+		}
 
 		if gConf.Network.hasIPv4 == 1 || gConf.Network.hasUPNPorNATPMP == 1 {
 			onceV4Listener.Do(func() {
@@ -529,7 +612,13 @@ func (pn *P2PNetwork) init() error {
 				go v4l.start()
 			})
 		}
-		gLog.Printf(LvINFO, "hasIPv4:%d, UPNP:%d, NAT type:%d, publicIP:%s", gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP, gConf.Network.natType, gConf.Network.publicIP)
+		if gConf.Network.hasIPv4 == 1 && gConf.Network.WSSPort > 0 {
+			onceWSSListener.Do(func() {
+				wssl = &wssListener{port: gConf.Network.WSSPort}
+				go wssl.start()
+			})
+		}
+		gLog.Printf(LvINFO, "hasIPv4:%d, UPNP:%d, NAT type:%d, publicIP:%s, %s", gConf.Network.hasIPv4, gConf.Network.hasUPNPorNATPMP, gConf.Network.natType, gConf.Network.publicIP, natBehaviorString(gConf.NATBehavior()))
 		gatewayURL := fmt.Sprintf("%s:%d", gConf.Network.ServerHost, gConf.Network.ServerPort)
 		uri := "/api/v1/login"
 		caCertPool, errCert := x509.SystemCertPool()
@@ -544,6 +633,7 @@ func (pn *P2PNetwork) init() error {
 			InsecureSkipVerify: false} // let's encrypt root cert "DST Root CA X3" expired at 2021/09/29. many old system(windows server 2008 etc) will not trust our cert
 		websocket.DefaultDialer.TLSClientConfig = &config
 		websocket.DefaultDialer.HandshakeTimeout = ClientAPITimeout
+		websocket.DefaultDialer.Proxy = httpProxy
 		u := url.URL{Scheme: "wss", Host: gatewayURL, Path: uri}
 		q := u.Query()
 		q.Add("node", gConf.Network.Node)
@@ -551,6 +641,7 @@ func (pn *P2PNetwork) init() error {
 		q.Add("version", OpenP2PVersion)
 		q.Add("nattype", fmt.Sprintf("%d", gConf.Network.natType))
 		q.Add("sharebandwidth", fmt.Sprintf("%d", gConf.Network.ShareBandwidth))
+		q.Add("identity", localIdentity().String())
 		u.RawQuery = q.Encode()
 		var ws *websocket.Conn
 		ws, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
@@ -580,6 +671,9 @@ func (pn *P2PNetwork) init() error {
 				HasUPNPorNATPMP: gConf.Network.hasUPNPorNATPMP,
 				Version:         OpenP2PVersion,
 			}
+			if b := gConf.NATBehavior(); b.Mapping != NATBehaviorUnknown {
+				req.NatBehavior = &b
+			}
 			rsp := netInfo()
 			gLog.Println(LvDEBUG, "netinfo:", rsp)
 			if rsp != nil && rsp.Country != "" {
@@ -708,7 +802,7 @@ func (pn *P2PNetwork) write(mainType uint16, subType uint16, packet interface{})
 	return err
 }
 
-func (pn *P2PNetwork) relay(to uint64, body []byte) error {
+func (pn *P2PNetwork) relay(to uint64, body []byte, datagram bool) error {
 	i, ok := pn.allTunnels.Load(to)
 	if !ok {
 		return ErrRelayTunnelNotFound
@@ -717,11 +811,15 @@ func (pn *P2PNetwork) relay(to uint64, body []byte) error {
 	if tunnel.config.shareBandwidth > 0 {
 		pn.limiter.Add(len(body), true)
 	}
-	var err error
-	if err = tunnel.conn.WriteBuffer(body); err != nil {
-		gLog.Printf(LvERROR, "relay to %d len=%d error:%s", to, len(body), err)
+	if !datagram || !tunnel.writeDatagram(body) {
+		if err := tunnel.conn.WriteBuffer(body); err != nil {
+			gLog.Printf(LvERROR, "relay to %d len=%d error:%s", to, len(body), err)
+			return err
+		}
 	}
-	return err
+	tunnel.traffic.addTx(len(body))
+	gTraffic.relayed.addTx(len(body))
+	return nil
 }
 
 func (pn *P2PNetwork) push(to string, subType uint16, packet interface{}) error {
@@ -821,6 +919,17 @@ func (pn *P2PNetwork) updateAppHeartbeat(appID uint64) {
 	})
 }
 
+// end-to-end rtt of relay apps, measured by relay heartbeat ack
+func (pn *P2PNetwork) updateAppRelayRTT(appID uint64, seq uint64) {
+	pn.apps.Range(func(id, i interface{}) bool {
+		app := i.(*p2pApp)
+		if app.id == appID {
+			app.relayRTT.ack(seq)
+		}
+		return true
+	})
+}
+
 // ipv6 will expired need to refresh.
 func (pn *P2PNetwork) refreshIPv6() {
 	for i := 0; i < 2; i++ {
@@ -873,6 +982,11 @@ func (pn *P2PNetwork) requestPeerInfo(config *AppConfig) error {
 	config.peerIPv6 = rsp.IPv6
 	config.hasUPNPorNATPMP = rsp.HasUPNPorNATPMP
 	config.peerNatType = rsp.NatType
+	config.peerNatBehavior = NATBehavior{}
+	if rsp.NatBehavior != nil {
+		config.peerNatBehavior = *rsp.NatBehavior
+	}
+	config.peerIdentity = rsp.Identity
 	///
 	return nil
 }
@@ -917,18 +1031,21 @@ func (pn *P2PNetwork) WriteNode(nodeID uint64, buff []byte) error {
 	}
 	// TODO: move to app.write
 	gLog.Printf(LvDev, "%d tunnel write node data bodylen=%d, relay=%t", app.Tunnel().id, len(buff), !app.isDirect())
+	data, subType, relaySubType := sealNodeData(nodeID, buff)
+	// icmp goes to the small queue
+	small := len(buff) > 9 && buff[9] == 1
 	if app.isDirect() { // direct
-		app.Tunnel().asyncWriteNodeData(MsgP2P, MsgNodeData, buff)
+		app.Tunnel().asyncWriteNodeData(MsgP2P, subType, data, small)
 	} else { // relay
 		fromNodeIDHead := new(bytes.Buffer)
 		binary.Write(fromNodeIDHead, binary.LittleEndian, gConf.nodeID())
 		all := app.RelayHead().Bytes()
-		all = append(all, encodeHeader(MsgP2P, MsgRelayNodeData, uint32(len(buff)+overlayHeaderSize))...)
+		all = append(all, encodeHeader(MsgP2P, relaySubType, uint32(len(data)+overlayHeaderSize))...)
 		all = append(all, fromNodeIDHead.Bytes()...)
-		all = append(all, buff...)
-		app.Tunnel().asyncWriteNodeData(MsgP2P, MsgRelayData, all)
+		all = append(all, data...)
+		app.Tunnel().asyncWriteNodeData(MsgP2P, MsgRelayData, all, small)
 	}
-
+	countAppTx(app, len(buff), !app.isDirect())
 	return err
 }
 
@@ -951,16 +1068,21 @@ func (pn *P2PNetwork) WriteBroadcast(buff []byte) error {
 		if app.config.peerIP == gConf.Network.publicIP { // mostly in a lan
 			return true
 		}
+		countAppTx(app, len(buff), !app.isDirect())
+		metricSDWANRouted.inc("out")
+		data, subType, relaySubType := sealNodeData(id.(uint64), buff)
 		if app.isDirect() { // direct
-			app.Tunnel().conn.WriteBytes(MsgP2P, MsgNodeData, buff)
+			app.Tunnel().conn.WriteBytes(MsgP2P, subType, data)
+			app.Tunnel().traffic.addTx(len(data) + openP2PHeaderSize)
 		} else { // relay
 			fromNodeIDHead := new(bytes.Buffer)
 			binary.Write(fromNodeIDHead, binary.LittleEndian, gConf.nodeID())
 			all := app.RelayHead().Bytes()
-			all = append(all, encodeHeader(MsgP2P, MsgRelayNodeData, uint32(len(buff)+overlayHeaderSize))...)
+			all = append(all, encodeHeader(MsgP2P, relaySubType, uint32(len(data)+overlayHeaderSize))...)
 			all = append(all, fromNodeIDHead.Bytes()...)
-			all = append(all, buff...)
+			all = append(all, data...)
 			app.Tunnel().conn.WriteBytes(MsgP2P, MsgRelayData, all)
+			app.Tunnel().traffic.addTx(len(all) + openP2PHeaderSize)
 		}
 		return true
 	})
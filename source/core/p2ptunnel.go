@@ -32,10 +32,16 @@ type P2PTunnel struct {
 	tunnelServer   bool // different from underlayServer
 	coneLocalPort  int
 	coneNatPort    int
+	natPortBase    int // symmetric nat port allocation, the peer sprays the predicted ports
+	natPortDelta   int
 	linkModeWeb    string // use config.linkmode
 	punchTs        uint64
 	writeData      chan []byte
 	writeDataSmall chan []byte
+	traffic        TrafficStats
+	rtt            rttStats
+	kex            keyExchange
+	peerIdentity   string // verified in key exchange
 }
 
 func (t *P2PTunnel) initPort() {
@@ -50,6 +56,14 @@ func (t *P2PTunnel) initPort() {
 		_, natPort, _ := natTest(gConf.Network.ServerHost, gConf.Network.UDPPort1, localPort)
 		t.coneLocalPort = localPort
 		t.coneNatPort = natPort
+		if gConf.Network.natType == NATSymmetric {
+			t.natPortBase, t.natPortDelta = natPortPattern(gConf.Network.ServerHost, gConf.Network.UDPPort1)
+		}
+	}
+	if t.config.linkMode == LinkModeUDP6 {
+		// no nat on ipv6, the firewall lets the peer in after we send to it
+		t.coneLocalPort = localPort
+		t.coneNatPort = localPort
 	}
 	if t.config.linkMode == LinkModeTCPPunch {
 		// prepare one random cone hole by system automatically
@@ -58,6 +72,9 @@ func (t *P2PTunnel) initPort() {
 		t.coneNatPort = natPort
 	}
 	t.localHoleAddr = &net.UDPAddr{IP: net.ParseIP(gConf.Network.localIP), Port: t.coneLocalPort}
+	if t.config.linkMode == LinkModeUDP6 {
+		t.localHoleAddr = &net.UDPAddr{IP: net.ParseIP(gConf.IPv6()), Port: t.coneLocalPort} // the reported address, not a temporary one
+	}
 	gLog.Printf(LvDEBUG, "prepare punching port %d:%d", t.coneLocalPort, t.coneNatPort)
 }
 
@@ -84,6 +101,11 @@ func (t *P2PTunnel) connect() error {
 	if req.Token == 0 { // no relay token
 		req.Token = gConf.Network.Token
 	}
+	req.WSSPort, req.WSSCertHash = localWSS()
+	if b := gConf.NATBehavior(); b.Mapping != NATBehaviorUnknown {
+		req.NatBehavior = &b
+	}
+	req.NatPortBase, req.NatPortDelta = t.natPortBase, t.natPortDelta
 	GNetwork.push(t.config.PeerNode, MsgPushConnectReq, req)
 	head, body := GNetwork.read(t.config.PeerNode, MsgPush, MsgPushConnectRsp, UnderlayConnectTimeout*3)
 	if head == nil {
@@ -99,12 +121,18 @@ func (t *P2PTunnel) connect() error {
 		return errors.New(rsp.Detail)
 	}
 	t.config.peerNatType = rsp.NatType
+	if rsp.NatBehavior != nil {
+		t.config.peerNatBehavior = *rsp.NatBehavior
+	}
 	t.config.hasIPv4 = rsp.HasIPv4
 	t.config.peerIPv6 = rsp.IPv6
 	t.config.hasUPNPorNATPMP = rsp.HasUPNPorNATPMP
 	t.config.peerVersion = rsp.Version
 	t.config.peerConeNatPort = rsp.ConeNatPort
+	t.config.peerNatPortBase, t.config.peerNatPortDelta = rsp.NatPortBase, rsp.NatPortDelta
 	t.config.peerIP = rsp.FromIP
+	t.config.peerWSSPort = rsp.WSSPort
+	t.config.peerWSSCertHash = rsp.WSSCertHash
 	t.punchTs = rsp.PunchTs
 	err := t.start()
 	if err != nil {
@@ -169,11 +197,12 @@ func (t *P2PTunnel) close() {
 		t.conn.Close()
 	}
 	GNetwork.allTunnels.Delete(t.id)
+	deleteRelayPeers(t.id)
 	gLog.Printf(LvINFO, "%d p2ptunnel close %s ", t.id, t.config.LogPeerNode())
 }
 
 func (t *P2PTunnel) start() error {
-	if t.config.linkMode == LinkModeUDPPunch {
+	if t.config.linkMode == LinkModeUDPPunch || t.config.linkMode == LinkModeUDP6 {
 		if err := t.handshake(); err != nil {
 			return err
 		}
@@ -187,7 +216,9 @@ func (t *P2PTunnel) start() error {
 }
 
 func (t *P2PTunnel) handshake() error {
-	if t.config.peerConeNatPort > 0 { // only peer is cone should prepare t.ra
+	if t.config.linkMode == LinkModeUDP6 {
+		t.remoteHoleAddr = &net.UDPAddr{IP: net.ParseIP(t.config.peerIPv6), Port: t.config.peerConeNatPort}
+	} else if t.config.peerConeNatPort > 0 { // only peer is cone should prepare t.ra
 		var err error
 		t.remoteHoleAddr, err = net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", t.config.peerIP, t.config.peerConeNatPort))
 		if err != nil {
@@ -206,19 +237,29 @@ func (t *P2PTunnel) handshake() error {
 	}
 	gLog.Println(LvDEBUG, "handshake to ", t.config.LogPeerNode())
 	var err error
-	if gConf.Network.natType == NATCone && t.config.peerNatType == NATCone {
+	var method string
+	if t.config.linkMode == LinkModeUDP6 { // both sides send at the same time like cone
+		method = punchMethodUDP6
+		err = handshakeC2C(t)
+	} else if gConf.Network.natType == NATCone && t.config.peerNatType == NATCone {
+		method = punchMethodC2C
 		err = handshakeC2C(t)
 	} else if t.config.peerNatType == NATSymmetric && gConf.Network.natType == NATSymmetric {
+		method = punchMethodS2S
 		err = ErrorS2S
 		t.close()
 	} else if t.config.peerNatType == NATSymmetric && gConf.Network.natType == NATCone {
+		method = punchMethodC2S
 		err = handshakeC2S(t)
 	} else if t.config.peerNatType == NATCone && gConf.Network.natType == NATSymmetric {
+		method = punchMethodS2C
 		err = handshakeS2C(t)
 	} else {
 		return errors.New("unknown error")
 	}
+	metricPunchAttempts.inc(method)
 	if err != nil {
+		metricPunchFailures.inc(method)
 		gLog.Println(LvERROR, "punch handshake error:", err)
 		return err
 	}
@@ -233,16 +274,23 @@ func (t *P2PTunnel) connectUnderlay() (err error) {
 	case LinkModeTCP4:
 		t.conn, err = t.connectUnderlayTCP()
 	case LinkModeTCPPunch:
+		method := punchMethodTCP
 		if gConf.Network.natType == NATSymmetric || t.config.peerNatType == NATSymmetric {
+			method = punchMethodTCPSymmetric
 			t.conn, err = t.connectUnderlayTCPSymmetric()
 		} else {
 			t.conn, err = t.connectUnderlayTCP()
 		}
+		metricPunchAttempts.inc(method)
+		if err != nil || t.conn == nil {
+			metricPunchFailures.inc(method)
+		}
 	case LinkModeIntranet:
 		t.conn, err = t.connectUnderlayTCP()
-	case LinkModeUDPPunch:
+	case LinkModeUDPPunch, LinkModeUDP6:
 		t.conn, err = t.connectUnderlayUDP()
-
+	case LinkModeWSS:
+		t.conn, err = t.connectUnderlayWSS()
 	}
 	if err != nil {
 		return err
@@ -251,8 +299,12 @@ func (t *P2PTunnel) connectUnderlay() (err error) {
 		return errors.New("connect underlay error")
 	}
 	t.setRun(true)
+	t.startKeyExchange() // before readLoop, the peer's public key may come at once
 	go t.readLoop()
 	go t.writeLoop()
+	if du, ok := t.conn.(datagramUnderlay); ok {
+		go t.readDatagramLoop(du)
+	}
 	return nil
 }
 
@@ -305,7 +357,7 @@ func (t *P2PTunnel) connectUnderlayUDP() (c underlay, err error) {
 	if t.config.UnderlayProtocol == "kcp" {
 		ul, errL = dialKCP(conn, t.remoteHoleAddr, TunnelIdleTimeout)
 	} else {
-		ul, errL = dialQuic(conn, t.remoteHoleAddr, TunnelIdleTimeout)
+		ul, errL = dialQuic(conn, t.remoteHoleAddr, TunnelIdleTimeout, t.config.PeerNode, t.config.peerIdentity)
 	}
 
 	if errL != nil {
@@ -325,6 +377,9 @@ func (t *P2PTunnel) connectUnderlayUDP() (c underlay, err error) {
 	gLog.Println(LvINFO, "rtt=", time.Since(handshakeBegin))
 	gLog.Printf(LvINFO, "%s connection ok", underlayProtocol)
 	t.linkModeWeb = LinkModeUDPPunch
+	if t.config.linkMode == LinkModeUDP6 {
+		t.linkModeWeb = LinkModeIPv6
+	}
 	return ul, nil
 }
 
@@ -542,6 +597,7 @@ func (t *P2PTunnel) readLoop() {
 			}
 			break
 		}
+		t.traffic.addRx(int(head.DataLen) + openP2PHeaderSize)
 		if head.MainType != MsgP2P {
 			gLog.Printf(LvWARN, "%d head.MainType != MsgP2P", t.id)
 			continue
@@ -552,52 +608,46 @@ func (t *P2PTunnel) readLoop() {
 			t.hbMtx.Lock()
 			t.hbTime = time.Now()
 			t.hbMtx.Unlock()
-			t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeatAck, nil)
+			t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeatAck, body) // echo for peer's rtt
 			gLog.Printf(LvDev, "%d read tunnel heartbeat", t.id)
 		case MsgTunnelHeartbeatAck:
 			t.hbMtx.Lock()
 			t.hbTime = time.Now()
 			t.hbMtx.Unlock()
+			if len(body) >= tunnelHeartbeatSize {
+				hb := tunnelHeartbeat{}
+				binary.Read(bytes.NewReader(body), binary.LittleEndian, &hb)
+				if rtt, ok := t.rtt.ack(hb.Seq); ok {
+					gLog.Printf(LvDev, "%d read tunnel heartbeat ack rtt=%dms", t.id, rtt.Milliseconds())
+				}
+			}
 			gLog.Printf(LvDev, "%d read tunnel heartbeat ack", t.id)
 		case MsgOverlayData:
-			if len(body) < overlayHeaderSize {
-				gLog.Printf(LvWARN, "%d len(body) < overlayHeaderSize", t.id)
-				continue
-			}
-			overlayID := binary.LittleEndian.Uint64(body[:8])
-			gLog.Printf(LvDev, "%d tunnel read overlay data %d bodylen=%d", t.id, overlayID, head.DataLen)
-			s, ok := t.overlayConns.Load(overlayID)
-			if !ok {
-				// debug level, when overlay connection closed, always has some packet not found tunnel
-				gLog.Printf(LvDEBUG, "%d tunnel not found overlay connection %d", t.id, overlayID)
-				continue
-			}
-			overlayConn, ok := s.(*overlayConn)
-			if !ok {
-				continue
-			}
-			payload := body[overlayHeaderSize:]
-			var err error
-			if overlayConn.appKey != 0 {
-				payload, _ = decryptBytes(overlayConn.appKeyBytes, decryptData, body[overlayHeaderSize:], int(head.DataLen-uint32(overlayHeaderSize)))
-			}
-			_, err = overlayConn.Write(payload)
-			if err != nil {
-				gLog.Println(LvERROR, "overlay write error:", err)
-			}
+			t.handleOverlayData(head, body, decryptData)
 		case MsgNodeData:
-			t.handleNodeData(head, body, false)
+			t.handleNodeData(head, body, false, false)
 		case MsgRelayNodeData:
-			t.handleNodeData(head, body, true)
-		case MsgRelayData:
-			if len(body) < 8 {
+			t.handleNodeData(head, body, true, false)
+		case MsgNodeDataSealed:
+			t.handleNodeData(head, body, false, true)
+		case MsgRelayNodeDataSealed:
+			t.handleNodeData(head, body, true, true)
+		case MsgNodeKeyExchange:
+			req := KeyExchange{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
 				continue
 			}
-			tunnelID := binary.LittleEndian.Uint64(body[:8])
-			gLog.Printf(LvDev, "relay data to %d, len=%d", tunnelID, head.DataLen-RelayHeaderSize)
-			if err := GNetwork.relay(tunnelID, body[RelayHeaderSize:]); err != nil {
-				gLog.Printf(LvERROR, "%s:%d relay to %d len=%d error:%s", t.config.LogPeerNode(), t.id, tunnelID, len(body), ErrRelayTunnelNotFound)
+			t.handleNodeKeyExchange(&req)
+		case MsgNodeKeyExchangeAck:
+			req := KeyExchange{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
 			}
+			t.handleNodeKeyExchangeAck(&req)
+		case MsgRelayData:
+			t.handleRelayData(head, body, false)
 		case MsgRelayHeartbeat:
 			req := RelayHeartbeat{}
 			if err := json.Unmarshal(body, &req); err != nil {
@@ -620,50 +670,105 @@ func (t *P2PTunnel) readLoop() {
 			// TODO: debug relay heartbeat
 			gLog.Printf(LvDEBUG, "read MsgRelayHeartbeatAck to appid:%d", req.AppID)
 			GNetwork.updateAppHeartbeat(req.AppID)
+			GNetwork.updateAppRelayRTT(req.AppID, req.Seq)
+		case MsgTunnelKeyExchange:
+			req := KeyExchange{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			if err := verifyKeyExchange(&req, t.config.PeerNode, tunnelKeyLabel(t.id), t.config.peerIdentity); err != nil {
+				gLog.Printf(LvERROR, "%d tunnel %s %s, close it", t.id, t.config.LogPeerNode(), err)
+				t.close()
+				continue
+			}
+			t.peerIdentity = req.Identity
+			if err := t.kex.complete(req.Pub, tunnelKeyLabel(t.id)); err != nil {
+				gLog.Printf(LvERROR, "%d tunnel key exchange error:%s", t.id, err)
+				continue
+			}
+			gLog.Printf(LvDEBUG, "%d tunnel session key ready", t.id)
+		case MsgAppKeyExchange:
+			req := KeyExchange{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			go t.handleAppKeyExchange(&req)
+		case MsgAppKeyExchangeAck:
+			req := KeyExchange{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			GNetwork.updateAppSessionKey(&req)
 		case MsgOverlayConnectReq:
 			req := OverlayConnectReq{}
 			if err := json.Unmarshal(body, &req); err != nil {
 				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
 				continue
 			}
-			// app connect only accept token(not relay totp token), avoid someone using the share relay node's token
-			if req.Token != gConf.Network.Token {
-				gLog.Println(LvERROR, "Access Denied:", req.Token)
+			go t.handleOverlayConnectReq(&req) // dialing takes time, don't block readLoop
+		case MsgOverlayConnectRsp:
+			rsp := OverlayConnectRsp{}
+			if err := json.Unmarshal(body, &rsp); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(rsp), err)
 				continue
 			}
-
-			overlayID := req.ID
-			gLog.Printf(LvDEBUG, "App:%d overlayID:%d connect %s:%d", req.AppID, overlayID, req.DstIP, req.DstPort)
-			oConn := overlayConn{
-				tunnel:   t,
-				id:       overlayID,
-				isClient: false,
-				rtid:     req.RelayTunnelID,
-				appID:    req.AppID,
-				appKey:   GetKey(req.AppID),
-				running:  true,
+			i, ok := t.overlayConns.Load(rsp.ID)
+			if !ok {
+				continue
 			}
-			if req.Protocol == "udp" {
-				oConn.connUDP, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(req.DstIP), Port: req.DstPort})
-			} else {
-				oConn.connTCP, err = net.DialTimeout("tcp", fmt.Sprintf("%s:%d", req.DstIP, req.DstPort), ReadMsgTimeout)
-
+			if oConn := i.(*overlayConn); oConn.connectRsp != nil {
+				select {
+				case oConn.connectRsp <- &rsp:
+				default:
+				}
 			}
-			if err != nil {
-				gLog.Println(LvERROR, err)
+		case MsgOverlayWindowUpdate:
+			req := OverlayWindowUpdate{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
 				continue
 			}
-
-			// calc key bytes for encrypt
-			if oConn.appKey != 0 {
-				encryptKey := make([]byte, AESKeySize)
-				binary.LittleEndian.PutUint64(encryptKey, oConn.appKey)
-				binary.LittleEndian.PutUint64(encryptKey[8:], oConn.appKey)
-				oConn.appKeyBytes = encryptKey
+			if i, ok := t.overlayConns.Load(req.ID); ok {
+				i.(*overlayConn).updateWindow(&req)
 			}
-
-			t.overlayConns.Store(oConn.id, &oConn)
-			go oConn.run()
+		case MsgOverlayDataSeq:
+			if len(body) < overlayHeaderSize+8 {
+				gLog.Printf(LvWARN, "%d len(body) < overlayHeaderSize+8", t.id)
+				continue
+			}
+			overlayID := binary.LittleEndian.Uint64(body[:8])
+			gLog.Printf(LvDev, "%d tunnel read overlay seq data %d bodylen=%d", t.id, overlayID, head.DataLen)
+			s, ok := t.overlayConns.Load(overlayID)
+			if !ok {
+				gLog.Printf(LvDEBUG, "%d tunnel not found overlay connection %d", t.id, overlayID)
+				continue
+			}
+			overlayConn := s.(*overlayConn)
+			n, err := overlayConn.receiveSeq(body, decryptData)
+			if err == ErrOverlayWindowExceeded {
+				gLog.Printf(LvERROR, "%d tunnel overlay %d %s, close it", t.id, overlayID, err)
+				overlayConn.Close()
+			} else if err != nil {
+				gLog.Printf(LvWARN, "%d tunnel overlay %d %s, drop it", t.id, overlayID, err)
+			}
+			countAppRx(overlayConn.app, n, overlayConn.rtid != 0)
+		case MsgOverlayMigrate:
+			req := OverlayMigrateReq{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			t.handleOverlayMigrate(&req)
+		case MsgOverlayAddPath:
+			req := OverlayMigrateReq{}
+			if err := json.Unmarshal(body, &req); err != nil {
+				gLog.Printf(LvERROR, "wrong %v:%s", reflect.TypeOf(req), err)
+				continue
+			}
+			t.handleOverlayAddPath(&req)
 		case MsgOverlayDisconnectReq:
 			req := OverlayDisconnectReq{}
 			if err := json.Unmarshal(body, &req); err != nil {
@@ -695,18 +800,21 @@ func (t *P2PTunnel) writeLoop() {
 	for t.isRuning() {
 		select {
 		case buff := <-t.writeDataSmall:
-			t.conn.WriteBuffer(buff)
+			t.writeNodeData(buff)
+			t.traffic.addTx(len(buff))
 			// gLog.Printf(LvDEBUG, "write icmp %d", time.Now().Unix())
 		default:
 			select {
 			case buff := <-t.writeDataSmall:
-				t.conn.WriteBuffer(buff)
+				t.writeNodeData(buff)
+				t.traffic.addTx(len(buff))
 				// gLog.Printf(LvDEBUG, "write icmp %d", time.Now().Unix())
 			case buff := <-t.writeData:
-				t.conn.WriteBuffer(buff)
+				t.writeNodeData(buff)
+				t.traffic.addTx(len(buff))
 			case <-tc.C:
 				// tunnel send
-				err := t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, nil)
+				err := t.writeHeartbeat()
 				if err != nil {
 					gLog.Printf(LvERROR, "%d write tunnel heartbeat error %s", t.id, err)
 					t.close()
@@ -718,6 +826,14 @@ func (t *P2PTunnel) writeLoop() {
 	}
 }
 
+// timestamped heartbeat for rtt
+func (t *P2PTunnel) writeHeartbeat() error {
+	seq, ts := t.rtt.probe()
+	hb := new(bytes.Buffer)
+	binary.Write(hb, binary.LittleEndian, tunnelHeartbeat{Seq: seq, Ts: ts.UnixNano()})
+	return t.conn.WriteBytes(MsgP2P, MsgTunnelHeartbeat, hb.Bytes())
+}
+
 func (t *P2PTunnel) listen() error {
 	// notify client to connect
 	rsp := PushConnectRsp{
@@ -736,6 +852,11 @@ func (t *P2PTunnel) listen() error {
 		Version:         OpenP2PVersion,
 	}
 	t.punchTs = rsp.PunchTs
+	rsp.WSSPort, rsp.WSSCertHash = localWSS()
+	if b := gConf.NATBehavior(); b.Mapping != NATBehaviorUnknown {
+		rsp.NatBehavior = &b
+	}
+	rsp.NatPortBase, rsp.NatPortDelta = t.natPortBase, t.natPortDelta
 	// only private node set ipv6
 	if t.config.fromToken == gConf.Network.Token {
 		rsp.IPv6 = gConf.IPv6()
@@ -757,35 +878,251 @@ func (t *P2PTunnel) closeOverlayConns(appID uint64) {
 	})
 }
 
-func (t *P2PTunnel) handleNodeData(head *openP2PHeader, body []byte, isRelay bool) {
-	gLog.Printf(LvDev, "%d tunnel read node data bodylen=%d, relay=%t", t.id, head.DataLen, isRelay)
+// handleOverlayConnectReq dials the destination and answers the client, old clients ignore the answer
+func (t *P2PTunnel) handleOverlayConnectReq(req *OverlayConnectReq) {
+	oConn, code, err := t.dialOverlay(req)
+	rsp := OverlayConnectRsp{ID: req.ID, Error: code}
+	if oConn != nil && oConn.flowControl.Load() {
+		rsp.Window = OverlayWindowSize
+		if oConn.seqMode.Load() {
+			rsp.Migrate = 1
+			rsp.Multipath = oConn.multipathMode()
+		}
+	}
+	if err != nil {
+		rsp.Detail = err.Error()
+		gLog.Printf(LvERROR, "overlay %d connect %s:%d error:%s", req.ID, req.DstIP, req.DstPort, err)
+	}
+	t.WriteMessage(req.RelayTunnelID, MsgP2P, MsgOverlayConnectRsp, &rsp)
+	if oConn != nil {
+		oConn.run()
+	}
+}
+
+// legacyDenied is true once the peer is known to support aead: it exchanged a session key or
+// has a node identity. the legacy cipher uses appKey which the server knows, so a downgraded
+// request could come from anyone who reads it.
+func (t *P2PTunnel) legacyDenied(req *OverlayConnectReq) bool {
+	if req.RelayTunnelID == 0 {
+		return t.kex.sessionKey() != nil || t.peerIdentity != "" || t.config.peerIdentity != "" || trust().pinned(t.config.PeerNode)
+	}
+	node := relayPeer(t.id, req.RelayTunnelID)
+	return getAppSessionKey(node, req.AppID) != nil || (node != "" && trust().pinned(node))
+}
+
+func (t *P2PTunnel) dialOverlay(req *OverlayConnectReq) (*overlayConn, int, error) {
+	// app connect only accept token(not relay totp token), avoid someone using the share relay node's token
+	if req.Token != gConf.Network.Token {
+		gLog.Println(LvERROR, "Access Denied:", req.Token)
+		return nil, OverlayConnectDenied, errors.New("token not match")
+	}
+	if !isCipherSupported(req.Cipher) {
+		return nil, OverlayConnectDenied, fmt.Errorf("%w: %s", ErrCipherNotSupport, req.Cipher)
+	}
+	var sessionKey []byte
+	if req.Kex == KexX25519 {
+		sessionKey = t.kex.sessionKey()
+		if req.RelayTunnelID != 0 {
+			sessionKey = getAppSessionKey(relayPeer(t.id, req.RelayTunnelID), req.AppID)
+		}
+		if sessionKey == nil {
+			return nil, OverlayConnectDenied, ErrNoSessionKey
+		}
+	} else if req.Kex != "" {
+		return nil, OverlayConnectDenied, fmt.Errorf("kex %s not support", req.Kex)
+	} else if req.Cipher != CipherLegacy {
+		return nil, OverlayConnectDenied, ErrNoSessionKey // aead peers always exchange keys, appKey is known by the server
+	} else if t.legacyDenied(req) {
+		return nil, OverlayConnectDenied, ErrCipherDowngrade
+	}
+	gLog.Printf(LvDEBUG, "App:%d overlayID:%d connect %s:%d", req.AppID, req.ID, req.DstIP, req.DstPort)
+	oConn := overlayConn{
+		tunnel:   t,
+		id:       req.ID,
+		isClient: false,
+		rtid:     req.RelayTunnelID,
+		appID:    req.AppID,
+		appKey:   GetKey(req.AppID),
+	}
+	oConn.running.Store(true)
+	var err error
+	if req.Protocol == "udp" {
+		oConn.connUDP, err = net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP(req.DstIP), Port: req.DstPort})
+	} else {
+		oConn.connTCP, err = net.DialTimeout("tcp", fmt.Sprintf("%s:%d", req.DstIP, req.DstPort), ReadMsgTimeout)
+	}
+	if err != nil {
+		return nil, OverlayConnectDialFailed, err
+	}
+	if err = oConn.initCipher(req.Cipher, req.Salt, sessionKey); err != nil {
+		oConn.Close()
+		return nil, OverlayConnectDenied, err
+	}
+	if req.Window > 0 && req.Protocol != "udp" {
+		oConn.enableFlowControl(req.Window)
+		if req.Migrate == 1 {
+			oConn.enableMigration()
+			if isMultipathSupported(req.Multipath) {
+				oConn.enableMultipath(req.Multipath)
+			}
+		}
+	}
+	oConn.startDeliver()
+	t.overlayConns.Store(oConn.id, &oConn)
+	return &oConn, OverlayConnectOK, nil
+}
+
+func (t *P2PTunnel) handleNodeData(head *openP2PHeader, body []byte, isRelay bool, sealed bool) {
+	gLog.Printf(LvDev, "%d tunnel read node data bodylen=%d, relay=%t, sealed=%t", t.id, head.DataLen, isRelay, sealed)
 	ch := GNetwork.nodeData
 	// if body[9] == 1 { // TODO: deal relay
 	// 	ch = GNetwork.nodeDataSmall
 	// 	gLog.Printf(LvDEBUG, "read icmp %d", time.Now().Unix())
 	// }
+	nd := &NodeData{NodeNameToID(t.config.PeerNode), body} // TODO: cache peerNodeID
 	if isRelay {
-		fromPeerID := binary.LittleEndian.Uint64(body[:8])
-		ch <- &NodeData{fromPeerID, body[8:]} // TODO: cache peerNodeID; encrypt/decrypt
-	} else {
-		ch <- &NodeData{NodeNameToID(t.config.PeerNode), body} // TODO: cache peerNodeID; encrypt/decrypt
+		if len(body) < 8 {
+			return
+		}
+		nd = &NodeData{binary.LittleEndian.Uint64(body[:8]), body[8:]}
+	}
+	if sealed {
+		plain, err := getNodeKey(nd.NodeID).open(nd.Data)
+		if err != nil {
+			metricSDWANDropped.inc("decrypt")
+			gLog.Printf(LvDEBUG, "%d tunnel node data from %d %s, drop it", t.id, nd.NodeID, err)
+			return
+		}
+		nd.Data = plain
+	} else if findNodeCipher(nd.NodeID) != nil { // only old peers send plain
+		metricSDWANDropped.inc("decrypt")
+		gLog.Printf(LvDEBUG, "%d tunnel plain node data from %d, drop it", t.id, nd.NodeID)
+		return
+	}
+	var app *p2pApp
+	if i, ok := GNetwork.apps.Load(nd.NodeID); ok {
+		app = i.(*p2pApp)
+	}
+	countAppRx(app, len(nd.Data), isRelay)
+	ch <- nd
+}
+
+func (t *P2PTunnel) handleOverlayData(head *openP2PHeader, body []byte, decryptData []byte) {
+	if len(body) < overlayHeaderSize {
+		gLog.Printf(LvWARN, "%d len(body) < overlayHeaderSize", t.id)
+		return
+	}
+	overlayID := binary.LittleEndian.Uint64(body[:8])
+	gLog.Printf(LvDev, "%d tunnel read overlay data %d bodylen=%d", t.id, overlayID, head.DataLen)
+	s, ok := t.overlayConns.Load(overlayID)
+	if !ok {
+		// debug level, when overlay connection closed, always has some packet not found tunnel
+		gLog.Printf(LvDEBUG, "%d tunnel not found overlay connection %d", t.id, overlayID)
+		return
+	}
+	overlayConn, ok := s.(*overlayConn)
+	if !ok {
+		return
+	}
+	payload := body[overlayHeaderSize:]
+	var err error
+	if overlayConn.aead != nil {
+		if payload, err = overlayConn.aead.open(decryptData, body[overlayHeaderSize:], body[:overlayHeaderSize]); err != nil {
+			gLog.Printf(LvWARN, "%d tunnel overlay %d %s, drop it", t.id, overlayID, err)
+			return
+		}
+	} else if overlayConn.appKey != 0 {
+		payload, _ = decryptBytes(overlayConn.appKeyBytes, decryptData, body[overlayHeaderSize:], int(head.DataLen-uint32(overlayHeaderSize)))
+	}
+	if err = overlayConn.deliver(payload); err != nil {
+		gLog.Printf(LvERROR, "%d tunnel overlay %d %s, close it", t.id, overlayID, err)
+		overlayConn.Close()
+	}
+	countAppRx(overlayConn.app, len(payload), overlayConn.rtid != 0)
+}
+
+// handleRelayData forwards the message, a datagram is forwarded in a datagram
+func (t *P2PTunnel) handleRelayData(head *openP2PHeader, body []byte, datagram bool) {
+	if len(body) < 8 {
+		return
+	}
+	tunnelID := binary.LittleEndian.Uint64(body[:8])
+	gTraffic.relayed.addRx(len(body) - RelayHeaderSize)
+	gLog.Printf(LvDev, "relay data to %d, len=%d", tunnelID, head.DataLen-RelayHeaderSize)
+	if err := GNetwork.relay(tunnelID, body[RelayHeaderSize:], datagram); err != nil {
+		gLog.Printf(LvERROR, "%s:%d relay to %d len=%d error:%s", t.config.LogPeerNode(), t.id, tunnelID, len(body), ErrRelayTunnelNotFound)
+	}
+}
+
+// readDatagramLoop reads the messages which can be lost, sdwan packets and udp overlay data.
+// control messages always go through the stream.
+func (t *P2PTunnel) readDatagramLoop(du datagramUnderlay) {
+	decryptData := make([]byte, ReadBuffLen+PaddingSize)
+	for t.isRuning() {
+		buff, err := du.ReadDatagram()
+		if err != nil {
+			break
+		}
+		head, err := decodeHeader(buff)
+		if err != nil || head.MainType != MsgP2P || int(head.DataLen) != len(buff)-openP2PHeaderSize {
+			continue
+		}
+		body := buff[openP2PHeaderSize:]
+		t.traffic.addRx(len(buff))
+		metricDatagrams.inc("in")
+		switch head.SubType {
+		case MsgOverlayData:
+			t.handleOverlayData(head, body, decryptData)
+		case MsgNodeData:
+			t.handleNodeData(head, body, false, false)
+		case MsgRelayNodeData:
+			t.handleNodeData(head, body, true, false)
+		case MsgNodeDataSealed:
+			t.handleNodeData(head, body, false, true)
+		case MsgRelayNodeDataSealed:
+			t.handleNodeData(head, body, true, true)
+		case MsgRelayData:
+			t.handleRelayData(head, body, true)
+		}
+	}
+	gLog.Printf(LvDEBUG, "%d tunnel datagram readloop end", t.id)
+}
+
+// writeDatagram sends a whole message in a datagram, false if the underlay or the peer
+// doesn't support it or it's too large, the caller writes it to the stream then
+func (t *P2PTunnel) writeDatagram(buff []byte) bool {
+	du, ok := t.conn.(datagramUnderlay)
+	if !ok || du.WriteDatagram(buff) != nil {
+		return false
+	}
+	metricDatagrams.inc("out")
+	return true
+}
+
+func (t *P2PTunnel) writeNodeData(buff []byte) {
+	if !t.writeDatagram(buff) {
+		t.conn.WriteBuffer(buff)
 	}
 }
 
-func (t *P2PTunnel) asyncWriteNodeData(mainType, subType uint16, data []byte) {
+func (t *P2PTunnel) asyncWriteNodeData(mainType, subType uint16, data []byte, small bool) {
 	writeBytes := append(encodeHeader(mainType, subType, uint32(len(data))), data...)
 	// if len(data) < 192 {
-	if data[9] == 1 { // icmp
+	if small { // icmp
 		select {
 		case t.writeDataSmall <- writeBytes:
+			metricSDWANRouted.inc("out")
 			// gLog.Printf(LvWARN, "%s:%d t.writeDataSmall write %d", t.config.PeerNode, t.id, len(t.writeDataSmall))
 		default:
+			metricSDWANDropped.inc("queue_full")
 			gLog.Printf(LvWARN, "%s:%d t.writeDataSmall is full, drop it", t.config.LogPeerNode(), t.id)
 		}
 	} else {
 		select {
 		case t.writeData <- writeBytes:
+			metricSDWANRouted.inc("out")
 		default:
+			metricSDWANDropped.inc("queue_full")
 			gLog.Printf(LvWARN, "%s:%d t.writeData is full, drop it", t.config.LogPeerNode(), t.id)
 		}
 	}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -22,3 +23,41 @@ func TestSelectPriority(t *testing.T) {
 	}
 
 }
+
+func TestUDP6Handshake(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		l, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+		if err != nil {
+			t.Skip("ipv6 unavailable:", err)
+		}
+		ports = append(ports, l.LocalAddr().(*net.UDPAddr).Port)
+		l.Close()
+	}
+	tunnels := []*P2PTunnel{}
+	for i := 0; i < 2; i++ {
+		tunnel := &P2PTunnel{id: 1, coneLocalPort: ports[i], coneNatPort: ports[i]}
+		tunnel.config.linkMode = LinkModeUDP6
+		tunnel.config.peerIPv6 = "::1"
+		tunnel.config.peerConeNatPort = ports[i^1]
+		tunnel.localHoleAddr = &net.UDPAddr{IP: net.IPv6loopback, Port: ports[i]}
+		tunnels = append(tunnels, tunnel)
+	}
+	errCh := make(chan error, 2)
+	for _, tunnel := range tunnels {
+		go func(tunnel *P2PTunnel) { errCh <- tunnel.handshake() }(tunnel)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatal("handshake error:", err)
+		}
+	}
+	for i, tunnel := range tunnels {
+		if tunnel.remoteHoleAddr.Port != ports[i^1] || !tunnel.remoteHoleAddr.IP.Equal(net.IPv6loopback) {
+			t.Errorf("%d remote hole %s", i, tunnel.remoteHoleAddr)
+		}
+	}
+}
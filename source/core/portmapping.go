@@ -0,0 +1,226 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// the port mapping manager keeps the UPnP, NAT-PMP and PCP mappings alive until shutdown. they are
+// persisted, so a restart after crash deletes the stale ones.
+
+const (
+	portMappingLifetime   = 7200 // seconds, renewed at half
+	portMappingRetryDelay = time.Minute
+	portMappingFile       = "portmappings.json"
+)
+
+var portMappingCheckTime = time.Minute // detect the gateway reboot
+
+// natKinds are tried in order by publicIPTest
+var natKinds = []struct {
+	name     string
+	discover func() (NAT, error)
+}{
+	{"UPNP", Discover},
+	{"NAT-PMP", discoverNATPMP},
+	{"PCP", discoverPCP},
+}
+
+func natKind(nat NAT) string {
+	switch nat.(type) {
+	case *natPMP:
+		return "NAT-PMP"
+	case *pcpNAT:
+		return "PCP"
+	}
+	return "UPNP"
+}
+
+func discoverNAT(kind string) (NAT, error) {
+	for _, k := range natKinds {
+		if k.name == kind {
+			return k.discover()
+		}
+	}
+	return nil, fmt.Errorf("unknown nat %s", kind)
+}
+
+type portMapping struct {
+	nat        NAT
+	protocol   string
+	port       int // same internal and external port
+	lifetime   int
+	externalIP net.IP
+	stop       chan struct{}
+}
+
+// portMappingState is the persisted mapping
+type portMappingState struct {
+	NAT      string `json:"nat"`
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	Nonce    []byte `json:"nonce,omitempty"` // pcp deletes with the nonce of the mapping
+}
+
+var (
+	portMappings   = map[string]*portMapping{}
+	portMappingMtx sync.Mutex
+)
+
+// addPortMapping maps the same external port, the peers connect to it as the public port
+func addPortMapping(nat NAT, protocol string, port int, lifetime int) error {
+	mapped, err := nat.AddPortMapping(protocol, port, port, "openp2p", lifetime)
+	if err != nil {
+		return err
+	}
+	if mapped != port {
+		nat.DeletePortMapping(protocol, mapped, port)
+		return fmt.Errorf("port mapping %s %d got external port %d", protocol, port, mapped)
+	}
+	m := &portMapping{nat: nat, protocol: protocol, port: port, lifetime: lifetime, stop: make(chan struct{})}
+	m.externalIP, _ = nat.GetExternalAddress()
+	key := fmt.Sprintf("%s:%d", protocol, port)
+	portMappingMtx.Lock()
+	if old := portMappings[key]; old != nil {
+		close(old.stop)
+	}
+	portMappings[key] = m
+	savePortMappings()
+	portMappingMtx.Unlock()
+	go m.keepLoop()
+	return nil
+}
+
+func (m *portMapping) keepLoop() {
+	renewTime := time.Now().Add(time.Duration(m.lifetime) * time.Second / 2)
+	check := portMappingCheckTime
+	if half := time.Duration(m.lifetime) * time.Second / 2; half < check {
+		check = half
+	}
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-time.After(check):
+		}
+		rebooted := m.gatewayRebooted()
+		if !rebooted && time.Now().Before(renewTime) {
+			continue
+		}
+		if rebooted {
+			gLog.Printf(LvINFO, "gateway rebooted, re-create port mapping %s %d", m.protocol, m.port)
+		}
+		if err := m.renew(); err != nil {
+			gLog.Printf(LvWARN, "renew port mapping %s %d error:%s", m.protocol, m.port, err)
+			renewTime = time.Now().Add(portMappingRetryDelay)
+			continue
+		}
+		renewTime = time.Now().Add(time.Duration(m.lifetime) * time.Second / 2)
+	}
+}
+
+// gatewayRebooted checks the epoch of NAT-PMP and PCP, the external ip of UPnP
+func (m *portMapping) gatewayRebooted() bool {
+	if d, ok := m.nat.(natRebootDetector); ok {
+		rebooted, err := d.rebooted()
+		return err == nil && rebooted
+	}
+	ip, err := m.nat.GetExternalAddress()
+	if err != nil || ip == nil {
+		return false
+	}
+	changed := m.externalIP != nil && !ip.Equal(m.externalIP)
+	m.externalIP = ip
+	return changed
+}
+
+// renew maps again, the gateway may be rediscovered after reboot with another service url
+func (m *portMapping) renew() error {
+	_, err := m.nat.AddPortMapping(m.protocol, m.port, m.port, "openp2p", m.lifetime)
+	if err == nil {
+		return nil
+	}
+	nat, errDiscover := discoverNAT(natKind(m.nat))
+	if errDiscover != nil {
+		return err
+	}
+	if _, err = nat.AddPortMapping(m.protocol, m.port, m.port, "openp2p", m.lifetime); err != nil {
+		return err
+	}
+	portMappingMtx.Lock()
+	m.nat = nat
+	savePortMappings()
+	portMappingMtx.Unlock()
+	return nil
+}
+
+func deletePortMappings() {
+	portMappingMtx.Lock()
+	defer portMappingMtx.Unlock()
+	for key, m := range portMappings {
+		close(m.stop)
+		if err := m.nat.DeletePortMapping(m.protocol, m.port, m.port); err != nil {
+			gLog.Printf(LvDEBUG, "delete port mapping %s error:%s", key, err)
+		}
+		delete(portMappings, key)
+	}
+	savePortMappings()
+}
+
+// savePortMappings must be called with portMappingMtx
+func savePortMappings() {
+	if len(portMappings) == 0 {
+		os.Remove(portMappingFile)
+		return
+	}
+	states := []portMappingState{}
+	for _, m := range portMappings {
+		s := portMappingState{NAT: natKind(m.nat), Protocol: m.protocol, Port: m.port}
+		if p, ok := m.nat.(*pcpNAT); ok {
+			s.Nonce = p.nonce(m.protocol, m.port)
+		}
+		states = append(states, s)
+	}
+	data, _ := json.MarshalIndent(states, "", "  ")
+	if err := writeFileAtomic(portMappingFile, data, 0644); err != nil {
+		gLog.Printf(LvERROR, "save %s error:%s", portMappingFile, err)
+	}
+}
+
+// cleanPortMappings deletes the mappings left by the last run, it crashed or changed the port
+func cleanPortMappings() {
+	data, err := os.ReadFile(portMappingFile)
+	if err != nil {
+		return
+	}
+	states := []portMappingState{}
+	json.Unmarshal(data, &states)
+	nats := map[string]NAT{}
+	for _, s := range states {
+		nat, ok := nats[s.NAT]
+		if !ok {
+			if nat, err = discoverNAT(s.NAT); err != nil {
+				gLog.Printf(LvDEBUG, "clean port mapping %s %d discover error:%s", s.Protocol, s.Port, err)
+			}
+			nats[s.NAT] = nat
+		}
+		if nat == nil {
+			continue
+		}
+		if p, ok := nat.(*pcpNAT); ok && s.Nonce != nil {
+			p.setNonce(s.Protocol, s.Port, s.Nonce)
+		}
+		if err = nat.DeletePortMapping(s.Protocol, s.Port, s.Port); err == nil {
+			gLog.Printf(LvINFO, "delete stale port mapping %s %s %d", s.NAT, s.Protocol, s.Port)
+		}
+	}
+	portMappingMtx.Lock()
+	if len(portMappings) == 0 {
+		os.Remove(portMappingFile)
+	}
+	portMappingMtx.Unlock()
+}
@@ -10,7 +10,7 @@ import (
 	"time"
 )
 
-const OpenP2PVersion = "3.21.12"
+const OpenP2PVersion = "3.22.0"
 const ProductName string = "openp2p"
 const LeastSupportVersion = "3.0.0"
 const SyncServerTimeVersion = "3.9.0"
@@ -18,6 +18,11 @@ const SymmetricSimultaneouslySendVersion = "3.10.7"
 const PublicIPVersion = "3.11.2"
 const SupportIntranetVersion = "3.14.5"
 const SupportDualTunnelVersion = "3.15.5"
+const SupportAEADVersion = "3.22.0"
+const SupportOverlayConnectRspVersion = "3.22.0"
+const SupportWSSVersion = "3.22.0"
+const SupportUDP6Version = "3.22.0"
+const SupportMultipathVersion = "3.22.0"
 
 const (
 	IfconfigPort1 = 27180
@@ -44,6 +49,15 @@ var PushHeaderSize = binary.Size(PushHeader{})
 
 const RelayHeaderSize = 8
 
+// body of MsgTunnelHeartbeat, the peer echo it in MsgTunnelHeartbeatAck.
+// old versions send empty heartbeat and ack.
+type tunnelHeartbeat struct {
+	Seq uint64
+	Ts  int64 // sender UnixNano
+}
+
+var tunnelHeartbeatSize = binary.Size(tunnelHeartbeat{})
+
 type overlayHeader struct {
 	id uint64
 }
@@ -109,6 +123,7 @@ const (
 	MsgPushReportMemApps        = 17
 	MsgPushServerSideSaveMemApp = 18
 	MsgPushCheckRemoteService   = 19
+	MsgPushRevokedIdentities    = 20
 )
 
 // MsgP2P sub type message
@@ -128,6 +143,17 @@ const (
 	MsgRelayHeartbeatAck
 	MsgNodeData
 	MsgRelayNodeData
+	MsgTunnelKeyExchange
+	MsgAppKeyExchange
+	MsgAppKeyExchangeAck
+	MsgNodeKeyExchange
+	MsgNodeKeyExchangeAck
+	MsgNodeDataSealed
+	MsgRelayNodeDataSealed
+	MsgOverlayWindowUpdate
+	MsgOverlayDataSeq
+	MsgOverlayMigrate
+	MsgOverlayAddPath
 )
 
 // MsgRelay sub type message
@@ -157,6 +183,7 @@ const (
 	SymmetricHandshakeNum     = 800 // 0.992379
 	// SymmetricHandshakeNum        = 1000 // 0.999510
 	SymmetricHandshakeInterval = time.Millisecond
+	NatPortProbeNum            = 5 // new sockets to learn the port allocation stride of symmetric nat
 	HandshakeTimeout           = time.Second * 7
 	PunchTsDelay               = time.Second * 3
 	PeerAddRelayTimeount       = time.Second * 30 // peer need times. S2C\TCP\TCP Punch\UDP Punch
@@ -169,9 +196,18 @@ const (
 	Cone2ConeUDPPunchMaxRetry  = 1
 	PublicIPEchoTimeout        = time.Second * 3
 	NatTestTimeout             = time.Second * 5
+	NatProbeTimeout            = time.Second // a behavior probe, retransmitted NatProbeRetry times
+	NatProbeRetry              = 3
 	UDPReadTimeout             = time.Second * 5
 	ClientAPITimeout           = time.Second * 10
 	UnderlayConnectTimeout     = time.Second * 10
+	OverlayConnectTimeout      = ReadMsgTimeout * 2 // peer dial timeout and relay
+	OverlayWindowSize          = 1024 * 1024 * 4    // receive window of a tcp overlay
+	OverlayPacketCost          = ReadBuffLen        // minimum credit of a packet, bounds the receive queue length
+	OverlayMigrateTimeout      = time.Second * 20   // overlay waits for another tunnel after its tunnel closed
+	KeyExchangeTimeout         = ReadMsgTimeout     // overlay of an aead peer waits for the session key
+	WSSPort                    = 443
+	WSSPath                    = "/openp2p"
 	MaxDirectTry               = 3
 
 	// sdwan
@@ -187,11 +223,33 @@ const (
 	NATUnknown   = 314
 )
 
+// nat mapping and filtering behavior, RFC 5780
+const (
+	NATBehaviorUnknown         = 0
+	NATEndpointIndependent     = 1
+	NATAddressDependent        = 2
+	NATAddressAndPortDependent = 3
+)
+
+const (
+	NATHairpinUnknown = 0
+	NATHairpinYes     = 1
+	NATHairpinNo      = 2
+)
+
+type NATBehavior struct {
+	Mapping   int `json:"mapping,omitempty"`
+	Filtering int `json:"filtering,omitempty"`
+	Hairpin   int `json:"hairpin,omitempty"`
+	Lifetime  int `json:"lifetime,omitempty"` // seconds of an idle udp mapping, 0 unknown
+}
+
 // underlay protocol
 const (
 	UderlayAuto = "auto"
 	UderlayQUIC = "quic"
 	UderlayTCP  = "tcp"
+	UderlayWSS  = "wss" // tls websocket, for firewalls only allowing tcp 443
 )
 
 // linkmode
@@ -205,6 +263,7 @@ const (
 	LinkModeTCP4     = "tcp4"
 	LinkModeUDP6     = "udp6"
 	LinkModeUDP4     = "udp4"
+	LinkModeWSS      = "wss"
 )
 
 const (
@@ -248,39 +307,49 @@ func NodeNameToID(name string) uint64 {
 }
 
 type PushConnectReq struct {
-	From             string `json:"from,omitempty"`
-	FromToken        uint64 `json:"fromToken,omitempty"` // deprecated
-	Version          string `json:"version,omitempty"`
-	Token            uint64 `json:"token,omitempty"`       // if public totp token
-	ConeNatPort      int    `json:"coneNatPort,omitempty"` // if isPublic, is public port
-	NatType          int    `json:"natType,omitempty"`
-	HasIPv4          int    `json:"hasIPv4,omitempty"`
-	IPv6             string `json:"IPv6,omitempty"`
-	HasUPNPorNATPMP  int    `json:"hasUPNPorNATPMP,omitempty"`
-	FromIP           string `json:"fromIP,omitempty"`
-	ID               uint64 `json:"id,omitempty"`
-	AppKey           uint64 `json:"appKey,omitempty"` // for underlay tcp
-	LinkMode         string `json:"linkMode,omitempty"`
-	IsUnderlayServer int    `json:"isServer,omitempty"`         // Requset spec peer is server
-	UnderlayProtocol string `json:"underlayProtocol,omitempty"` // quic or kcp, default quic
+	From             string       `json:"from,omitempty"`
+	FromToken        uint64       `json:"fromToken,omitempty"` // deprecated
+	Version          string       `json:"version,omitempty"`
+	Token            uint64       `json:"token,omitempty"`       // if public totp token
+	ConeNatPort      int          `json:"coneNatPort,omitempty"` // if isPublic, is public port
+	NatType          int          `json:"natType,omitempty"`
+	HasIPv4          int          `json:"hasIPv4,omitempty"`
+	IPv6             string       `json:"IPv6,omitempty"`
+	HasUPNPorNATPMP  int          `json:"hasUPNPorNATPMP,omitempty"`
+	FromIP           string       `json:"fromIP,omitempty"`
+	ID               uint64       `json:"id,omitempty"`
+	AppKey           uint64       `json:"appKey,omitempty"` // for underlay tcp
+	LinkMode         string       `json:"linkMode,omitempty"`
+	IsUnderlayServer int          `json:"isServer,omitempty"`         // Requset spec peer is server
+	UnderlayProtocol string       `json:"underlayProtocol,omitempty"` // quic, kcp or wss, default quic
+	WSSPort          int          `json:"wssPort,omitempty"`          // listening wss underlay
+	WSSCertHash      string       `json:"wssCertHash,omitempty"`      // sha256 of its self-signed cert
+	NatBehavior      *NATBehavior `json:"natBehavior,omitempty"`
+	NatPortBase      int          `json:"natPortBase,omitempty"`  // symmetric nat: last mapped port of the allocation probe
+	NatPortDelta     int          `json:"natPortDelta,omitempty"` // symmetric nat: port allocation stride, 0 random
 }
 type PushDstNodeOnline struct {
 	Node string `json:"node,omitempty"`
 }
 type PushConnectRsp struct {
-	Error           int    `json:"error,omitempty"`
-	From            string `json:"from,omitempty"`
-	To              string `json:"to,omitempty"`
-	Detail          string `json:"detail,omitempty"`
-	NatType         int    `json:"natType,omitempty"`
-	HasIPv4         int    `json:"hasIPv4,omitempty"`
-	IPv6            string `json:"IPv6,omitempty"` // if public relay node, ipv6 not set
-	HasUPNPorNATPMP int    `json:"hasUPNPorNATPMP,omitempty"`
-	ConeNatPort     int    `json:"coneNatPort,omitempty"` //it's not only cone, but also upnp or nat-pmp hole
-	FromIP          string `json:"fromIP,omitempty"`
-	ID              uint64 `json:"id,omitempty"`
-	PunchTs         uint64 `json:"punchts,omitempty"` // server timestamp
-	Version         string `json:"version,omitempty"`
+	Error           int          `json:"error,omitempty"`
+	From            string       `json:"from,omitempty"`
+	To              string       `json:"to,omitempty"`
+	Detail          string       `json:"detail,omitempty"`
+	NatType         int          `json:"natType,omitempty"`
+	HasIPv4         int          `json:"hasIPv4,omitempty"`
+	IPv6            string       `json:"IPv6,omitempty"` // if public relay node, ipv6 not set
+	HasUPNPorNATPMP int          `json:"hasUPNPorNATPMP,omitempty"`
+	ConeNatPort     int          `json:"coneNatPort,omitempty"` //it's not only cone, but also upnp or nat-pmp hole
+	FromIP          string       `json:"fromIP,omitempty"`
+	ID              uint64       `json:"id,omitempty"`
+	PunchTs         uint64       `json:"punchts,omitempty"` // server timestamp
+	Version         string       `json:"version,omitempty"`
+	WSSPort         int          `json:"wssPort,omitempty"`
+	WSSCertHash     string       `json:"wssCertHash,omitempty"`
+	NatBehavior     *NATBehavior `json:"natBehavior,omitempty"`
+	NatPortBase     int          `json:"natPortBase,omitempty"`
+	NatPortDelta    int          `json:"natPortDelta,omitempty"`
 }
 type PushRsp struct {
 	Error  int    `json:"error,omitempty"`
@@ -298,14 +367,18 @@ type LoginRsp struct {
 }
 
 type NatDetectReq struct {
-	SrcPort  int `json:"srcPort,omitempty"`
-	EchoPort int `json:"echoPort,omitempty"`
+	SrcPort    int  `json:"srcPort,omitempty"`
+	EchoPort   int  `json:"echoPort,omitempty"`
+	ChangeIP   bool `json:"changeIP,omitempty"`   // reply from the alternate ip
+	ChangePort bool `json:"changePort,omitempty"` // reply from the alternate port
 }
 
 type NatDetectRsp struct {
 	IP         string `json:"IP,omitempty"`
 	Port       int    `json:"port,omitempty"`
 	IsPublicIP int    `json:"isPublicIP,omitempty"`
+	OtherIP    string `json:"otherIP,omitempty"`   // alternate ip of the server, empty if it has only one
+	OtherPort  int    `json:"otherPort,omitempty"` // alternate port, 0 by old servers
 }
 
 type P2PHandshakeReq struct {
@@ -320,6 +393,42 @@ type OverlayConnectReq struct {
 	Protocol      string `json:"protocol,omitempty"`
 	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // if not 0 relay
 	AppID         uint64 `json:"appID,omitempty"`
+	Cipher        string `json:"cipher,omitempty"`    // empty is legacy aes-cbc
+	Salt          []byte `json:"salt,omitempty"`      // for aead key derivation
+	Kex           string `json:"kex,omitempty"`       // x25519: aead keys from the end-to-end session key
+	Window        int    `json:"window,omitempty"`    // receive window for flow control, 0 if not support
+	Migrate       int    `json:"migrate,omitempty"`   // 1: seq numbered data, the overlay can move to another tunnel
+	Multipath     string `json:"multipath,omitempty"` // redundant or aggregate, needs migrate
+}
+
+// OverlayConnectRsp.Error
+const (
+	OverlayConnectOK = iota
+	OverlayConnectDenied
+	OverlayConnectDialFailed
+)
+
+type OverlayConnectRsp struct {
+	ID        uint64 `json:"id,omitempty"`
+	Error     int    `json:"error,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+	Window    int    `json:"window,omitempty"`
+	Migrate   int    `json:"migrate,omitempty"`
+	Multipath string `json:"multipath,omitempty"`
+}
+
+// the receiver returns credits after writing the data to the destination
+type OverlayWindowUpdate struct {
+	ID       uint64 `json:"id,omitempty"`
+	Consumed int64  `json:"consumed,omitempty"` // cumulative credits
+	Ack      uint64 `json:"ack,omitempty"`      // last seq received, migration only
+}
+
+// moves the overlay to the tunnel this message arrived on, or adds it as another path
+type OverlayMigrateReq struct {
+	ID            uint64 `json:"id,omitempty"`
+	Token         uint64 `json:"token,omitempty"`
+	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // if not 0 relay
 }
 type OverlayDisconnectReq struct {
 	ID uint64 `json:"id,omitempty"`
@@ -329,7 +438,9 @@ type TunnelMsg struct {
 }
 
 type RelayNodeReq struct {
-	PeerNode string `json:"peerNode,omitempty"`
+	PeerNode  string   `json:"peerNode,omitempty"`
+	RelayNode string   `json:"relayNode,omitempty"` // pinned relay node
+	Exclude   []string `json:"exclude,omitempty"`   // relay nodes in use, multipath asks for another one
 }
 
 type RelayNodeRsp struct {
@@ -353,21 +464,37 @@ type APPKeySync struct {
 	AppKey uint64 `json:"appKey,omitempty"`
 }
 
+type KeyExchange struct {
+	Pub           []byte `json:"pub,omitempty"` // x25519 public key
+	AppID         uint64 `json:"appID,omitempty"`
+	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"` // for app key exchange ack
+	Node          string `json:"node,omitempty"`
+	Identity      string `json:"identity,omitempty"` // ed25519 public key of node
+	Sig           []byte `json:"sig,omitempty"`      // identity signature of label and pub
+}
+
+type RevokedIdentities struct {
+	Identities []string `json:"identities,omitempty"`
+}
+
 type RelayHeartbeat struct {
 	From          string `json:"from,omitempty"`
 	RelayTunnelID uint64 `json:"relayTunnelID,omitempty"`
 	AppID         uint64 `json:"appID,omitempty"`
+	Seq           uint64 `json:"seq,omitempty"` // echoed in ack for rtt
+	Ts            int64  `json:"ts,omitempty"`
 }
 
 type ReportBasic struct {
-	OS              string  `json:"os,omitempty"`
-	Mac             string  `json:"mac,omitempty"`
-	LanIP           string  `json:"lanIP,omitempty"`
-	HasIPv4         int     `json:"hasIPv4,omitempty"`
-	IPv6            string  `json:"IPv6,omitempty"`
-	HasUPNPorNATPMP int     `json:"hasUPNPorNATPMP,omitempty"`
-	Version         string  `json:"version,omitempty"`
-	NetInfo         NetInfo `json:"netInfo,omitempty"`
+	OS              string       `json:"os,omitempty"`
+	Mac             string       `json:"mac,omitempty"`
+	LanIP           string       `json:"lanIP,omitempty"`
+	HasIPv4         int          `json:"hasIPv4,omitempty"`
+	IPv6            string       `json:"IPv6,omitempty"`
+	HasUPNPorNATPMP int          `json:"hasUPNPorNATPMP,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	NetInfo         NetInfo      `json:"netInfo,omitempty"`
+	NatBehavior     *NATBehavior `json:"natBehavior,omitempty"`
 }
 
 type ReportConnect struct {
@@ -387,31 +514,35 @@ type ReportConnect struct {
 }
 
 type AppInfo struct {
-	AppName        string `json:"appName,omitempty"`
-	Error          string `json:"error,omitempty"`
-	Protocol       string `json:"protocol,omitempty"`
-	PunchPriority  int    `json:"punchPriority,omitempty"`
-	Whitelist      string `json:"whitelist,omitempty"`
-	SrcPort        int    `json:"srcPort,omitempty"`
-	Protocol0      string `json:"protocol0,omitempty"`
-	SrcPort0       int    `json:"srcPort0,omitempty"` // srcport+protocol is uneque, use as old app id
-	NatType        int    `json:"natType,omitempty"`
-	PeerNode       string `json:"peerNode,omitempty"`
-	DstPort        int    `json:"dstPort,omitempty"`
-	DstHost        string `json:"dstHost,omitempty"`
-	PeerUser       string `json:"peerUser,omitempty"`
-	PeerNatType    int    `json:"peerNatType,omitempty"`
-	PeerIP         string `json:"peerIP,omitempty"`
-	ShareBandwidth int    `json:"shareBandWidth,omitempty"`
-	RelayNode      string `json:"relayNode,omitempty"`
-	SpecRelayNode  string `json:"specRelayNode,omitempty"`
-	RelayMode      string `json:"relayMode,omitempty"`
-	LinkMode       string `json:"linkMode,omitempty"`
-	Version        string `json:"version,omitempty"`
-	RetryTime      string `json:"retryTime,omitempty"`
-	ConnectTime    string `json:"connectTime,omitempty"`
-	IsActive       int    `json:"isActive,omitempty"`
-	Enabled        int    `json:"enabled,omitempty"`
+	AppName         string       `json:"appName,omitempty"`
+	Error           string       `json:"error,omitempty"`
+	Protocol        string       `json:"protocol,omitempty"`
+	PunchPriority   int          `json:"punchPriority,omitempty"`
+	Whitelist       string       `json:"whitelist,omitempty"`
+	SrcPort         int          `json:"srcPort,omitempty"`
+	Protocol0       string       `json:"protocol0,omitempty"`
+	SrcPort0        int          `json:"srcPort0,omitempty"` // srcport+protocol is uneque, use as old app id
+	NatType         int          `json:"natType,omitempty"`
+	PeerNode        string       `json:"peerNode,omitempty"`
+	DstPort         int          `json:"dstPort,omitempty"`
+	DstHost         string       `json:"dstHost,omitempty"`
+	PeerUser        string       `json:"peerUser,omitempty"`
+	PeerNatType     int          `json:"peerNatType,omitempty"`
+	NatBehavior     *NATBehavior `json:"natBehavior,omitempty"`
+	PeerNatBehavior *NATBehavior `json:"peerNatBehavior,omitempty"`
+	NatDetail       string       `json:"natDetail,omitempty"` // why direct connection can't work
+	PeerIP          string       `json:"peerIP,omitempty"`
+	ShareBandwidth  int          `json:"shareBandWidth,omitempty"`
+	RelayNode       string       `json:"relayNode,omitempty"`
+	SpecRelayNode   string       `json:"specRelayNode,omitempty"`
+	RelayMode       string       `json:"relayMode,omitempty"`
+	LinkMode        string       `json:"linkMode,omitempty"`
+	Multipath       string       `json:"multipath,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	RetryTime       string       `json:"retryTime,omitempty"`
+	ConnectTime     string       `json:"connectTime,omitempty"`
+	IsActive        int          `json:"isActive,omitempty"`
+	Enabled         int          `json:"enabled,omitempty"`
 }
 
 type ReportApps struct {
@@ -474,15 +605,17 @@ type QueryPeerInfoReq struct {
 	PeerNode string `json:"peerNode,omitempty"`
 }
 type QueryPeerInfoRsp struct {
-	PeerNode        string `json:"peerNode,omitempty"`
-	Online          int    `json:"online,omitempty"`
-	Version         string `json:"version,omitempty"`
-	NatType         int    `json:"natType,omitempty"`
-	IPv4            string `json:"IPv4,omitempty"`
-	LanIP           string `json:"lanIP,omitempty"`
-	HasIPv4         int    `json:"hasIPv4,omitempty"` // has public ipv4
-	IPv6            string `json:"IPv6,omitempty"`    // if public relay node, ipv6 not set
-	HasUPNPorNATPMP int    `json:"hasUPNPorNATPMP,omitempty"`
+	PeerNode        string       `json:"peerNode,omitempty"`
+	Online          int          `json:"online,omitempty"`
+	Version         string       `json:"version,omitempty"`
+	NatType         int          `json:"natType,omitempty"`
+	IPv4            string       `json:"IPv4,omitempty"`
+	LanIP           string       `json:"lanIP,omitempty"`
+	HasIPv4         int          `json:"hasIPv4,omitempty"` // has public ipv4
+	IPv6            string       `json:"IPv6,omitempty"`    // if public relay node, ipv6 not set
+	HasUPNPorNATPMP int          `json:"hasUPNPorNATPMP,omitempty"`
+	Identity        string       `json:"identity,omitempty"` // published at login
+	NatBehavior     *NATBehavior `json:"natBehavior,omitempty"`
 }
 
 type SDWANNode struct {
@@ -0,0 +1,129 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rttWindowSize = 30 // heartbeats kept for loss statistics, 5 minutes at TunnelHeartbeatTime
+	rttLossAfter  = TunnelHeartbeatTime * 2
+)
+
+type rttProbe struct {
+	seq    uint64
+	sentTs time.Time
+	acked  bool
+}
+
+// rttStats measures rtt, jitter and loss by heartbeat probes.
+// srtt and rttvar are smoothed as RFC 6298, jitter as RFC 3550.
+type rttStats struct {
+	mtx    sync.Mutex
+	seq    uint64
+	probes [rttWindowSize]rttProbe
+	last   time.Duration
+	srtt   time.Duration
+	rttvar time.Duration
+	jitter time.Duration
+	echoed bool // old peers ack heartbeats without the seq, their loss is unknown
+}
+
+type RTTSnapshot struct {
+	RTT    float64 `json:"rtt"` // ms, smoothed
+	Last   float64 `json:"last"`
+	Jitter float64 `json:"jitter"`
+	Loss   float64 `json:"loss"` // 0-1, -1 unknown
+}
+
+// next probe sequence, seq starts at 1 so 0 means no probe
+func (s *rttStats) probe() (uint64, time.Time) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.seq++
+	now := time.Now()
+	s.probes[s.seq%rttWindowSize] = rttProbe{seq: s.seq, sentTs: now}
+	return s.seq, now
+}
+
+// ack the probe seq, unknown, too old or duplicated acks are ignored
+func (s *rttStats) ack(seq uint64) (time.Duration, bool) {
+	if seq == 0 {
+		return 0, false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	p := &s.probes[seq%rttWindowSize]
+	if p.seq != seq || p.acked {
+		return 0, false
+	}
+	p.acked = true
+	s.echoed = true
+	rtt := time.Since(p.sentTs)
+	s.addSample(rtt)
+	return rtt, true
+}
+
+// caller holds mtx
+func (s *rttStats) addSample(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt = rtt
+		s.rttvar = rtt / 2
+	} else {
+		s.rttvar = (3*s.rttvar + absDuration(s.srtt-rtt)) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+		s.jitter += (absDuration(rtt-s.last) - s.jitter) / 16
+	}
+	s.last = rtt
+}
+
+// loss rate of the probes old enough to be acked
+func (s *rttStats) loss() float64 {
+	if !s.echoed {
+		return -1
+	}
+	deadline := time.Now().Add(-rttLossAfter)
+	sent, lost := 0, 0
+	for _, p := range s.probes {
+		if p.seq == 0 || p.sentTs.After(deadline) {
+			continue
+		}
+		sent++
+		if !p.acked {
+			lost++
+		}
+	}
+	if sent == 0 {
+		return 0
+	}
+	return float64(lost) / float64(sent)
+}
+
+func (s *rttStats) Snapshot() RTTSnapshot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return RTTSnapshot{
+		RTT:    durationMS(s.srtt),
+		Last:   durationMS(s.last),
+		Jitter: durationMS(s.jitter),
+		Loss:   s.loss(),
+	}
+}
+
+// smoothed rtt, 0 before the first sample
+func (s *rttStats) SRTT() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.srtt
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTStats(t *testing.T) {
+	s := rttStats{}
+	if _, ok := s.ack(0); ok {
+		t.Errorf("ack seq 0 ok")
+	}
+	seq, _ := s.probe()
+	s.probes[seq%rttWindowSize].sentTs = time.Now().Add(-time.Millisecond * 100)
+	if rtt, ok := s.ack(seq); !ok || rtt < time.Millisecond*100 {
+		t.Errorf("ack error:%v %v", rtt, ok)
+	}
+	if _, ok := s.ack(seq); ok {
+		t.Errorf("duplicated ack ok")
+	}
+	snap := s.Snapshot()
+	if snap.RTT < 100 || snap.RTT > 200 || snap.Loss != 0 {
+		t.Errorf("snapshot error:%+v", snap)
+	}
+
+	// one acked and one lost probe, both old enough
+	seq, _ = s.probe()
+	s.probes[seq%rttWindowSize].sentTs = time.Now().Add(-rttLossAfter * 2)
+	s.probes[(seq-1)%rttWindowSize].sentTs = time.Now().Add(-rttLossAfter * 2)
+	if loss := s.Snapshot().Loss; loss != 0.5 {
+		t.Errorf("loss error:%f", loss)
+	}
+	// late ack of an overwritten probe is ignored
+	for i := 0; i < rttWindowSize; i++ {
+		s.probe()
+	}
+	if _, ok := s.ack(seq); ok {
+		t.Errorf("ack overwritten probe ok")
+	}
+}
+
+func TestRTTLossUnknown(t *testing.T) {
+	// an old peer acks heartbeats without the seq
+	s := rttStats{}
+	seq, _ := s.probe()
+	s.probes[seq%rttWindowSize].sentTs = time.Now().Add(-rttLossAfter * 2)
+	if loss := s.Snapshot().Loss; loss != -1 {
+		t.Errorf("loss without echo:%f", loss)
+	}
+}
@@ -213,7 +213,10 @@ func (s *p2pSDWAN) readNodeLoop() {
 		}
 
 		len, err := s.tun.Write(writeBuff, PIHeaderSize)
-		if err != nil {
+		if err == nil {
+			metricSDWANRouted.inc("in")
+		} else {
+			metricSDWANDropped.inc("tun_write")
 			gLog.Printf(LvDEBUG, "write tun dst ip=%s,len=%d,error:%s", net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String(), len, err)
 		}
 	}
@@ -232,6 +235,8 @@ func (s *p2pSDWAN) routeTunPacket(p []byte, head *PacketHeader) {
 		if isBroadcastOrMulticast(head.dst, s.subnet) {
 			gLog.Printf(LvDev, "multicast ip=%s", net.IP{byte(head.dst >> 24), byte(head.dst >> 16), byte(head.dst >> 8), byte(head.dst)}.String())
 			GNetwork.WriteBroadcast(p)
+		} else {
+			metricSDWANDropped.inc("no_route")
 		}
 		return
 	} else {
@@ -240,6 +245,7 @@ func (s *p2pSDWAN) routeTunPacket(p []byte, head *PacketHeader) {
 
 	err := GNetwork.WriteNode(node.id, p)
 	if err != nil {
+		metricSDWANDropped.inc("no_tunnel")
 		gLog.Printf(LvDev, "write packet to %s fail: %s", node.name, err)
 	}
 }
@@ -0,0 +1,227 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SessionTTL          = time.Hour * 12
+	SessionRefreshAfter = time.Minute * 5 // 过早刷新无意义，避免被滥用刷出大量会话
+	sessionTokenLen     = 32
+)
+
+// 会话，服务端保存，重启后需重新登录
+type Session struct {
+	Username string
+	Created  time.Time
+	Expires  time.Time
+}
+
+type sessionContextKey struct{}
+
+// 会话存储，key为token的sha256，内存中不保存明文token
+type sessionStore struct {
+	sessions map[string]*Session
+	mtx      sync.Mutex
+}
+
+var gSessions = &sessionStore{sessions: make(map[string]*Session)}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 创建会话，返回token
+func (s *sessionStore) create(username string) (string, *Session, error) {
+	b := make([]byte, sessionTokenLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now()
+	session := &Session{Username: username, Created: now, Expires: now.Add(SessionTTL)}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.gc(now)
+	s.sessions[hashSessionToken(token)] = session
+	return token, session, nil
+}
+
+// 校验token，过期的会话会被删除
+func (s *sessionStore) get(token string) *Session {
+	if token == "" {
+		return nil
+	}
+	key := hashSessionToken(token)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, key)
+		return nil
+	}
+	return session
+}
+
+// 刷新会话：签发新token并作废旧token
+func (s *sessionStore) refresh(token string) (string, *Session, error) {
+	session := s.get(token)
+	if session == nil {
+		return "", nil, ErrSessionInvalid
+	}
+	if time.Since(session.Created) < SessionRefreshAfter {
+		return "", nil, ErrSessionRefreshTooSoon
+	}
+	newToken, newSession, err := s.create(session.Username)
+	if err != nil {
+		return "", nil, err
+	}
+	s.revoke(token)
+	return newToken, newSession, nil
+}
+
+func (s *sessionStore) revoke(token string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.sessions, hashSessionToken(token))
+}
+
+// 作废用户的所有会话，用于删除用户、重置TOTP等
+func (s *sessionStore) revokeUser(username string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for key, session := range s.sessions {
+		if session.Username == username {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// 有效会话数
+func (s *sessionStore) count() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.gc(time.Now())
+	return len(s.sessions)
+}
+
+// 调用方需持有锁
+func (s *sessionStore) gc(now time.Time) {
+	for key, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, key)
+		}
+	}
+}
+
+// 从请求头获取token，兼容 "Bearer <token>" 和直接传token
+func requestToken(r *http.Request) string {
+	token := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(token) > 7 && strings.EqualFold(token[:7], "Bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	return token
+}
+
+// 认证中间件，未登录或会话过期返回401，角色不足返回403。
+// GET请求需要readRole，其他请求需要writeRole
+func authMiddleware(readRole string, writeRole string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		session := gSessions.get(token)
+		if session == nil {
+			responseStatusJSON(w, http.StatusUnauthorized, APIResponse{Code: 1, Message: "Unauthorized"})
+			return
+		}
+		// 每次请求都检查用户，删除用户或修改角色立即生效
+		user, ok := gUserManager.GetUser(session.Username)
+		if !ok {
+			gSessions.revoke(token)
+			responseStatusJSON(w, http.StatusUnauthorized, APIResponse{Code: 1, Message: "Unauthorized"})
+			return
+		}
+		required := writeRole
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			required = readRole
+		}
+		if !roleAllowed(user.Role, required) {
+			responseStatusJSON(w, http.StatusForbidden, APIResponse{Code: 1, Message: "Permission denied"})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session)))
+	}
+}
+
+// 客户端API由节点调用，节点没有登录会话，使用管理API创建节点时分配的token认证。
+// 空token不匹配任何节点，调用方需持有 gConf.mtx
+func findNodeByToken(token string) *AppConfig {
+	if token == "" {
+		return nil
+	}
+	for _, app := range gConf.Apps {
+		if app.AppToken != "" && subtle.ConstantTimeCompare([]byte(app.AppToken), []byte(token)) == 1 {
+			return app
+		}
+	}
+	return nil
+}
+
+func responseStatusJSON(w http.ResponseWriter, status int, response APIResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// 获取当前请求的登录用户名，只能在authMiddleware之后调用
+func sessionUser(r *http.Request) string {
+	session, ok := r.Context().Value(sessionContextKey{}).(*Session)
+	if !ok {
+		return ""
+	}
+	return session.Username
+}
+
+// 刷新会话
+func handleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, session, err := gSessions.refresh(requestToken(r))
+	if err != nil {
+		responseJSON(w, APIResponse{Code: 1, Message: err.Error()})
+		return
+	}
+	responseJSON(w, APIResponse{
+		Code:    0,
+		Message: "Token refreshed",
+		Data: map[string]interface{}{
+			"token":   token,
+			"expires": session.Expires.Unix(),
+		},
+	})
+}
+
+// 退出登录，作废当前会话
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	gSessions.revoke(requestToken(r))
+	responseJSON(w, APIResponse{Code: 0, Message: "Logout successful"})
+}
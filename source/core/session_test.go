@@ -0,0 +1,128 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	store := &sessionStore{sessions: make(map[string]*Session)}
+	token, _, err := store.create("admin")
+	if err != nil {
+		t.Fatalf("create session error:%s", err)
+	}
+	if s := store.get(token); s == nil || s.Username != "admin" {
+		t.Errorf("get session error")
+	}
+	if store.get("YWRtaW4=") != nil { // base64("admin") must not be accepted
+		t.Errorf("forged token accepted")
+	}
+	if _, _, err = store.refresh(token); err != ErrSessionRefreshTooSoon {
+		t.Errorf("refresh too soon error:%v", err)
+	}
+	store.sessions[hashSessionToken(token)].Created = time.Now().Add(-SessionRefreshAfter)
+	newToken, _, err := store.refresh(token)
+	if err != nil || store.get(token) != nil || store.get(newToken) == nil {
+		t.Errorf("refresh session error:%v", err)
+	}
+	store.sessions[hashSessionToken(newToken)].Expires = time.Now().Add(-time.Second)
+	if store.get(newToken) != nil {
+		t.Errorf("expired session accepted")
+	}
+	token, _, _ = store.create("admin")
+	store.revokeUser("admin")
+	if store.get(token) != nil {
+		t.Errorf("revoked session accepted")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	oldManager := gUserManager
+	defer func() { gUserManager = oldManager }()
+	gUserManager = NewUserManager(t.TempDir())
+	gUserManager.CreateAdmin("admin", "key")
+	gUserManager.AddUser(User{Username: "viewer", Role: RoleReadOnly})
+
+	token, _, _ := gSessions.create("admin")
+	defer gSessions.revoke(token)
+	handler := authMiddleware(RoleReadOnly, RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if sessionUser(r) == "" {
+			t.Errorf("sessionUser error")
+		}
+	})
+	for _, auth := range []string{token, "Bearer " + token} {
+		r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("auth %s got %d", auth, w.Code)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.Header.Set("Authorization", "YWRtaW4=")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("forged token got %d", w.Code)
+	}
+
+	viewerToken, _, _ := gSessions.create("viewer")
+	defer gSessions.revoke(viewerToken)
+	for method, code := range map[string]int{http.MethodGet: http.StatusOK, http.MethodPost: http.StatusForbidden} {
+		r = httptest.NewRequest(method, "/api/stats", nil)
+		r.Header.Set("Authorization", viewerToken)
+		w = httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != code {
+			t.Errorf("readonly %s want %d got %d", method, code, w.Code)
+		}
+	}
+
+	// removed user's session no longer works
+	gUserManager.DeleteUser("viewer")
+	r = httptest.NewRequest(http.MethodGet, "/api/stats", nil)
+	r.Header.Set("Authorization", viewerToken)
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("deleted user got %d", w.Code)
+	}
+}
+
+func TestClientNodeToken(t *testing.T) {
+	oldApps := gConf.Apps
+	defer func() { gConf.Apps = oldApps }()
+	gConf.Apps = []*AppConfig{{AppID: "node1", AppName: "node1", AppToken: "secret"}, {SrcPort: 23389, PeerNode: "peer1"}}
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized}, // must not match the apps without token
+		{"wrong", http.StatusUnauthorized},
+		{"secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/client/heartbeat", strings.NewReader(`{"token":"`+tt.token+`"}`))
+		w := httptest.NewRecorder()
+		handleClientHeartbeat(w, r)
+		if w.Code != tt.status {
+			t.Errorf("token %q got %d", tt.token, w.Code)
+		}
+	}
+}
+
+func TestDeleteLastAdmin(t *testing.T) {
+	um := NewUserManager(t.TempDir())
+	um.CreateAdmin("admin", "key")
+	um.AddUser(User{Username: "viewer", Role: RoleReadOnly})
+	if err := um.DeleteUser("admin"); err == nil || !um.HasAdmin() {
+		t.Errorf("deleted the last admin")
+	}
+	if err := um.DeleteUser("viewer"); err != nil {
+		t.Errorf("delete user error:%s", err)
+	}
+}
@@ -37,11 +37,13 @@ func (sl *SpeedLimiter) Add(increment int, wait bool) bool {
 		sl.freeCap = sl.maxFreeCap
 	}
 	if !wait && sl.freeCap < increment {
+		metricThrottled.inc()
 		return false
 	}
 	sl.freeCap -= increment
 	sl.lastUpdate = time.Now()
 	if sl.freeCap < 0 {
+		metricThrottled.inc()
 		// sleep for the overflow
 		// fmt.Println("sleep ", time.Millisecond*time.Duration(-sl.freeCap*100)/time.Duration(sl.speed))
 		time.Sleep(time.Millisecond * time.Duration(-sl.freeCap*1000) / time.Duration(sl.speed)) // sleep ms
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rates are recalculated at most once per trafficRateInterval, callers polling faster get the last value
+const trafficRateInterval = time.Second * 5
+
+// TrafficStats counts bytes and packets, safe for concurrent use
+type TrafficStats struct {
+	txBytes   atomic.Uint64 // atomic types stay 64-bit aligned on 32-bit platforms
+	rxBytes   atomic.Uint64
+	txPackets atomic.Uint64
+	rxPackets atomic.Uint64
+	rateMtx   sync.Mutex
+	rateTs    time.Time
+	rateTx    uint64 // txBytes at rateTs
+	rateRx    uint64
+	txRate    float64 // bytes per second
+	rxRate    float64
+}
+
+type TrafficSnapshot struct {
+	TxBytes   uint64  `json:"txBytes"`
+	RxBytes   uint64  `json:"rxBytes"`
+	TxPackets uint64  `json:"txPackets"`
+	RxPackets uint64  `json:"rxPackets"`
+	TxRate    float64 `json:"txRate"` // bytes per second
+	RxRate    float64 `json:"rxRate"`
+}
+
+func (s *TrafficStats) addTx(n int) {
+	s.txBytes.Add(uint64(n))
+	s.txPackets.Add(1)
+}
+
+func (s *TrafficStats) addRx(n int) {
+	s.rxBytes.Add(uint64(n))
+	s.rxPackets.Add(1)
+}
+
+func (s *TrafficStats) Snapshot() TrafficSnapshot {
+	snap := TrafficSnapshot{
+		TxBytes:   s.txBytes.Load(),
+		RxBytes:   s.rxBytes.Load(),
+		TxPackets: s.txPackets.Load(),
+		RxPackets: s.rxPackets.Load(),
+	}
+	s.rateMtx.Lock()
+	defer s.rateMtx.Unlock()
+	now := time.Now()
+	if s.rateTs.IsZero() {
+		s.rateTs, s.rateTx, s.rateRx = now, snap.TxBytes, snap.RxBytes
+	} else if elapsed := now.Sub(s.rateTs); elapsed >= trafficRateInterval {
+		s.txRate = float64(snap.TxBytes-s.rateTx) / elapsed.Seconds()
+		s.rxRate = float64(snap.RxBytes-s.rateRx) / elapsed.Seconds()
+		s.rateTs, s.rateTx, s.rateRx = now, snap.TxBytes, snap.RxBytes
+	}
+	snap.TxRate = s.txRate
+	snap.RxRate = s.rxRate
+	return snap
+}
+
+func (s TrafficSnapshot) Total() uint64 {
+	return s.TxBytes + s.RxBytes
+}
+
+func (s *TrafficSnapshot) add(o TrafficSnapshot) {
+	s.TxBytes += o.TxBytes
+	s.RxBytes += o.RxBytes
+	s.TxPackets += o.TxPackets
+	s.RxPackets += o.RxPackets
+	s.TxRate += o.TxRate
+	s.RxRate += o.RxRate
+}
+
+// node level traffic. direct and relay are this node's own app data,
+// relayed is forwarded for other nodes when this node works as a relay.
+type nodeTraffic struct {
+	direct  TrafficStats
+	relay   TrafficStats
+	relayed TrafficStats
+}
+
+var gTraffic nodeTraffic
+
+func (nt *nodeTraffic) path(isRelay bool) *TrafficStats {
+	if isRelay {
+		return &nt.relay
+	}
+	return &nt.direct
+}
+
+type NodeTrafficSnapshot struct {
+	Direct  TrafficSnapshot `json:"direct"`
+	Relay   TrafficSnapshot `json:"relay"`
+	Relayed TrafficSnapshot `json:"relayed"`
+}
+
+func NodeTraffic() NodeTrafficSnapshot {
+	return NodeTrafficSnapshot{
+		Direct:  gTraffic.direct.Snapshot(),
+		Relay:   gTraffic.relay.Snapshot(),
+		Relayed: gTraffic.relayed.Snapshot(),
+	}
+}
+
+// count app payload on tx path, app may be nil on the server side of a tunnel
+func countAppTx(app *p2pApp, n int, isRelay bool) {
+	if app != nil {
+		app.traffic.addTx(n)
+	}
+	gTraffic.path(isRelay).addTx(n)
+}
+
+func countAppRx(app *p2pApp, n int, isRelay bool) {
+	if app != nil {
+		app.traffic.addRx(n)
+	}
+	gTraffic.path(isRelay).addRx(n)
+}
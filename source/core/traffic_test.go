@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrafficStats(t *testing.T) {
+	s := TrafficStats{}
+	s.addTx(100)
+	s.addTx(200)
+	s.addRx(50)
+	snap := s.Snapshot()
+	if snap.TxBytes != 300 || snap.TxPackets != 2 || snap.RxBytes != 50 || snap.RxPackets != 1 || snap.Total() != 350 {
+		t.Errorf("snapshot error:%+v", snap)
+	}
+	if snap.TxRate != 0 {
+		t.Errorf("first snapshot rate should be 0:%+v", snap)
+	}
+	s.rateTs = time.Now().Add(-trafficRateInterval * 2) // pretend last sample 10s ago
+	s.rateTx = 0
+	snap = s.Snapshot()
+	if snap.TxRate < 29 || snap.TxRate > 31 {
+		t.Errorf("tx rate error:%f", snap.TxRate)
+	}
+}
+
+func TestCountAppTraffic(t *testing.T) {
+	app := &p2pApp{}
+	before := NodeTraffic()
+	countAppTx(app, 10, false)
+	countAppRx(app, 20, true)
+	countAppRx(nil, 5, true)
+	after := NodeTraffic()
+	if snap := app.traffic.Snapshot(); snap.TxBytes != 10 || snap.RxBytes != 20 {
+		t.Errorf("app traffic error:%+v", snap)
+	}
+	if after.Direct.TxBytes-before.Direct.TxBytes != 10 || after.Relay.RxBytes-before.Relay.RxBytes != 25 {
+		t.Errorf("node traffic error:%+v", after)
+	}
+}
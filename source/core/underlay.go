@@ -20,6 +20,13 @@ type underlay interface {
 	Protocol() string
 }
 
+// datagramUnderlay also sends unreliable datagrams beside the stream, for the data which can
+// be lost: sdwan packets and udp overlays. no head-of-line blocking or retransmission.
+type datagramUnderlay interface {
+	WriteDatagram([]byte) error
+	ReadDatagram() ([]byte, error)
+}
+
 func DefaultReadBuffer(ul underlay) (*openP2PHeader, []byte, error) {
 	headBuf := make([]byte, openP2PHeaderSize)
 	_, err := io.ReadFull(ul, headBuf)
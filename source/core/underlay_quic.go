@@ -1,16 +1,17 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
+	"encoding/binary"
 	"fmt"
 	"math/big"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/quic-go/quic-go"
@@ -19,11 +20,19 @@ import (
 // quic.DialContext do not support version 44,disable it
 var quicVersion []quic.VersionNumber
 
+const (
+	quicDatagramMaxSize  = 1150 // fits a packet of 1232 bytes with headers
+	quicDatagramHeadSize = 4    // message id uint16, part index, part count
+	quicDatagramMaxParts = 4    // udp overlays read 4096 bytes
+)
+
 type underlayQUIC struct {
 	listener *quic.Listener
 	writeMtx *sync.Mutex
 	quic.Stream
 	quic.Connection
+	datagramID uint32
+	assembler  datagramAssembler
 }
 
 func (conn *underlayQUIC) Protocol() string {
@@ -58,6 +67,83 @@ func (conn *underlayQUIC) WLock() {
 func (conn *underlayQUIC) WUnlock() {
 	conn.writeMtx.Unlock()
 }
+
+// WriteDatagram sends a whole openp2p message in quic datagrams (RFC 9221). path mtu discovery
+// is disabled, the message is split into parts fitting a packet, a lost part drops the message.
+// it fails if the peer doesn't enable datagrams or the message is too large.
+func (conn *underlayQUIC) WriteDatagram(data []byte) error {
+	if !conn.ConnectionState().SupportsDatagrams {
+		return ErrDatagramUnsupported
+	}
+	partSize := quicDatagramMaxSize - quicDatagramHeadSize
+	count := (len(data) + partSize - 1) / partSize
+	if count > quicDatagramMaxParts {
+		return ErrDatagramTooLarge
+	}
+	id := uint16(atomic.AddUint32(&conn.datagramID, 1))
+	for i := 0; i < count; i++ {
+		end := (i + 1) * partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		part := make([]byte, quicDatagramHeadSize, quicDatagramHeadSize+end-i*partSize)
+		binary.LittleEndian.PutUint16(part, id)
+		part[2], part[3] = byte(i), byte(count)
+		if err := conn.SendDatagram(append(part, data[i*partSize:end]...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadDatagram returns the next whole message, only the datagram read loop calls it
+func (conn *underlayQUIC) ReadDatagram() ([]byte, error) {
+	for {
+		buff, err := conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		if msg := conn.assembler.add(buff); msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// datagramAssembler joins the parts of one message, the parts of a message usually come in
+// order without others between, otherwise the incomplete one is dropped like a lost packet
+type datagramAssembler struct {
+	id    uint16
+	parts [][]byte
+	got   int
+}
+
+func (a *datagramAssembler) add(buff []byte) []byte {
+	if len(buff) <= quicDatagramHeadSize {
+		return nil
+	}
+	id, index, count := binary.LittleEndian.Uint16(buff), int(buff[2]), int(buff[3])
+	if count == 1 && index == 0 {
+		return buff[quicDatagramHeadSize:]
+	}
+	if count > quicDatagramMaxParts || index >= count {
+		return nil
+	}
+	if a.parts == nil || id != a.id || len(a.parts) != count {
+		a.id, a.parts, a.got = id, make([][]byte, count), 0
+	}
+	if a.parts[index] != nil {
+		return nil
+	}
+	a.parts[index] = buff[quicDatagramHeadSize:]
+	a.got++
+	if a.got < count {
+		return nil
+	}
+	msg := bytes.Join(a.parts, nil)
+	a.parts = nil
+	return msg
+}
+
 func (conn *underlayQUIC) CloseListener() {
 	if conn.listener != nil {
 		conn.listener.Close()
@@ -83,7 +169,7 @@ func (conn *underlayQUIC) Accept() error {
 func listenQuic(addr string, idleTimeout time.Duration) (*underlayQUIC, error) {
 	gLog.Println(LvDEBUG, "quic listen on ", addr)
 	listener, err := quic.ListenAddr(addr, generateTLSConfig(),
-		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true})
+		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true, EnableDatagrams: true})
 	if err != nil {
 		return nil, fmt.Errorf("quic.ListenAddr error:%s", err)
 	}
@@ -96,13 +182,17 @@ func listenQuic(addr string, idleTimeout time.Duration) (*underlayQUIC, error) {
 	return ul, nil
 }
 
-func dialQuic(conn *net.UDPConn, remoteAddr *net.UDPAddr, idleTimeout time.Duration) (*underlayQUIC, error) {
+// dialQuic checks the cert key of the peer like the key exchange, the cert is self-signed
+func dialQuic(conn *net.UDPConn, remoteAddr *net.UDPAddr, idleTimeout time.Duration, node string, published string) (*underlayQUIC, error) {
 	tlsConf := &tls.Config{
 		InsecureSkipVerify: true,
-		NextProtos:         []string{"openp2pv1"},
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyPeerCert(rawCerts, node, published)
+		},
+		NextProtos: []string{"openp2pv1"},
 	}
 	Connection, err := quic.DialEarly(context.Background(), conn, remoteAddr, tlsConf,
-		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true})
+		&quic.Config{Versions: quicVersion, MaxIdleTimeout: idleTimeout, DisablePathMTUDiscovery: true, EnableDatagrams: true})
 	if err != nil {
 		return nil, fmt.Errorf("quic.DialContext error:%s", err)
 	}
@@ -114,26 +204,16 @@ func dialQuic(conn *net.UDPConn, remoteAddr *net.UDPAddr, idleTimeout time.Durat
 	return qConn, nil
 }
 
-// Setup a bare-bones TLS config for the server
+// Setup a bare-bones TLS config for the server, the cert key is the node identity
 func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		panic(err)
-	}
+	id := localIdentity()
 	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
-	if err != nil {
-		panic(err)
-	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, id.pub, id.priv)
 	if err != nil {
 		panic(err)
 	}
 	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certDER}, PrivateKey: id.priv}},
 		NextProtos:   []string{"openp2pv1"},
 	}
 }
@@ -0,0 +1,200 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQuicDatagram(t *testing.T) {
+	dir := t.TempDir()
+	if gLog == nil {
+		gLog = NewLogger(dir, ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	onceIdentity.Do(func() { gIdentity, _ = loadIdentity(filepath.Join(dir, identityFile)) })
+	tempTrust(t, dir)
+	l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.LocalAddr().(*net.UDPAddr)
+	l.Close()
+	serverCh := make(chan *underlayQUIC, 1)
+	go func() {
+		ul, err := listenQuic(addr.String(), TunnelIdleTimeout)
+		if err != nil {
+			t.Error(err)
+		}
+		serverCh <- ul
+	}()
+	time.Sleep(time.Millisecond * 100)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := dialQuic(conn, addr, TunnelIdleTimeout, "quic server", localIdentity().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.WriteBytes(MsgP2P, MsgTunnelHandshake, []byte("OpenP2P,hello")) // the stream is accepted with data
+	server := <-serverCh
+	if server == nil {
+		t.FailNow()
+	}
+	defer server.Close()
+	server.ReadBuffer()
+
+	// the udp overlay data comes in a datagram
+	tunnel := &P2PTunnel{conn: server}
+	tunnel.setRun(true)
+	oConn := &overlayConn{id: 1, tunnel: tunnel, recvData: make(chan []byte, 10), connUDP: conn}
+	oConn.running.Store(true)
+	tunnel.overlayConns.Store(oConn.id, oConn)
+	go tunnel.readDatagramLoop(server)
+	body := make([]byte, overlayHeaderSize)
+	binary.LittleEndian.PutUint64(body, oConn.id)
+	body = append(body, "udp data"...)
+	clientTunnel := &P2PTunnel{conn: client}
+	if !clientTunnel.writeDatagram(append(encodeHeader(MsgP2P, MsgOverlayData, uint32(len(body))), body...)) {
+		t.Fatal("write datagram error")
+	}
+	select {
+	case got := <-oConn.recvData:
+		if string(got) != "udp data" {
+			t.Errorf("datagram got %s", got)
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("datagram not delivered")
+	}
+	// sdwan packets are larger than a datagram
+	large := bytes.Repeat([]byte("large udp data"), 200)
+	body = append(body[:overlayHeaderSize], large...)
+	if !clientTunnel.writeDatagram(append(encodeHeader(MsgP2P, MsgOverlayData, uint32(len(body))), body...)) {
+		t.Fatal("write parts error")
+	}
+	select {
+	case got := <-oConn.recvData:
+		if !bytes.Equal(got, large) {
+			t.Errorf("datagram parts joined error")
+		}
+	case <-time.After(time.Second * 3):
+		t.Errorf("datagram parts not delivered")
+	}
+	if clientTunnel.writeDatagram(make([]byte, quicDatagramMaxSize*quicDatagramMaxParts)) {
+		t.Errorf("too large datagram not fell back to stream")
+	}
+	tunnel.setRun(false)
+
+	tcpTunnel := &P2PTunnel{conn: &underlayTCP{writeMtx: &sync.Mutex{}}}
+	if tcpTunnel.writeDatagram([]byte("data")) {
+		t.Errorf("tcp underlay sent a datagram")
+	}
+}
+
+// tempTrust pins the peer identities in dir during the test
+func tempTrust(t *testing.T, dir string) {
+	onceTrust.Do(func() {})
+	ts := gTrust
+	gTrust = newTrustStore(filepath.Join(dir, knownNodesFile))
+	t.Cleanup(func() { gTrust = ts })
+}
+
+func TestQuicPeerIdentity(t *testing.T) {
+	dir := t.TempDir()
+	if gLog == nil {
+		gLog = NewLogger(dir, ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	onceIdentity.Do(func() { gIdentity, _ = loadIdentity(filepath.Join(dir, identityFile)) })
+	tempTrust(t, dir)
+	dial := func(node string, published string) error {
+		l, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := l.LocalAddr().(*net.UDPAddr)
+		l.Close()
+		go func() {
+			if ul, err := listenQuic(addr.String(), TunnelIdleTimeout); err == nil {
+				ul.ReadBuffer()
+				ul.Close()
+			}
+		}()
+		time.Sleep(time.Millisecond * 100)
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client, err := dialQuic(conn, addr, TunnelIdleTimeout, node, published)
+		if err != nil {
+			return err
+		}
+		client.WriteBytes(MsgP2P, MsgTunnelHandshake, []byte("OpenP2P,hello"))
+		client.Close()
+		return nil
+	}
+	other, _ := loadIdentity(filepath.Join(dir, "other.key"))
+	if err := dial("quic impostor", other.String()); err == nil {
+		t.Errorf("cert of another identity accepted")
+	}
+	if err := dial("quic peer", localIdentity().String()); err != nil {
+		t.Errorf("published identity refused:%s", err)
+	}
+	if !trust().pinned("quic peer") {
+		t.Errorf("quic peer not pinned")
+	}
+}
+
+func TestQuicDatagramFallback(t *testing.T) {
+	// udp overlays on an underlay without datagrams write to the stream
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ul := &underlayTCP{writeMtx: &sync.Mutex{}, Conn: client}
+	tunnel := &P2PTunnel{conn: ul}
+	oConn := &overlayConn{id: 1, tunnel: tunnel, connUDP: &net.UDPConn{}}
+	data := bytes.Repeat([]byte("d"), 100)
+	go oConn.writeOverlay(MsgOverlayData, data)
+	sul := &underlayTCP{writeMtx: &sync.Mutex{}, Conn: server}
+	head, buff, err := sul.ReadBuffer()
+	if err != nil || head.SubType != MsgOverlayData || !bytes.Equal(buff, data) {
+		t.Errorf("stream fallback error:%v", err)
+	}
+}
+
+func TestDatagramAssembler(t *testing.T) {
+	part := func(id uint16, index, count int, data string) []byte {
+		b := make([]byte, quicDatagramHeadSize)
+		binary.LittleEndian.PutUint16(b, id)
+		b[2], b[3] = byte(index), byte(count)
+		return append(b, data...)
+	}
+	a := datagramAssembler{}
+	if got := a.add(part(1, 0, 1, "single")); string(got) != "single" {
+		t.Errorf("single part got %s", got)
+	}
+	if a.add(part(2, 1, 2, "b")) != nil {
+		t.Errorf("incomplete message returned")
+	}
+	if got := a.add(part(2, 0, 2, "a")); string(got) != "ab" {
+		t.Errorf("parts out of order got %s", got)
+	}
+	// 3 is interleaved by 4, it's dropped
+	a.add(part(3, 0, 2, "x"))
+	a.add(part(4, 0, 2, "c"))
+	if a.add(part(3, 1, 2, "y")) != nil {
+		t.Errorf("interleaved message returned")
+	}
+	a.add(part(4, 0, 2, "c"))
+	if got := a.add(part(4, 1, 2, "d")); string(got) != "cd" {
+		t.Errorf("got %s", got)
+	}
+	if a.add(part(5, 4, 5, "e")) != nil || a.add([]byte{1, 2}) != nil {
+		t.Errorf("bad part accepted")
+	}
+}
@@ -0,0 +1,311 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// the wss underlay carries the tunnel over tls websocket, it looks like https on 443 for
+// firewalls blocking udp and other tcp ports. the node with public ip listens with a
+// self-signed cert, the peer pins its sha256 got through the server. it can dial
+// through an http CONNECT proxy.
+
+type underlayWSS struct {
+	writeMtx *sync.Mutex
+	*websocket.Conn
+	reader      io.Reader // current message
+	connectTime time.Time
+}
+
+func (conn *underlayWSS) Protocol() string {
+	return "wss"
+}
+
+// Read reads the binary messages as a stream
+func (conn *underlayWSS) Read(b []byte) (int, error) {
+	for {
+		if conn.reader == nil {
+			mt, r, err := conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if mt != websocket.BinaryMessage {
+				continue
+			}
+			conn.reader = r
+		}
+		n, err := conn.reader.Read(b)
+		if err == io.EOF {
+			conn.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends one message, the callers write a whole openp2p message with WLock
+func (conn *underlayWSS) Write(b []byte) (int, error) {
+	if err := conn.Conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (conn *underlayWSS) ReadBuffer() (*openP2PHeader, []byte, error) {
+	return DefaultReadBuffer(conn)
+}
+
+func (conn *underlayWSS) WriteBytes(mainType uint16, subType uint16, data []byte) error {
+	return DefaultWriteBytes(conn, mainType, subType, data)
+}
+
+func (conn *underlayWSS) WriteBuffer(data []byte) error {
+	return DefaultWriteBuffer(conn, data)
+}
+
+func (conn *underlayWSS) WriteMessage(mainType uint16, subType uint16, packet interface{}) error {
+	return DefaultWriteMessage(conn, mainType, subType, packet)
+}
+
+func (conn *underlayWSS) Close() error {
+	return conn.Conn.Close()
+}
+func (conn *underlayWSS) WLock() {
+	conn.writeMtx.Lock()
+}
+func (conn *underlayWSS) WUnlock() {
+	conn.writeMtx.Unlock()
+}
+
+// httpProxy uses the configured proxy, or HTTPS_PROXY in environment
+func httpProxy(req *http.Request) (*url.URL, error) {
+	proxy := gConf.Network.HTTPProxy
+	if proxy == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	return url.Parse(proxy)
+}
+
+func dialWSS(host string, port int, certHash string) (*underlayWSS, error) {
+	dialer := websocket.Dialer{
+		Proxy:            httpProxy,
+		HandshakeTimeout: UnderlayConnectTimeout,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, // self-signed, verified by hash below
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || certHash == "" {
+					return ErrWSSCertMismatch
+				}
+				sum := sha256.Sum256(rawCerts[0])
+				if hex.EncodeToString(sum[:]) != certHash {
+					return ErrWSSCertMismatch
+				}
+				return nil
+			},
+		},
+	}
+	u := url.URL{Scheme: "wss", Host: net.JoinHostPort(host, strconv.Itoa(port)), Path: WSSPath}
+	ws, _, err := dialer.Dial(u.String(), nil)
+	if err != nil {
+		gLog.Printf(LvDEBUG, "Dial %s error:%s", u.String(), err)
+		return nil, err
+	}
+	gLog.Printf(LvDEBUG, "Dial %s OK", u.String())
+	return &underlayWSS{writeMtx: &sync.Mutex{}, Conn: ws}, nil
+}
+
+var (
+	wssl            *wssListener
+	onceWSSListener sync.Once
+)
+
+type wssListener struct {
+	conns     sync.Map
+	port      int
+	certHash  string
+	listening atomic.Bool
+	acceptCh  chan bool
+	upgrader  websocket.Upgrader
+}
+
+// localWSS returns the port and cert hash for the peer, 0 if not listening
+func localWSS() (int, string) {
+	if wssl == nil || !wssl.listening.Load() {
+		return 0, ""
+	}
+	return wssl.port, wssl.certHash
+}
+
+func (wl *wssListener) start() {
+	wl.acceptCh = make(chan bool, 500)
+	for {
+		if err := wl.listen(); err != nil { // no permission or port in use, don't retry
+			return
+		}
+		time.Sleep(UnderlayTCPConnectTimeout)
+	}
+}
+
+func (wl *wssListener) listen() error {
+	cert, hash, err := newSelfSignedCert()
+	if err != nil {
+		gLog.Printf(LvERROR, "wssListener generate cert error:%s", err)
+		return err
+	}
+	l, err := tls.Listen("tcp", fmt.Sprintf(":%d", wl.port), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		gLog.Printf(LvERROR, "wssListener listen %d error:%s", wl.port, err)
+		return err
+	}
+	defer l.Close()
+	wl.port = l.Addr().(*net.TCPAddr).Port
+	wl.certHash = hash
+	wl.listening.Store(true)
+	defer wl.listening.Store(false)
+	gLog.Printf(LvINFO, "wssListener listen %d start", wl.port)
+	defer gLog.Printf(LvINFO, "wssListener listen %d end", wl.port)
+	srv := http.Server{Handler: wl, ReadHeaderTimeout: UnderlayTCPConnectTimeout}
+	srv.Serve(l)
+	return nil
+}
+
+func (wl *wssListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != WSSPath {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := wl.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		gLog.Println(LvDEBUG, "wssListener upgrade error:", err)
+		return
+	}
+	gLog.Println(LvDEBUG, "wssListener accept connection: ", r.RemoteAddr)
+	ul := &underlayWSS{writeMtx: &sync.Mutex{}, Conn: ws, connectTime: time.Now()}
+	ul.SetReadDeadline(time.Now().Add(UnderlayTCPConnectTimeout))
+	_, buff, err := ul.ReadBuffer()
+	if err != nil || len(buff) < 8 {
+		gLog.Println(LvDEBUG, "wssListener read handshake error:", err)
+		ul.Close()
+		return
+	}
+	ul.WriteBytes(MsgP2P, MsgTunnelHandshakeAck, buff)
+	tid := binary.LittleEndian.Uint64(buff[:8])
+	gLog.Println(LvDEBUG, "hello ", tid)
+	// clear timeout connection
+	wl.conns.Range(func(idx, i interface{}) bool {
+		u := i.(*underlayWSS)
+		if u.connectTime.Before(time.Now().Add(-UnderlayConnectTimeout)) {
+			wl.conns.Delete(idx)
+			u.Close()
+		}
+		return true
+	})
+	wl.conns.Store(tid, ul)
+	if len(wl.acceptCh) == 0 {
+		wl.acceptCh <- true
+	}
+}
+
+func (wl *wssListener) getUnderlay(tid uint64) *underlayWSS {
+	for i := 0; i < int(UnderlayConnectTimeout/(time.Millisecond*50)); i++ {
+		select {
+		case <-time.After(time.Millisecond * 50):
+		case <-wl.acceptCh:
+		}
+		if u, ok := wl.conns.LoadAndDelete(tid); ok {
+			return u.(*underlayWSS)
+		}
+	}
+	return nil
+}
+
+// newSelfSignedCert returns a new cert and the sha256 hex of it
+func newSelfSignedCert() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	sum := sha256.Sum256(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, hex.EncodeToString(sum[:]), nil
+}
+
+func (t *P2PTunnel) connectUnderlayWSS() (c underlay, err error) {
+	gLog.Printf(LvDEBUG, "connectUnderlayWSS %s start ", t.config.LogPeerNode())
+	defer gLog.Printf(LvDEBUG, "connectUnderlayWSS %s end ", t.config.LogPeerNode())
+	t.linkModeWeb = LinkModeWSS
+	if t.config.isUnderlayServer == 1 {
+		if port, _ := localWSS(); port == 0 {
+			return nil, ErrWSSUnavailable
+		}
+		GNetwork.push(t.config.PeerNode, MsgPushUnderlayConnect, nil)
+		ul := wssl.getUnderlay(t.id)
+		if ul == nil {
+			return nil, fmt.Errorf("wait wss connection timeout")
+		}
+		gLog.Println(LvINFO, "WSS connection ok")
+		return ul, nil
+	}
+
+	//else
+	if t.config.peerWSSPort == 0 {
+		return nil, ErrWSSUnavailable
+	}
+	GNetwork.read(t.config.PeerNode, MsgPush, MsgPushUnderlayConnect, ReadMsgTimeout)
+	ul, err := dialWSS(t.config.peerIP, t.config.peerWSSPort, t.config.peerWSSCertHash)
+	if err != nil {
+		return nil, fmt.Errorf("WSS dial to %s:%d error:%s", t.config.peerIP, t.config.peerWSSPort, err)
+	}
+	handshakeBegin := time.Now()
+	tidBuff := new(bytes.Buffer)
+	binary.Write(tidBuff, binary.LittleEndian, t.id)
+	ul.WriteBytes(MsgP2P, MsgTunnelHandshake, tidBuff.Bytes())
+	ul.SetReadDeadline(time.Now().Add(UnderlayConnectTimeout))
+	if _, _, err = ul.ReadBuffer(); err != nil {
+		ul.Close()
+		return nil, fmt.Errorf("read MsgTunnelHandshake error:%s", err)
+	}
+	gLog.Println(LvINFO, "rtt=", time.Since(handshakeBegin))
+	gLog.Println(LvINFO, "WSS connection ok")
+	return ul, nil
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// connectProxy is a minimal http CONNECT proxy
+func connectProxy(t *testing.T) (string, *int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	count := new(int)
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		*count++
+		w.WriteHeader(http.StatusOK)
+		src, _, _ := w.(http.Hijacker).Hijack()
+		go io.Copy(dst, src)
+		io.Copy(src, dst)
+		src.Close()
+		dst.Close()
+	}))
+	return l.Addr().String(), count
+}
+
+func TestUnderlayWSS(t *testing.T) {
+	if gLog == nil {
+		gLog = NewLogger(t.TempDir(), ProductName, LvDEBUG, 1024*1024, LogConsole)
+	}
+	wl := &wssListener{}
+	go wl.start()
+	for i := 0; i < 100 && !wl.listening.Load(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !wl.listening.Load() {
+		t.Fatal("wss listen error")
+	}
+	if _, err := dialWSS("127.0.0.1", wl.port, "0000"); err == nil {
+		t.Errorf("wrong cert hash not rejected")
+	}
+
+	proxy, count := connectProxy(t)
+	gConf.Network.HTTPProxy = proxy
+	defer func() { gConf.Network.HTTPProxy = "" }()
+	client, err := dialWSS("127.0.0.1", wl.port, wl.certHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if *count != 1 {
+		t.Errorf("not dialed through proxy")
+	}
+	tid := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tid, 123)
+	client.WriteBytes(MsgP2P, MsgTunnelHandshake, tid)
+	if _, buff, err := client.ReadBuffer(); err != nil || !bytes.Equal(buff, tid) {
+		t.Fatalf("handshake ack error:%v", err)
+	}
+	server := wl.getUnderlay(123)
+	if server == nil {
+		t.Fatal("accepted underlay not found")
+	}
+	defer server.Close()
+
+	data := bytes.Repeat([]byte("openp2p"), 1000)
+	for i := 0; i < 3; i++ {
+		server.WriteBytes(MsgP2P, MsgOverlayData, data)
+	}
+	for i := 0; i < 3; i++ {
+		head, buff, err := client.ReadBuffer()
+		if err != nil || head.SubType != MsgOverlayData || !bytes.Equal(buff, data) {
+			t.Fatalf("read %d error:%v", i, err)
+		}
+	}
+}
@@ -5,10 +5,30 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
 
+// 用户角色
+const (
+	RoleAdmin    = "admin"    // 所有权限，包括用户管理
+	RoleOperator = "operator" // 管理节点和映射
+	RoleReadOnly = "readonly" // 只读
+)
+
+// 角色等级，等级高的角色拥有等级低的角色的所有权限
+var roleLevels = map[string]int{
+	RoleReadOnly: 1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// 检查角色是否满足要求
+func roleAllowed(role string, required string) bool {
+	return roleLevels[role] > 0 && roleLevels[role] >= roleLevels[required]
+}
+
 // UserManager 用户管理器
 type UserManager struct {
 	users     map[string]User
@@ -17,6 +37,8 @@ type UserManager struct {
 	dataPath  string
 }
 
+var gUserManager = NewUserManager("config")
+
 // NewUserManager 创建用户管理器
 func NewUserManager(dataPath string) *UserManager {
 	return &UserManager{
@@ -47,8 +69,10 @@ func (um *UserManager) loadUsers() error {
 	// 检查文件是否存在
 	if _, err := os.Stat(userFile); os.IsNotExist(err) {
 		// 文件不存在，初始化空数据
+		um.userLock.Lock()
 		um.users = make(map[string]User)
 		um.adminUser = nil
+		um.userLock.Unlock()
 		return nil
 	}
 
@@ -66,6 +90,9 @@ func (um *UserManager) loadUsers() error {
 	if err := json.Unmarshal(data, &userData); err != nil {
 		return fmt.Errorf("解析用户数据失败: %v", err)
 	}
+	if userData.Users == nil {
+		userData.Users = make(map[string]User)
+	}
 
 	// 更新用户数据
 	um.userLock.Lock()
@@ -77,12 +104,11 @@ func (um *UserManager) loadUsers() error {
 	return nil
 }
 
-// 保存用户数据
+// 保存用户数据，调用方需持有 userLock
 func (um *UserManager) saveUsers() error {
 	userFile := filepath.Join(um.dataPath, "users.json")
 
 	// 准备数据
-	um.userLock.RLock()
 	userData := struct {
 		Admin *User           `json:"admin"`
 		Users map[string]User `json:"users"`
@@ -90,7 +116,6 @@ func (um *UserManager) saveUsers() error {
 		Admin: um.adminUser,
 		Users: um.users,
 	}
-	um.userLock.RUnlock()
 
 	// 序列化数据
 	data, err := json.MarshalIndent(userData, "", "  ")
@@ -98,8 +123,8 @@ func (um *UserManager) saveUsers() error {
 		return fmt.Errorf("序列化用户数据失败: %v", err)
 	}
 
-	// 写入文件
-	if err := os.WriteFile(userFile, data, 0644); err != nil {
+	// 写入文件，包含TOTP密钥，仅当前用户可读
+	if err := writeFileAtomic(userFile, data, 0600); err != nil {
 		return fmt.Errorf("写入用户数据文件失败: %v", err)
 	}
 
@@ -110,26 +135,30 @@ func (um *UserManager) saveUsers() error {
 func (um *UserManager) GetAdminUser() *User {
 	um.userLock.RLock()
 	defer um.userLock.RUnlock()
-	return um.adminUser
+	if um.adminUser == nil {
+		return nil
+	}
+	admin := *um.adminUser
+	return &admin
 }
 
 // SetAdminUser 设置管理员用户
 func (um *UserManager) SetAdminUser(user *User) error {
 	um.userLock.Lock()
+	defer um.userLock.Unlock()
 	um.adminUser = user
-	um.userLock.Unlock()
-
 	return um.saveUsers()
 }
 
-// GetUser 获取用户
+// GetUser 获取用户，返回副本
 func (um *UserManager) GetUser(username string) (*User, bool) {
 	um.userLock.RLock()
 	defer um.userLock.RUnlock()
 
 	// 检查是否是管理员
 	if um.adminUser != nil && um.adminUser.Username == username {
-		return um.adminUser, true
+		admin := *um.adminUser
+		return &admin, true
 	}
 
 	// 检查普通用户
@@ -140,12 +169,31 @@ func (um *UserManager) GetUser(username string) (*User, bool) {
 	return &user, true
 }
 
+// ListUsers 获取所有用户，管理员在前
+func (um *UserManager) ListUsers() []User {
+	um.userLock.RLock()
+	defer um.userLock.RUnlock()
+	list := make([]User, 0, len(um.users)+1)
+	if um.adminUser != nil {
+		list = append(list, *um.adminUser)
+	}
+	others := make([]User, 0, len(um.users))
+	for _, user := range um.users {
+		others = append(others, user)
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Username < others[j].Username })
+	return append(list, others...)
+}
+
 // AddUser 添加用户
 func (um *UserManager) AddUser(user User) error {
 	um.userLock.Lock()
-	um.users[user.Username] = user
-	um.userLock.Unlock()
+	defer um.userLock.Unlock()
 
+	if _, exists := um.users[user.Username]; exists || (um.adminUser != nil && um.adminUser.Username == user.Username) {
+		return fmt.Errorf("用户已存在: %s", user.Username)
+	}
+	um.users[user.Username] = user
 	return um.saveUsers()
 }
 
@@ -176,15 +224,14 @@ func (um *UserManager) UpdateUser(username string, updateFunc func(*User) error)
 	return um.saveUsers()
 }
 
-// DeleteUser 删除用户
+// DeleteUser 删除用户，唯一的管理员不能删除，否则第一个调用注册接口的人会成为管理员
 func (um *UserManager) DeleteUser(username string) error {
 	um.userLock.Lock()
 	defer um.userLock.Unlock()
 
 	// 检查是否是管理员
 	if um.adminUser != nil && um.adminUser.Username == username {
-		um.adminUser = nil
-		return um.saveUsers()
+		return fmt.Errorf("不能删除唯一的管理员: %s", username)
 	}
 
 	// 检查普通用户
@@ -209,8 +256,11 @@ func (um *UserManager) GetUserInfo(username string) (map[string]interface{}, err
 	if !exists {
 		return nil, fmt.Errorf("用户不存在: %s", username)
 	}
+	return userInfo(user), nil
+}
 
-	// 返回用户信息（不包含敏感信息）
+// 用户信息（不包含敏感信息）
+func userInfo(user *User) map[string]interface{} {
 	return map[string]interface{}{
 		"username": user.Username,
 		"role":     user.Role,
@@ -222,7 +272,7 @@ func (um *UserManager) GetUserInfo(username string) (map[string]interface{}, err
 			return user.Username
 		}(),
 		"email": user.Email,
-	}, nil
+	}
 }
 
 // UpdateUserInfo 更新用户信息
@@ -236,28 +286,37 @@ func (um *UserManager) UpdateUserInfo(username string, displayName, email string
 
 // CreateAdmin 创建管理员用户
 func (um *UserManager) CreateAdmin(username string, totpKey string) error {
-	if um.HasAdmin() {
+	um.userLock.Lock()
+	defer um.userLock.Unlock()
+	if um.adminUser != nil {
 		return fmt.Errorf("管理员已存在")
 	}
+	if _, exists := um.users[username]; exists {
+		return fmt.Errorf("用户已存在: %s", username)
+	}
 
-	admin := &User{
+	um.adminUser = &User{
 		Username: username,
 		TOTPKey:  totpKey,
-		Role:     "admin",
+		Role:     RoleAdmin,
 		Created:  time.Now(),
 	}
+	return um.saveUsers()
+}
 
-	return um.SetAdminUser(admin)
+// ResetTOTP 重置用户TOTP密钥
+func (um *UserManager) ResetTOTP(username string, newTOTPKey string) error {
+	return um.UpdateUser(username, func(user *User) error {
+		user.TOTPKey = newTOTPKey
+		return nil
+	})
 }
 
 // ResetAdminTOTP 重置管理员TOTP密钥
 func (um *UserManager) ResetAdminTOTP(newTOTPKey string) error {
-	if !um.HasAdmin() {
+	admin := um.GetAdminUser()
+	if admin == nil {
 		return fmt.Errorf("管理员不存在")
 	}
-
-	return um.UpdateUser(um.adminUser.Username, func(user *User) error {
-		user.TOTPKey = newTOTPKey
-		return nil
-	})
+	return um.ResetTOTP(admin.Username, newTOTPKey)
 }
@@ -0,0 +1,219 @@
+// Package natdetect serves the NAT type detection, TCP ifconfig and public ip
+// echo probes that openp2p clients send to their server. With an alternate ip
+// it answers the RFC 5780 change requests, so the clients can tell the mapping
+// and filtering behavior of their NAT.
+package natdetect
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"openp2p/core"
+)
+
+const (
+	headerSize    = 8
+	maxPacketLen  = 1024
+	tcpReadTimout = 5 * time.Second
+)
+
+type Config struct {
+	UDPPorts []int  // MsgNATDetect, default UDPPort1 UDPPort2. the first two are the primary and alternate port
+	TCPPorts []int  // ifconfig, default IfconfigPort1 IfconfigPort2
+	IP       string // primary public ip, listen on all ips if empty
+	AltIP    string // alternate public ip for the change ip test, needs IP
+}
+
+// udpKey is the index of the ip and port of a udp socket
+type udpKey struct {
+	ip   int
+	port int
+}
+
+type Server struct {
+	config    Config
+	mtx       sync.Mutex
+	conns     []*net.UDPConn
+	udp       map[udpKey]*net.UDPConn
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+func New(config Config) *Server {
+	if len(config.UDPPorts) == 0 {
+		config.UDPPorts = []int{core.UDPPort1, core.UDPPort2}
+	}
+	if len(config.TCPPorts) == 0 {
+		config.TCPPorts = []int{core.IfconfigPort1, core.IfconfigPort2}
+	}
+	return &Server{config: config}
+}
+
+// Start listens all ports and serves in background.
+func (s *Server) Start() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ips := []net.IP{nil}
+	if s.config.IP != "" {
+		ips[0] = net.ParseIP(s.config.IP)
+		if ips[0] == nil {
+			return fmt.Errorf("natdetect invalid ip %s", s.config.IP)
+		}
+	}
+	if s.config.AltIP != "" {
+		altIP := net.ParseIP(s.config.AltIP)
+		if altIP == nil || ips[0] == nil {
+			return fmt.Errorf("natdetect invalid alternate ip %s, the primary ip must be set too", s.config.AltIP)
+		}
+		ips = append(ips, altIP)
+	}
+	// bind all sockets before serving, the change requests reply from the others
+	s.udp = make(map[udpKey]*net.UDPConn)
+	for i, ip := range ips {
+		for j, port := range s.config.UDPPorts {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				s.close()
+				return fmt.Errorf("natdetect listen udp %s:%d error:%s", ip, port, err)
+			}
+			s.conns = append(s.conns, conn)
+			s.udp[udpKey{i, j}] = conn
+		}
+	}
+	for key, conn := range s.udp {
+		s.wg.Add(1)
+		go s.serveUDP(conn, key)
+	}
+	for _, port := range s.config.TCPPorts {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			s.close()
+			return fmt.Errorf("natdetect listen tcp %d error:%s", port, err)
+		}
+		s.listeners = append(s.listeners, l)
+		s.wg.Add(1)
+		go s.serveTCP(l)
+	}
+	log.Printf("natdetect listen on udp %v, tcp %v, ip %s, alternate ip %s", s.config.UDPPorts, s.config.TCPPorts, s.config.IP, s.config.AltIP)
+	return nil
+}
+
+func (s *Server) Close() {
+	s.mtx.Lock()
+	s.close()
+	s.mtx.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) close() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.conns = nil
+	s.listeners = nil
+}
+
+// other returns the socket which differs in the changed ip and port, nil if not listening
+func (s *Server) other(key udpKey, changeIP bool, changePort bool) *net.UDPConn {
+	if changeIP {
+		key.ip ^= 1
+	}
+	if changePort {
+		key.port ^= 1
+	}
+	return s.udp[key]
+}
+
+func (s *Server) serveUDP(conn *net.UDPConn, key udpKey) {
+	// the other address of RFC 5780, both ip and port changed
+	otherIP, otherPort := "", 0
+	if other := s.other(key, false, true); other != nil {
+		otherPort = other.LocalAddr().(*net.UDPAddr).Port
+	}
+	if other := s.other(key, true, false); other != nil {
+		otherIP = other.LocalAddr().(*net.UDPAddr).IP.String()
+	}
+	defer s.wg.Done()
+	buf := make([]byte, maxPacketLen)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		if n < headerSize || binary.LittleEndian.Uint16(buf[4:6]) != core.MsgNATDetect {
+			continue
+		}
+		switch binary.LittleEndian.Uint16(buf[6:8]) {
+		case core.MsgNAT:
+			req := core.NatDetectReq{} // old clients send no request
+			json.Unmarshal(buf[headerSize:n], &req)
+			replyConn := conn
+			if req.ChangeIP || req.ChangePort {
+				if replyConn = s.other(key, req.ChangeIP, req.ChangePort); replyConn == nil {
+					continue // can't change, no reply as RFC 5780 servers without alternate address
+				}
+			}
+			rsp := core.NatDetectRsp{IP: addr.IP.String(), Port: addr.Port, OtherIP: otherIP, OtherPort: otherPort}
+			writeUDP(replyConn, addr, core.MsgNAT, &rsp)
+		case core.MsgPublicIP:
+			req := core.NatDetectReq{}
+			if err = json.Unmarshal(buf[headerSize:n], &req); err != nil || req.EchoPort <= 0 || req.EchoPort > 65535 {
+				continue
+			}
+			// echo to the other port of the same ip, it only arrives when that port is reachable
+			echoAddr := &net.UDPAddr{IP: addr.IP, Port: req.EchoPort}
+			rsp := core.NatDetectRsp{IP: addr.IP.String(), Port: req.EchoPort, IsPublicIP: 1}
+			writeUDP(conn, echoAddr, core.MsgPublicIP, &rsp)
+		}
+	}
+}
+
+func writeUDP(conn *net.UDPConn, addr *net.UDPAddr, subType uint16, packet interface{}) {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return
+	}
+	msg := make([]byte, headerSize, headerSize+len(data))
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint16(msg[4:6], core.MsgNATDetect)
+	binary.LittleEndian.PutUint16(msg[6:8], subType)
+	if _, err = conn.WriteToUDP(append(msg, data...), addr); err != nil {
+		log.Printf("natdetect write to %s error:%s", addr, err)
+	}
+}
+
+// serveTCP answers "ip:port" of the peer, the client writes "1" first.
+func (s *Server) serveTCP(l net.Listener) {
+	defer s.wg.Done()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			c.SetDeadline(time.Now().Add(tcpReadTimout))
+			b := make([]byte, 16)
+			if _, err := c.Read(b); err != nil {
+				return
+			}
+			addr := c.RemoteAddr().(*net.TCPAddr)
+			c.Write([]byte(addr.IP.String() + ":" + strconv.Itoa(addr.Port)))
+		}(c)
+	}
+}
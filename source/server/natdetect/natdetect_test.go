@@ -0,0 +1,134 @@
+package natdetect
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"openp2p/core"
+)
+
+func natMessage(subType uint16, packet interface{}) []byte {
+	data, _ := json.Marshal(packet)
+	msg := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(msg[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint16(msg[4:6], core.MsgNATDetect)
+	binary.LittleEndian.PutUint16(msg[6:8], subType)
+	return append(msg, data...)
+}
+
+func TestNATDetect(t *testing.T) {
+	s := New(Config{UDPPorts: []int{0}, TCPPorts: []int{0}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	udpPort := s.conns[0].LocalAddr().(*net.UDPAddr).Port
+	tcpPort := s.listeners[0].Addr().(*net.TCPAddr).Port
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udpPort}
+
+	conn, _ := net.ListenUDP("udp4", nil)
+	defer conn.Close()
+	conn.WriteToUDP(natMessage(core.MsgNAT, nil), dst)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("nat detect read error:%s", err)
+	}
+	rsp := core.NatDetectRsp{}
+	json.Unmarshal(buf[headerSize:n], &rsp)
+	if rsp.Port != conn.LocalAddr().(*net.UDPAddr).Port || rsp.IP != "127.0.0.1" {
+		t.Errorf("nat detect rsp error:%+v", rsp)
+	}
+
+	echoConn, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer echoConn.Close()
+	echoPort := echoConn.LocalAddr().(*net.UDPAddr).Port
+	conn.WriteToUDP(natMessage(core.MsgPublicIP, core.NatDetectReq{EchoPort: echoPort}), dst)
+	echoConn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, _, err = echoConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("public ip echo read error:%s", err)
+	}
+	rsp = core.NatDetectRsp{}
+	json.Unmarshal(buf[headerSize:n], &rsp)
+	if rsp.Port != echoPort || rsp.IsPublicIP != 1 {
+		t.Errorf("public ip echo rsp error:%+v", rsp)
+	}
+
+	c, err := net.Dial("tcp4", fmt.Sprintf("127.0.0.1:%d", tcpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("1"))
+	c.SetReadDeadline(time.Now().Add(time.Second * 3))
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatalf("ifconfig read error:%s", err)
+	}
+	if string(buf[:n]) != c.LocalAddr().String() && !strings.HasSuffix(c.LocalAddr().String(), string(buf[:n])) {
+		t.Errorf("ifconfig rsp %s, want %s", buf[:n], c.LocalAddr())
+	}
+}
+
+func TestNATDetectChange(t *testing.T) {
+	ports := []int{}
+	for i := 0; i < 2; i++ {
+		c, _ := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		ports = append(ports, c.LocalAddr().(*net.UDPAddr).Port)
+		c.Close()
+	}
+	s := New(Config{UDPPorts: ports, TCPPorts: []int{0}, IP: "127.0.0.1", AltIP: "127.0.0.2"})
+	if err := s.Start(); err != nil {
+		t.Skip("alternate loopback ip unavailable:", err)
+	}
+	defer s.Close()
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ports[0]}
+	conn, _ := net.ListenUDP("udp4", nil)
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	tests := []struct {
+		req  core.NatDetectReq
+		from string
+	}{
+		{core.NatDetectReq{}, fmt.Sprintf("127.0.0.1:%d", ports[0])},
+		{core.NatDetectReq{ChangePort: true}, fmt.Sprintf("127.0.0.1:%d", ports[1])},
+		{core.NatDetectReq{ChangeIP: true}, fmt.Sprintf("127.0.0.2:%d", ports[0])},
+		{core.NatDetectReq{ChangeIP: true, ChangePort: true}, fmt.Sprintf("127.0.0.2:%d", ports[1])},
+	}
+	for _, tt := range tests {
+		conn.WriteToUDP(natMessage(core.MsgNAT, tt.req), dst)
+		conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%+v read error:%s", tt.req, err)
+		}
+		if from.String() != tt.from {
+			t.Errorf("%+v replied from %s, want %s", tt.req, from, tt.from)
+		}
+		rsp := core.NatDetectRsp{}
+		json.Unmarshal(buf[headerSize:n], &rsp)
+		if rsp.OtherIP != "127.0.0.2" || rsp.OtherPort != ports[1] || rsp.Port != conn.LocalAddr().(*net.UDPAddr).Port {
+			t.Errorf("%+v rsp error:%+v", tt.req, rsp)
+		}
+	}
+
+	// a server with one ip can't change ip, no reply
+	single := New(Config{UDPPorts: []int{0}, TCPPorts: []int{0}})
+	if err := single.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer single.Close()
+	singleDst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: single.conns[0].LocalAddr().(*net.UDPAddr).Port}
+	conn.WriteToUDP(natMessage(core.MsgNAT, core.NatDetectReq{ChangeIP: true}), singleDst)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	if _, _, err := conn.ReadFromUDP(buf); err == nil {
+		t.Errorf("change ip replied by a server without alternate ip")
+	}
+}
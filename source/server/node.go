@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"openp2p/core"
+
+	"github.com/gorilla/websocket"
+)
+
+// nodeConn is one logged in client.
+type nodeConn struct {
+	id       uint64
+	name     string
+	user     string
+	token    uint64
+	version  string
+	natType  int
+	ip       string // public ip seen by server
+	identity string // ed25519 public key, base64
+
+	shareBandwidth  int
+	lanIP           string
+	hasIPv4         int
+	ipv6            string
+	hasUPNPorNATPMP int
+	natBehavior     *core.NATBehavior // nil if the node or its natdetect server can't classify
+
+	conn     *websocket.Conn
+	writeMtx sync.Mutex
+	mtx      sync.Mutex // protect report fields
+	loginTs  time.Time
+	hbTime   time.Time
+}
+
+func (n *nodeConn) write(msg []byte) error {
+	n.writeMtx.Lock()
+	defer n.writeMtx.Unlock()
+	n.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return n.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+func (n *nodeConn) writeMessage(mainType uint16, subType uint16, packet interface{}) error {
+	msg, err := newMessage(mainType, subType, packet)
+	if err != nil {
+		return err
+	}
+	return n.write(msg)
+}
+
+// writePush send a server side push message. It has no PushHeader, but client
+// always reads PushHeaderSize bytes after header, so pad the json body.
+func (n *nodeConn) writePush(subType uint16, packet interface{}) error {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	for len(data) < core.PushHeaderSize {
+		data = append(data, ' ')
+	}
+	return n.write(append(encodeHeader(core.MsgPush, subType, uint32(len(data))), data...))
+}
+
+func (n *nodeConn) close() {
+	n.conn.Close()
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"openp2p/core"
+)
+
+// header mirrors the openP2PHeader wire format in core/protocol.go:
+// DataLen(uint32) MainType(uint16) SubType(uint16), little endian.
+type header struct {
+	DataLen  uint32
+	MainType uint16
+	SubType  uint16
+}
+
+var headerSize = binary.Size(header{})
+
+var errShortMessage = errors.New("message too short")
+
+func decodeHeader(msg []byte) (*header, error) {
+	if len(msg) < headerSize {
+		return nil, errShortMessage
+	}
+	head := header{}
+	if err := binary.Read(bytes.NewReader(msg[:headerSize]), binary.LittleEndian, &head); err != nil {
+		return nil, err
+	}
+	return &head, nil
+}
+
+func encodeHeader(mainType uint16, subType uint16, dataLen uint32) []byte {
+	buf := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(buf[0:4], dataLen)
+	binary.LittleEndian.PutUint16(buf[4:6], mainType)
+	binary.LittleEndian.PutUint16(buf[6:8], subType)
+	return buf
+}
+
+func newMessage(mainType uint16, subType uint16, packet interface{}) ([]byte, error) {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return nil, err
+	}
+	return append(encodeHeader(mainType, subType, uint32(len(data))), data...), nil
+}
+
+func decodePushHeader(msg []byte) (*core.PushHeader, error) {
+	if len(msg) < headerSize+core.PushHeaderSize {
+		return nil, errShortMessage
+	}
+	pushHead := core.PushHeader{}
+	err := binary.Read(bytes.NewReader(msg[headerSize:headerSize+core.PushHeaderSize]), binary.LittleEndian, &pushHead)
+	if err != nil {
+		return nil, err
+	}
+	return &pushHead, nil
+}
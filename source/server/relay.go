@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"openp2p/core"
+
+	"github.com/openp2p-cn/totp"
+)
+
+const (
+	RelayModePrivate = "private"
+	RelayModePublic  = "public"
+)
+
+// relayScore returns how well relay can serve from and to, 0 means can't relay.
+// Both peers dial the relay directly, so a reachable relay is preferred:
+// public ip > upnp/nat-pmp > cone nat. Own nodes are preferred to shared ones.
+func relayScore(relay *nodeConn, from *nodeConn, to *nodeConn) int {
+	if relay == from || relay == to {
+		return 0
+	}
+	relay.mtx.Lock()
+	defer relay.mtx.Unlock()
+	score := 0
+	switch {
+	case relay.hasIPv4 == 1 || relay.natType == core.NATNone:
+		score = 3
+	case relay.hasUPNPorNATPMP == 1:
+		score = 2
+	case relay.natType == core.NATCone:
+		score = 1
+	default:
+		return 0
+	}
+	if relay.user == from.user {
+		return score + 10
+	}
+	if relay.shareBandwidth <= 0 {
+		return 0
+	}
+	return score
+}
+
+// selectRelay picks the best relay node for from and to, except the excluded
+// ones. A pinned relay is used if it can relay, otherwise nil.
+func (s *Server) selectRelay(from *nodeConn, to *nodeConn, pinned string, exclude []string) *nodeConn {
+	if pinned != "" {
+		relay := s.node(core.NodeNameToID(pinned))
+		if relay == nil || relayScore(relay, from, to) == 0 {
+			return nil
+		}
+		return relay
+	}
+	var best *nodeConn
+	bestScore := 0
+	s.nodes.Range(func(_, i interface{}) bool {
+		relay := i.(*nodeConn)
+		score := relayScore(relay, from, to)
+		if score == 0 || isExcluded(relay.name, exclude) {
+			return true
+		}
+		if score > bestScore || (score == bestScore && relay.shareBandwidth > best.shareBandwidth) ||
+			(score == bestScore && relay.shareBandwidth == best.shareBandwidth && relay.name < best.name) {
+			best = relay
+			bestScore = score
+		}
+		return true
+	})
+	return best
+}
+
+func isExcluded(name string, exclude []string) bool {
+	for _, e := range exclude {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleRelayNodeReq(n *nodeConn, body []byte) error {
+	req := core.RelayNodeReq{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return err
+	}
+	rsp := core.RelayNodeRsp{}
+	peer := s.node(core.NodeNameToID(req.PeerNode))
+	if peer == nil {
+		log.Printf("node %s request relay to %s error: peer offline", n.name, req.PeerNode)
+		return n.writeMessage(core.MsgRelay, core.MsgRelayNodeRsp, &rsp)
+	}
+	relay := s.selectRelay(n, peer, req.RelayNode, req.Exclude)
+	if relay == nil {
+		log.Printf("node %s request relay to %s error: no relay node", n.name, req.PeerNode)
+		return n.writeMessage(core.MsgRelay, core.MsgRelayNodeRsp, &rsp)
+	}
+	rsp.RelayName = relay.name
+	if relay.user == n.user {
+		rsp.Mode = RelayModePrivate
+		rsp.RelayToken = relay.token
+	} else {
+		// don't leak the token of a shared relay, the relay verifies totp and limits bandwidth
+		rsp.Mode = RelayModePublic
+		t := totp.TOTP{Step: totp.RelayTOTPStep}
+		rsp.RelayToken = t.Gen(relay.token, time.Now().Unix())
+	}
+	log.Printf("node %s relay to %s by %s, mode %s", n.name, req.PeerNode, relay.name, rsp.Mode)
+	return n.writeMessage(core.MsgRelay, core.MsgRelayNodeRsp, &rsp)
+}
@@ -0,0 +1,454 @@
+// Package server is a self-hosted openp2p signaling server. Clients login by
+// websocket, keep alive by heartbeat, and exchange push messages through it.
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"openp2p/core"
+
+	"github.com/gorilla/websocket"
+	"github.com/openp2p-cn/totp"
+)
+
+const (
+	loginPath     = "/api/v1/login"
+	readTimeout   = core.NetworkHeartbeatTime*2 + 10*time.Second
+	writeTimeout  = 10 * time.Second
+	maxMessageLen = 1024 * 1024
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrInvalidNode  = errors.New("invalid node name")
+	ErrRevoked      = errors.New("node identity revoked")
+)
+
+type Config struct {
+	Port          int
+	CertFile      string // empty: generate a self-signed cert
+	KeyFile       string
+	UsersFile     string // json {"user":token}; empty: any token accepted
+	LoginMaxDelay int    // seconds, tell clients how long to spread reconnects
+	RevokedFile   string // json ["identity"], revoked node identities pushed to clients
+}
+
+type Server struct {
+	config   Config
+	users    map[uint64]string // token -> user
+	revoked  []string          // node identities
+	mtx      sync.Mutex        // guards revoked
+	nodes    sync.Map          // node id -> *nodeConn
+	upgrader websocket.Upgrader
+	srv      *http.Server
+}
+
+func New(config Config) (*Server, error) {
+	if config.Port == 0 {
+		config.Port = core.WsPort
+	}
+	s := &Server{
+		config: config,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  core.ReadBuffLen,
+			WriteBufferSize: core.ReadBuffLen,
+		},
+	}
+	if config.UsersFile != "" {
+		users, err := loadUsers(config.UsersFile)
+		if err != nil {
+			return nil, err
+		}
+		s.users = users
+	}
+	if config.RevokedFile != "" {
+		revoked, err := loadRevoked(config.RevokedFile)
+		if err != nil {
+			return nil, err
+		}
+		s.revoked = revoked
+	}
+	return s, nil
+}
+
+func (s *Server) isRevoked(identity string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, r := range s.revoked {
+		if r == identity {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) revokedIdentities() *core.RevokedIdentities {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return &core.RevokedIdentities{Identities: s.revoked}
+}
+
+// ReloadRevoked reads RevokedFile again and pushes the list to all online nodes,
+// an empty list too, so clients drop identities that are no longer revoked.
+// Nodes whose identity is revoked now are disconnected.
+func (s *Server) ReloadRevoked() error {
+	if s.config.RevokedFile == "" {
+		return nil
+	}
+	revoked, err := loadRevoked(s.config.RevokedFile)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.revoked = revoked
+	s.mtx.Unlock()
+	log.Printf("%d identities revoked", len(revoked))
+	s.nodes.Range(func(_, i interface{}) bool {
+		n := i.(*nodeConn)
+		if n.identity != "" && s.isRevoked(n.identity) {
+			log.Printf("node %s identity revoked, close it", n.name)
+			s.logout(n)
+			return true
+		}
+		n.writePush(core.MsgPushRevokedIdentities, s.revokedIdentities())
+		return true
+	})
+	return nil
+}
+
+func loadRevoked(path string) ([]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	revoked := []string{}
+	if err = json.Unmarshal(buf, &revoked); err != nil {
+		return nil, fmt.Errorf("parse %s error:%s", path, err)
+	}
+	return revoked, nil
+}
+
+func loadUsers(path string) (map[uint64]string, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := map[string]uint64{}
+	if err = json.Unmarshal(buf, &tokens); err != nil {
+		return nil, fmt.Errorf("parse %s error:%s", path, err)
+	}
+	users := make(map[uint64]string, len(tokens))
+	for user, token := range tokens {
+		if token == 0 {
+			return nil, fmt.Errorf("user %s token is 0", user)
+		}
+		users[token] = user
+	}
+	return users, nil
+}
+
+// Handler returns the http handler, useful for embedding or testing.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(loginPath, s.handleLogin)
+	return mux
+}
+
+func (s *Server) ListenAndServe() error {
+	cert, err := s.certificate()
+	if err != nil {
+		return err
+	}
+	s.srv = &http.Server{
+		Addr:      fmt.Sprintf(":%d", s.config.Port),
+		Handler:   s.Handler(),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	log.Printf("openp2p server listen on :%d", s.config.Port)
+	err = s.srv.ListenAndServeTLS("", "")
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Close() error {
+	s.nodes.Range(func(_, i interface{}) bool {
+		i.(*nodeConn).close()
+		return true
+	})
+	if s.srv != nil {
+		return s.srv.Close()
+	}
+	return nil
+}
+
+func (s *Server) certificate() (tls.Certificate, error) {
+	if s.config.CertFile != "" {
+		return tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	}
+	log.Println("no cert file, use a self-signed cert. clients will not trust it unless they add it to their root CAs")
+	return selfSignedCert()
+}
+
+// authenticate returns the user of token. Without users file every token is
+// accepted, token 0 will be assigned a new one.
+func (s *Server) authenticate(token uint64) (string, uint64, error) {
+	if s.users != nil {
+		user, ok := s.users[token]
+		if !ok {
+			return "", 0, ErrInvalidToken
+		}
+		return user, token, nil
+	}
+	for token == 0 {
+		b := make([]byte, 8)
+		if _, err := rand.Read(b); err != nil {
+			return "", 0, err
+		}
+		token = binary.LittleEndian.Uint64(b)
+	}
+	return strconv.FormatUint(token, 16), token, nil
+}
+
+func (s *Server) node(id uint64) *nodeConn {
+	i, ok := s.nodes.Load(id)
+	if !ok {
+		return nil
+	}
+	return i.(*nodeConn)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("node")
+	token, _ := strconv.ParseUint(q.Get("token"), 10, 64)
+	natType, _ := strconv.Atoi(q.Get("nattype"))
+	shareBandwidth, _ := strconv.Atoi(q.Get("sharebandwidth"))
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("upgrade %s error:%s", r.RemoteAddr, err)
+		return
+	}
+	n := &nodeConn{
+		id:             core.NodeNameToID(name),
+		name:           name,
+		version:        q.Get("version"),
+		identity:       q.Get("identity"),
+		natType:        natType,
+		shareBandwidth: shareBandwidth,
+		ip:             remoteIP(ws.RemoteAddr()),
+		conn:           ws,
+		loginTs:        time.Now(),
+		hbTime:         time.Now(),
+	}
+	rsp := core.LoginRsp{}
+	if len(name) < core.MinNodeNameLen {
+		err = ErrInvalidNode
+	} else if n.identity != "" && s.isRevoked(n.identity) {
+		err = ErrRevoked
+	} else {
+		n.user, n.token, err = s.authenticate(token)
+	}
+	if err != nil {
+		log.Printf("node %s login from %s error:%s", name, n.ip, err)
+		rsp.Error = 1
+		rsp.Detail = err.Error()
+		n.writeMessage(core.MsgLogin, 0, &rsp)
+		n.close()
+		return
+	}
+	if old, loaded := s.nodes.Swap(n.id, n); loaded {
+		log.Printf("node %s login again, close the old connection", name)
+		old.(*nodeConn).close()
+	}
+	rsp.User = n.user
+	rsp.Node = n.name
+	rsp.Token = n.token
+	rsp.Ts = time.Now().Unix()
+	rsp.LoginMaxDelay = s.config.LoginMaxDelay
+	if err = n.writeMessage(core.MsgLogin, 0, &rsp); err != nil {
+		s.logout(n)
+		return
+	}
+	log.Printf("node %s login ok. user=%s,ip=%s,version=%s,natType=%d", n.name, n.user, n.ip, n.version, n.natType)
+	// always push, an empty list clears what the client kept from an older list
+	n.writePush(core.MsgPushRevokedIdentities, s.revokedIdentities())
+	s.notifyOnline(n)
+	go s.readLoop(n)
+}
+
+func (s *Server) logout(n *nodeConn) {
+	n.close()
+	if s.nodes.CompareAndDelete(n.id, n) {
+		log.Printf("node %s logout", n.name)
+	}
+}
+
+// notifyOnline tell the same user's nodes to retry their apps to n.
+func (s *Server) notifyOnline(n *nodeConn) {
+	s.nodes.Range(func(_, i interface{}) bool {
+		peer := i.(*nodeConn)
+		if peer != n && peer.user == n.user {
+			peer.writePush(core.MsgPushDstNodeOnline, &core.PushDstNodeOnline{Node: n.name})
+		}
+		return true
+	})
+}
+
+func (s *Server) readLoop(n *nodeConn) {
+	defer s.logout(n)
+	n.conn.SetReadLimit(maxMessageLen)
+	for {
+		n.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		_, msg, err := n.conn.ReadMessage()
+		if err != nil {
+			log.Printf("node %s read error:%s", n.name, err)
+			return
+		}
+		if err = s.handleMessage(n, msg); err != nil {
+			log.Printf("node %s handle message error:%s", n.name, err)
+		}
+	}
+}
+
+func (s *Server) handleMessage(n *nodeConn, msg []byte) error {
+	head, err := decodeHeader(msg)
+	if err != nil {
+		return err
+	}
+	body := msg[headerSize:]
+	switch head.MainType {
+	case core.MsgHeartbeat:
+		n.mtx.Lock()
+		n.hbTime = time.Now()
+		n.mtx.Unlock()
+		rsp := encodeHeader(core.MsgHeartbeat, 0, 8)
+		rsp = binary.LittleEndian.AppendUint64(rsp, uint64(time.Now().UnixNano()))
+		return n.write(rsp)
+	case core.MsgPush:
+		return s.handlePush(n, head.SubType, msg)
+	case core.MsgQuery:
+		if head.SubType == core.MsgQueryPeerInfoReq {
+			return s.handleQueryPeerInfo(n, body)
+		}
+	case core.MsgReport:
+		if head.SubType == core.MsgReportBasic {
+			return s.handleReportBasic(n, body)
+		}
+	case core.MsgRelay:
+		if head.SubType == core.MsgRelayNodeReq {
+			return s.handleRelayNodeReq(n, body)
+		}
+	}
+	return nil
+}
+
+// pushes only allowed between nodes of the same user
+var privatePush = map[uint16]bool{
+	core.MsgPushUpdate:               true,
+	core.MsgPushReportApps:           true,
+	core.MsgPushEditApp:              true,
+	core.MsgPushSwitchApp:            true,
+	core.MsgPushRestart:              true,
+	core.MsgPushEditNode:             true,
+	core.MsgPushReportLog:            true,
+	core.MsgPushDstNodeOnline:        true,
+	core.MsgPushReportGoroutine:      true,
+	core.MsgPushReportMemApps:        true,
+	core.MsgPushServerSideSaveMemApp: true,
+	core.MsgPushCheckRemoteService:   true,
+}
+
+// pushes only sent by server, never forwarded
+var serverPush = map[uint16]bool{
+	core.MsgPushRevokedIdentities: true,
+}
+
+// handlePush forward the message as is, the receiver parse PushHeader itself.
+func (s *Server) handlePush(n *nodeConn, subType uint16, msg []byte) error {
+	pushHead, err := decodePushHeader(msg)
+	if err != nil {
+		return err
+	}
+	if pushHead.From != n.id {
+		return fmt.Errorf("push from %d mismatch node id %d", pushHead.From, n.id)
+	}
+	if serverPush[subType] {
+		return fmt.Errorf("push %d from node %s not allowed", subType, n.name)
+	}
+	peer := s.node(pushHead.To)
+	if peer == nil {
+		return n.writePush(core.MsgPushRsp, &core.PushRsp{Error: 1, Detail: "peer offline"})
+	}
+	if privatePush[subType] && peer.user != n.user {
+		return n.writePush(core.MsgPushRsp, &core.PushRsp{Error: 2, Detail: "no permission"})
+	}
+	if err = peer.write(msg); err != nil {
+		peer.close()
+		return n.writePush(core.MsgPushRsp, &core.PushRsp{Error: 1, Detail: "peer offline"})
+	}
+	return nil
+}
+
+// canAccess: same user, or the peer's token, or a totp of the peer's token.
+func canAccess(n *nodeConn, peer *nodeConn, token uint64) bool {
+	if peer.user == n.user {
+		return true
+	}
+	t := totp.TOTP{Step: totp.RelayTOTPStep}
+	return t.Verify(token, peer.token, time.Now().Unix())
+}
+
+func (s *Server) handleQueryPeerInfo(n *nodeConn, body []byte) error {
+	req := core.QueryPeerInfoReq{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return err
+	}
+	rsp := core.QueryPeerInfoRsp{PeerNode: req.PeerNode}
+	peer := s.node(core.NodeNameToID(req.PeerNode))
+	if peer != nil && canAccess(n, peer, req.Token) {
+		peer.mtx.Lock()
+		rsp.Online = 1
+		rsp.Version = peer.version
+		rsp.NatType = peer.natType
+		rsp.IPv4 = peer.ip
+		rsp.LanIP = peer.lanIP
+		rsp.HasIPv4 = peer.hasIPv4
+		rsp.IPv6 = peer.ipv6
+		rsp.HasUPNPorNATPMP = peer.hasUPNPorNATPMP
+		rsp.Identity = peer.identity
+		rsp.NatBehavior = peer.natBehavior
+		peer.mtx.Unlock()
+	}
+	return n.writeMessage(core.MsgQuery, core.MsgQueryPeerInfoRsp, &rsp)
+}
+
+func (s *Server) handleReportBasic(n *nodeConn, body []byte) error {
+	req := core.ReportBasic{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return err
+	}
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.lanIP = req.LanIP
+	n.hasIPv4 = req.HasIPv4
+	n.ipv6 = req.IPv6
+	n.hasUPNPorNATPMP = req.HasUPNPorNATPMP
+	n.natBehavior = req.NatBehavior
+	if req.Version != "" {
+		n.version = req.Version
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"openp2p/core"
+
+	"github.com/gorilla/websocket"
+)
+
+func login(t *testing.T, url string, node string, token uint64) (*websocket.Conn, core.LoginRsp) {
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s%s?node=%s&token=%d&version=%s", url, loginPath, node, token, core.OpenP2PVersion), nil)
+	if err != nil {
+		t.Fatalf("dial error:%s", err)
+	}
+	rsp := core.LoginRsp{}
+	head, body := readMsg(t, ws)
+	if head.MainType != core.MsgLogin {
+		t.Fatalf("want login rsp, got %d", head.MainType)
+	}
+	json.Unmarshal(body, &rsp)
+	if rsp.Error == 0 {
+		if head, _ = readMsg(t, ws); head.SubType != core.MsgPushRevokedIdentities {
+			t.Fatalf("want revoked list push, got %d:%d", head.MainType, head.SubType)
+		}
+	}
+	return ws, rsp
+}
+
+func readMsg(t *testing.T, ws *websocket.Conn) (*header, []byte) {
+	ws.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("read error:%s", err)
+	}
+	head, err := decodeHeader(msg)
+	if err != nil {
+		t.Fatalf("decode header error:%s", err)
+	}
+	return head, msg[headerSize:]
+}
+
+func TestLoginHeartbeatPush(t *testing.T) {
+	s, _ := New(Config{})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	n1, rsp1 := login(t, url, "testnode1", 0)
+	defer n1.Close()
+	if rsp1.Error != 0 || rsp1.Token == 0 || rsp1.Node != "testnode1" {
+		t.Fatalf("login error:%+v", rsp1)
+	}
+	n2, rsp2 := login(t, url, "testnode2", rsp1.Token)
+	defer n2.Close()
+	if rsp2.User != rsp1.User {
+		t.Errorf("same token different user %s %s", rsp1.User, rsp2.User)
+	}
+	// n1 notified n2 online
+	head, _ := readMsg(t, n1)
+	if head.MainType != core.MsgPush || head.SubType != core.MsgPushDstNodeOnline {
+		t.Errorf("want DstNodeOnline, got %d:%d", head.MainType, head.SubType)
+	}
+
+	before := time.Now().UnixNano()
+	n1.WriteMessage(websocket.BinaryMessage, encodeHeader(core.MsgHeartbeat, 0, 0))
+	head, body := readMsg(t, n1)
+	if head.MainType != core.MsgHeartbeat || len(body) != 8 || int64(binary.LittleEndian.Uint64(body)) < before {
+		t.Errorf("heartbeat rsp error")
+	}
+
+	data, _ := json.Marshal(core.TunnelMsg{ID: 123})
+	pushHead := core.PushHeader{From: core.NodeNameToID("testnode1"), To: core.NodeNameToID("testnode2")}
+	buf := bytes.NewBuffer(encodeHeader(core.MsgPush, core.MsgPushConnectRsp, uint32(len(data)+core.PushHeaderSize)))
+	binary.Write(buf, binary.LittleEndian, pushHead)
+	buf.Write(data)
+	n1.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	head, body = readMsg(t, n2)
+	if head.MainType != core.MsgPush || head.SubType != core.MsgPushConnectRsp || !bytes.Equal(body[core.PushHeaderSize:], data) {
+		t.Errorf("push routing error")
+	}
+
+	pushHead.To = core.NodeNameToID("offlinenode")
+	buf = bytes.NewBuffer(encodeHeader(core.MsgPush, core.MsgPushConnectReq, uint32(len(data)+core.PushHeaderSize)))
+	binary.Write(buf, binary.LittleEndian, pushHead)
+	buf.Write(data)
+	n1.WriteMessage(websocket.BinaryMessage, buf.Bytes())
+	head, body = readMsg(t, n1)
+	rsp := core.PushRsp{}
+	json.Unmarshal(body, &rsp)
+	if head.SubType != core.MsgPushRsp || rsp.Error == 0 || len(body) < core.PushHeaderSize {
+		t.Errorf("push offline rsp error:%+v", rsp)
+	}
+}
+
+func TestLoginInvalidToken(t *testing.T) {
+	s, _ := New(Config{})
+	s.users = map[uint64]string{1234: "user1"}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	ws, rsp := login(t, url, "testnode1", 4321)
+	defer ws.Close()
+	if rsp.Error == 0 {
+		t.Errorf("invalid token login ok")
+	}
+}
+
+func TestSelectRelay(t *testing.T) {
+	s, _ := New(Config{})
+	add := func(n *nodeConn) *nodeConn {
+		n.id = core.NodeNameToID(n.name)
+		s.nodes.Store(n.id, n)
+		return n
+	}
+	from := add(&nodeConn{name: "fromnode", user: "u1", natType: core.NATSymmetric})
+	to := add(&nodeConn{name: "tonode00", user: "u2", natType: core.NATSymmetric})
+	add(&nodeConn{name: "symmetric", user: "u1", natType: core.NATSymmetric})
+	add(&nodeConn{name: "noshare0", user: "u3", hasIPv4: 1})
+	public := add(&nodeConn{name: "public00", user: "u3", hasIPv4: 1, shareBandwidth: 10})
+	if relay := s.selectRelay(from, to, "", nil); relay != public {
+		t.Errorf("want public relay, got %v", relay)
+	}
+	private := add(&nodeConn{name: "private0", user: "u1", natType: core.NATCone})
+	if relay := s.selectRelay(from, to, "", nil); relay != private {
+		t.Errorf("want private relay, got %v", relay)
+	}
+	if relay := s.selectRelay(from, to, "public00", nil); relay != public {
+		t.Errorf("want pinned relay, got %v", relay)
+	}
+	if relay := s.selectRelay(from, to, "noshare0", nil); relay != nil {
+		t.Errorf("want no relay, got %v", relay)
+	}
+	if relay := s.selectRelay(from, to, "", []string{"private0"}); relay != public {
+		t.Errorf("want the relay not excluded, got %v", relay)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	s, _ := New(Config{})
+	s.revoked = []string{"revokedkey"}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	dial := func(node string, identity string) (*websocket.Conn, core.LoginRsp) {
+		ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s%s?node=%s&token=1&identity=%s", url, loginPath, node, identity), nil)
+		if err != nil {
+			t.Fatalf("dial error:%s", err)
+		}
+		rsp := core.LoginRsp{}
+		_, body := readMsg(t, ws)
+		json.Unmarshal(body, &rsp)
+		return ws, rsp
+	}
+	ws, rsp := dial("testnode1", "revokedkey")
+	ws.Close()
+	if rsp.Error == 0 {
+		t.Errorf("revoked identity login ok")
+	}
+
+	n1, rsp := dial("testnode1", "key1")
+	defer n1.Close()
+	if rsp.Error != 0 {
+		t.Fatalf("login error:%+v", rsp)
+	}
+	head, body := readMsg(t, n1)
+	revoked := core.RevokedIdentities{}
+	json.Unmarshal(body, &revoked)
+	if head.SubType != core.MsgPushRevokedIdentities || len(revoked.Identities) != 1 {
+		t.Errorf("revoked list push error:%d %s", head.SubType, body)
+	}
+
+	data, _ := json.Marshal(core.QueryPeerInfoReq{PeerNode: "testnode1"})
+	n1.WriteMessage(websocket.BinaryMessage, append(encodeHeader(core.MsgQuery, core.MsgQueryPeerInfoReq, uint32(len(data))), data...))
+	_, body = readMsg(t, n1)
+	peer := core.QueryPeerInfoRsp{}
+	json.Unmarshal(body, &peer)
+	if peer.Identity != "key1" {
+		t.Errorf("peer identity error:%+v", peer)
+	}
+}
+
+func TestReloadRevoked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked.json")
+	os.WriteFile(path, []byte(`["key2"]`), 0644)
+	s, err := New(Config{RevokedFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("%s%s?node=testnode1&token=1&identity=key1", url, loginPath), nil)
+	if err != nil {
+		t.Fatalf("dial error:%s", err)
+	}
+	defer ws.Close()
+	readRevoked := func() []string {
+		head, body := readMsg(t, ws)
+		revoked := core.RevokedIdentities{}
+		json.Unmarshal(body, &revoked)
+		if head.SubType != core.MsgPushRevokedIdentities {
+			t.Fatalf("want revoked list push, got %d:%d", head.MainType, head.SubType)
+		}
+		return revoked.Identities
+	}
+	readMsg(t, ws) // login rsp
+	if revoked := readRevoked(); len(revoked) != 1 {
+		t.Errorf("revoked list push error:%v", revoked)
+	}
+
+	os.WriteFile(path, []byte(`[]`), 0644)
+	if err = s.ReloadRevoked(); err != nil {
+		t.Fatal(err)
+	}
+	if revoked := readRevoked(); len(revoked) != 0 {
+		t.Errorf("empty revoked list not pushed:%v", revoked)
+	}
+
+	os.WriteFile(path, []byte(`["key1"]`), 0644)
+	if err = s.ReloadRevoked(); err != nil {
+		t.Fatal(err)
+	}
+	if s.node(core.NodeNameToID("testnode1")) != nil {
+		t.Errorf("revoked node still online")
+	}
+}
+
+func TestNATBehavior(t *testing.T) {
+	s, _ := New(Config{})
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	n1, rsp := login(t, url, "testnode1", 0)
+	defer n1.Close()
+	if rsp.Error != 0 {
+		t.Fatalf("login error:%+v", rsp)
+	}
+
+	data, _ := json.Marshal(core.ReportBasic{NatBehavior: &core.NATBehavior{Mapping: core.NATEndpointIndependent, Filtering: core.NATAddressAndPortDependent}})
+	n1.WriteMessage(websocket.BinaryMessage, append(encodeHeader(core.MsgReport, core.MsgReportBasic, uint32(len(data))), data...))
+	data, _ = json.Marshal(core.QueryPeerInfoReq{PeerNode: "testnode1"})
+	n1.WriteMessage(websocket.BinaryMessage, append(encodeHeader(core.MsgQuery, core.MsgQueryPeerInfoReq, uint32(len(data))), data...))
+	_, body := readMsg(t, n1)
+	peer := core.QueryPeerInfoRsp{}
+	json.Unmarshal(body, &peer)
+	if peer.NatBehavior == nil || peer.NatBehavior.Mapping != core.NATEndpointIndependent || peer.NatBehavior.Filtering != core.NATAddressAndPortDependent {
+		t.Errorf("peer nat behavior error:%+v", peer.NatBehavior)
+	}
+}
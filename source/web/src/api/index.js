@@ -36,6 +36,7 @@ api.interceptors.response.use(
         if (error.response) {
             if (error.response.status === 401) {
                 localStorage.removeItem('token')
+                localStorage.removeItem('tokenExpires')
                 router.push('/login')
                 return Promise.reject(new Error('未授权，请重新登录'))
             }
@@ -56,6 +57,14 @@ export const register = (userData) => {
     return api.post('/auth/register', userData)
 }
 
+export const logout = (token) => {
+    return api.post('/auth/logout', null, { headers: { Authorization: token } })
+}
+
+export const refreshToken = () => {
+    return api.post('/auth/refresh')
+}
+
 export const getUserInfo = () => {
     return api.get('/user/info')
 }
@@ -65,6 +74,23 @@ export const updateUserInfo = (userData) => {
     return api.put('/user/info', userData)
 }
 
+// 用户管理API，仅管理员
+export const getUsers = () => {
+    return api.get('/users')
+}
+
+export const inviteUser = (userData) => {
+    return api.post('/users', userData)
+}
+
+export const updateUser = (username, userData) => {
+    return api.put(`/users/${username}`, userData)
+}
+
+export const removeUser = (username) => {
+    return api.delete(`/users/${username}`)
+}
+
 // 统计数据API
 export const getStats = () => {
     return api.get('/stats')
@@ -198,6 +224,38 @@ export const getLogs = (params) => {
     return api.get('/logs', { params })
 }
 
+// 实时日志，SSE 需要带认证头，所以用 fetch 读取流。返回 AbortController 用于停止
+export const streamLogs = (params, onLog) => {
+    const controller = new AbortController()
+    const query = new URLSearchParams()
+    Object.entries(params || {}).forEach(([k, v]) => {
+        if (v !== undefined && v !== '') query.append(k, v)
+    })
+    fetch(`/api/logs/stream?${query}`, {
+        headers: { Authorization: localStorage.getItem('token') || '' },
+        signal: controller.signal
+    }).then(async (response) => {
+        if (!response.ok) throw new Error(`HTTP ${response.status}`)
+        const reader = response.body.getReader()
+        const decoder = new TextDecoder()
+        let buffer = ''
+        for (;;) {
+            const { done, value } = await reader.read()
+            if (done) break
+            buffer += decoder.decode(value, { stream: true })
+            const events = buffer.split('\n\n')
+            buffer = events.pop()
+            events.forEach((event) => {
+                const data = event.split('\n').filter(line => line.startsWith('data: ')).map(line => line.slice(6)).join('\n')
+                if (data) onLog(JSON.parse(data))
+            })
+        }
+    }).catch((error) => {
+        if (error.name !== 'AbortError') console.error('Log stream error:', error)
+    })
+    return controller
+}
+
 export const exportLogs = (params) => {
     return api.get('/logs/export', { 
         params,
@@ -220,7 +278,3 @@ export const checkAdminExists = async () => {
         throw error
     }
 }
-
-export const deleteAdmin = (data) => {
-    return api.post('/auth/delete-admin', data)
-}
\ No newline at end of file
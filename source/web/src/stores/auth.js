@@ -1,6 +1,6 @@
 import { defineStore } from 'pinia'
 import { ref } from 'vue'
-import { login as loginApi, register as registerApi, getUserInfo as getUserInfoApi, updateUserInfo as updateUserInfoApi } from '../api'
+import { login as loginApi, register as registerApi, logout as logoutApi, refreshToken as refreshTokenApi, getUserInfo as getUserInfoApi, updateUserInfo as updateUserInfoApi } from '../api'
 
 // 用户认证状态管理
 export const useAuthStore = defineStore('auth', () => {
@@ -8,16 +8,43 @@ export const useAuthStore = defineStore('auth', () => {
   const user = ref(JSON.parse(localStorage.getItem('user')) || null)
   const role = ref(localStorage.getItem('role') || '')
   const loading = ref(false)
+  let refreshTimer = null
+
+  // 保存token，并在过期前10分钟自动刷新
+  const setToken = (newToken, expires) => {
+    token.value = newToken
+    localStorage.setItem('token', newToken)
+    if (expires) {
+      localStorage.setItem('tokenExpires', String(expires))
+    }
+    scheduleRefresh()
+  }
+
+  const scheduleRefresh = () => {
+    clearTimeout(refreshTimer)
+    const expires = Number(localStorage.getItem('tokenExpires') || 0)
+    if (!token.value || !expires) return
+    const delay = Math.max(expires * 1000 - Date.now() - 10 * 60 * 1000, 60 * 1000)
+    refreshTimer = setTimeout(async () => {
+      try {
+        const response = await refreshTokenApi()
+        if (response.code === 0) {
+          setToken(response.data.token, response.data.expires)
+        }
+      } catch (error) {
+        console.error('Refresh token failed:', error)
+      }
+    }, delay)
+  }
 
   // 登录
   const login = async (credentials) => {
     loading.value = true
     try {
       const response = await loginApi(credentials)
-      token.value = response.data.token
       role.value = response.data.role || 'admin'
-      localStorage.setItem('token', response.data.token)
       localStorage.setItem('role', response.data.role || 'admin')
+      setToken(response.data.token, response.data.expires)
       
       // 登录成功后获取用户信息
       await fetchUserInfo()
@@ -85,21 +112,28 @@ export const useAuthStore = defineStore('auth', () => {
 
   // 登出
   const logout = () => {
+    if (token.value) {
+      logoutApi(token.value).catch(() => {}) // 服务端作废会话，失败不影响本地登出
+    }
+    clearTimeout(refreshTimer)
     token.value = ''
     role.value = ''
     user.value = null
     localStorage.removeItem('token')
+    localStorage.removeItem('tokenExpires')
     localStorage.removeItem('role')
     localStorage.removeItem('user')
   }
 
-  // 检查用户是否有权限访问某个功能
-  const hasPermission = (permission) => {
-    if (!role.value || role.value !== 'admin') return false
-    return true
+  // 检查用户是否有权限访问某个功能，permission 为所需的最低角色
+  const roleLevels = { readonly: 1, operator: 2, admin: 3 }
+  const hasPermission = (permission = 'admin') => {
+    const level = roleLevels[role.value] || 0
+    return level > 0 && level >= (roleLevels[permission] || roleLevels.admin)
   }
 
   // 初始化时检查token
+  scheduleRefresh()
   if (token.value && !user.value) {
     // 如果有token但没有用户信息，尝试获取用户信息
     fetchUserInfo()
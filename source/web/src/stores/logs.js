@@ -10,18 +10,23 @@ export const useLogsStore = defineStore('logs', () => {
   const currentPage = ref(1)
   const pageSize = ref(10)
   const logLevel = ref('all')
+  const keyword = ref('')
+  const timeRange = ref(null) // [start, end] Date
 
   // 获取日志列表
   const fetchLogs = async () => {
     loading.value = true
     try {
-      const data = await getLogs({
-        page: currentPage.value,
-        pageSize: pageSize.value,
-        level: logLevel.value !== 'all' ? logLevel.value : undefined
+      const response = await getLogs({
+        offset: (currentPage.value - 1) * pageSize.value,
+        limit: pageSize.value,
+        level: logLevel.value !== 'all' ? logLevel.value : undefined,
+        keyword: keyword.value || undefined,
+        start: timeRange.value ? timeRange.value[0].getTime() : undefined,
+        end: timeRange.value ? timeRange.value[1].getTime() : undefined
       })
-      logs.value = data.logs
-      total.value = data.total
+      logs.value = response.data.logs
+      total.value = response.data.total
     } catch (error) {
       console.error('获取日志列表失败:', error)
     } finally {
@@ -49,6 +54,14 @@ export const useLogsStore = defineStore('logs', () => {
     fetchLogs()
   }
 
+  // 更新关键字和时间范围筛选
+  const updateFilter = (newKeyword, newTimeRange) => {
+    keyword.value = newKeyword
+    timeRange.value = newTimeRange
+    currentPage.value = 1
+    fetchLogs()
+  }
+
   return {
     logs,
     loading,
@@ -56,7 +69,10 @@ export const useLogsStore = defineStore('logs', () => {
     currentPage,
     pageSize,
     logLevel,
+    keyword,
+    timeRange,
     fetchLogs,
+    updateFilter,
     updatePageSize,
     updateCurrentPage,
     updateLogLevel